@@ -0,0 +1,278 @@
+// Package arena is a cache that keeps its entries in a few large byte
+// slices, in the style of freecache and bigcache, so that the garbage
+// collector has almost nothing to scan however many entries it holds.
+//
+// The cache is split into shards, each a ring buffer that entries are
+// appended to and an index from the hash of a key to the offset of its
+// entry. Neither holds pointers. When a shard is full, its oldest entries
+// are overwritten, whether or not they were used recently.
+package arena
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math"
+	"sync"
+)
+
+const (
+	// hash | key length | value length
+	headerSize = 8 + 4 + 4
+
+	// the key length of the filler that pads out the end of a lap
+	filler = math.MaxUint32
+
+	minShardBytes = 1 << 10
+)
+
+// Cache is a cache of byte slices. It is safe for concurrent access.
+type Cache struct {
+	seed   maphash.Seed
+	shards []*shard
+	mask   uint64
+	// optional and executed when an entry is overwritten or replaced by
+	// one whose key has the same hash. value is only valid during the
+	// call.
+	OnEvicted func(key string, value []byte)
+}
+
+type shard struct {
+	mu    sync.Mutex
+	buf   []byte
+	index map[uint64]uint32 // hash of the key -> offset of the entry
+	// logical positions of the oldest entry and of the next write; the
+	// physical offset is the position modulo len(buf)
+	start, end uint64
+	nbytes     int64 // bytes of the keys and values in the index
+}
+
+// New returns a cache of about maxBytes, split into shards shards, which
+// is rounded up to a power of two.
+func New(maxBytes int64, shards int, onEvicted func(key string, value []byte)) *Cache {
+	n := 1
+	for n < shards {
+		n *= 2
+	}
+	size := max(maxBytes/int64(n), minShardBytes)
+	size = min(size, math.MaxUint32)
+	c := &Cache{
+		seed:      maphash.MakeSeed(),
+		shards:    make([]*shard, n),
+		mask:      uint64(n - 1),
+		OnEvicted: onEvicted,
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{buf: make([]byte, size), index: make(map[uint64]uint32)}
+	}
+	return c
+}
+
+func (c *Cache) shard(key string) (*shard, uint64) {
+	hash := maphash.String(c.seed, key)
+	return c.shards[hash&c.mask], hash
+}
+
+// Add adds a value to the cache. It returns false if the entry is too
+// large to fit in a shard, in which case key's old value is removed all
+// the same.
+func (c *Cache) Add(key string, value []byte) bool {
+	s, hash := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(c, hash, key, value)
+}
+
+// Get returns a copy of key's value.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	s, hash := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, ok := s.lookup(hash, key)
+	if !ok {
+		return nil, false
+	}
+	_, value := s.entry(off)
+	return append([]byte(nil), value...), true
+}
+
+// Remove removes the provided key from the cache. Its entry takes up
+// space until it is overwritten.
+func (c *Cache) Remove(key string) {
+	s, hash := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off, ok := s.lookup(hash, key); ok {
+		s.unindex(hash, off)
+	}
+}
+
+// Keys returns the keys in the cache, shard by shard from newest to
+// oldest.
+func (c *Cache) Keys() []string {
+	var keys []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		var shardKeys []string
+		s.each(func(hash uint64, off uint32) {
+			key, _ := s.entry(off)
+			shardKeys = append(shardKeys, key)
+		})
+		s.mu.Unlock()
+		for i := len(shardKeys) - 1; i >= 0; i-- {
+			keys = append(keys, shardKeys[i])
+		}
+	}
+	return keys
+}
+
+// Len the number of cache entries
+func (c *Cache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.index)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Bytes returns the bytes taken by the cache's keys and values.
+func (c *Cache) Bytes() int64 {
+	var n int64
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.nbytes
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (s *shard) add(c *Cache, hash uint64, key string, value []byte) bool {
+	size := uint64(len(s.buf))
+	n := uint64(headerSize + len(key) + len(value))
+	if off, ok := s.index[hash]; ok {
+		if old, value := s.entryBytes(off); string(old) != key && c.OnEvicted != nil {
+			c.OnEvicted(string(old), value)
+		}
+		s.unindex(hash, off)
+	}
+	// the old value is gone even if the new one doesn't fit
+	if n > size {
+		return false
+	}
+
+	p := s.end % size
+	if p+n > size {
+		// entries don't wrap around, pad out the rest of the lap
+		s.reserve(c, size-p)
+		if size-p >= headerSize {
+			s.putHeader(p, 0, filler, uint32(size-p-headerSize))
+		}
+		s.end += size - p
+		p = 0
+	}
+	s.reserve(c, n)
+	s.putHeader(p, hash, uint32(len(key)), uint32(len(value)))
+	copy(s.buf[p+headerSize:], key)
+	copy(s.buf[p+headerSize+uint64(len(key)):], value)
+	s.end += n
+	s.index[hash] = uint32(p)
+	s.nbytes += int64(len(key) + len(value))
+	return true
+}
+
+// reserve overwrites the oldest entries until n more bytes fit.
+func (s *shard) reserve(c *Cache, n uint64) {
+	for s.end+n-s.start > uint64(len(s.buf)) {
+		s.start += s.evictOldest(c)
+	}
+}
+
+// evictOldest drops the oldest entry, if it is still indexed, and
+// returns the bytes it took.
+func (s *shard) evictOldest(c *Cache) uint64 {
+	size := uint64(len(s.buf))
+	p := s.start % size
+	if size-p < headerSize {
+		// too short for a filler
+		return size - p
+	}
+	hash, keyLen, valueLen := s.header(p)
+	if keyLen == filler {
+		return headerSize + uint64(valueLen)
+	}
+	if off, ok := s.index[hash]; ok && uint64(off) == p {
+		if c.OnEvicted != nil {
+			key, value := s.entry(off)
+			c.OnEvicted(key, value)
+		}
+		s.unindex(hash, off)
+	}
+	return headerSize + uint64(keyLen) + uint64(valueLen)
+}
+
+// each calls fn for every indexed entry, oldest first.
+func (s *shard) each(fn func(hash uint64, off uint32)) {
+	size := uint64(len(s.buf))
+	for pos := s.start; pos < s.end; {
+		p := pos % size
+		if size-p < headerSize {
+			pos += size - p
+			continue
+		}
+		hash, keyLen, valueLen := s.header(p)
+		if keyLen == filler {
+			pos += headerSize + uint64(valueLen)
+			continue
+		}
+		if off, ok := s.index[hash]; ok && uint64(off) == p {
+			fn(hash, off)
+		}
+		pos += headerSize + uint64(keyLen) + uint64(valueLen)
+	}
+}
+
+func (s *shard) lookup(hash uint64, key string) (uint32, bool) {
+	off, ok := s.index[hash]
+	if !ok {
+		return 0, false
+	}
+	if k, _ := s.entryBytes(off); string(k) != key {
+		return 0, false
+	}
+	return off, true
+}
+
+func (s *shard) unindex(hash uint64, off uint32) {
+	_, keyLen, valueLen := s.header(uint64(off))
+	s.nbytes -= int64(keyLen) + int64(valueLen)
+	delete(s.index, hash)
+}
+
+func (s *shard) header(p uint64) (hash uint64, keyLen, valueLen uint32) {
+	h := s.buf[p : p+headerSize]
+	return binary.LittleEndian.Uint64(h), binary.LittleEndian.Uint32(h[8:]), binary.LittleEndian.Uint32(h[12:])
+}
+
+func (s *shard) putHeader(p, hash uint64, keyLen, valueLen uint32) {
+	h := s.buf[p : p+headerSize]
+	binary.LittleEndian.PutUint64(h, hash)
+	binary.LittleEndian.PutUint32(h[8:], keyLen)
+	binary.LittleEndian.PutUint32(h[12:], valueLen)
+}
+
+// entry returns the key of the entry at off and its value, which points
+// into the shard.
+func (s *shard) entry(off uint32) (string, []byte) {
+	key, value := s.entryBytes(off)
+	return string(key), value
+}
+
+// entryBytes is entry without copying the key.
+func (s *shard) entryBytes(off uint32) (key, value []byte) {
+	p := uint64(off)
+	_, keyLen, valueLen := s.header(p)
+	k := p + headerSize
+	v := k + uint64(keyLen)
+	return s.buf[k:v], s.buf[v : v+uint64(valueLen)]
+}
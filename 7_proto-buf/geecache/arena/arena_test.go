@@ -0,0 +1,94 @@
+package arena
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	c := New(1<<20, 4, nil)
+	c.Add("key1", []byte("1234"))
+	if v, ok := c.Get("key1"); !ok || string(v) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, ok := c.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+	c.Add("key1", []byte("5678"))
+	if v, _ := c.Get("key1"); string(v) != "5678" || c.Len() != 1 || c.Bytes() != 8 {
+		t.Fatalf("expected key1 to be replaced, got %q, %d entries, %d bytes", v, c.Len(), c.Bytes())
+	}
+	c.Remove("key1")
+	if _, ok := c.Get("key1"); ok || c.Len() != 0 || c.Bytes() != 0 {
+		t.Fatalf("expected key1 to be removed")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	var evicted []string
+	// one shard with room for four entries of 16+2+10 bytes
+	c := New(4*28, 1, func(key string, value []byte) {
+		evicted = append(evicted, key+"="+string(value[:1]))
+	})
+	c.shards[0].buf = make([]byte, 4*28)
+	for i := 0; i < 6; i++ {
+		c.Add(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("%d.........", i)))
+	}
+	c.Remove("k3")
+
+	if want := []string{"k0=0", "k1=1"}; !reflect.DeepEqual(evicted, want) {
+		t.Fatalf("expected %v to be evicted, got %v", want, evicted)
+	}
+	if want := []string{"k5", "k4", "k2"}; !reflect.DeepEqual(c.Keys(), want) {
+		t.Fatalf("expected keys %v, got %v", want, c.Keys())
+	}
+	if c.Add("big", make([]byte, 4*28)) {
+		t.Fatal("expected an entry larger than a shard to be refused")
+	}
+}
+
+// TestRandom checks the cache against a map through many laps of its
+// ring buffers, with entries of every size.
+func TestRandom(t *testing.T) {
+	model := make(map[string]string)
+	c := New(4<<10, 4, func(key string, value []byte) {
+		if model[key] != string(value) {
+			t.Fatalf("evicted %s=%q, expected %q", key, value, model[key])
+		}
+		delete(model, key)
+	})
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(200))
+		switch rnd.Intn(4) {
+		case 0:
+			c.Remove(key)
+			delete(model, key)
+		default:
+			value := make([]byte, rnd.Intn(300))
+			rnd.Read(value)
+			if c.Add(key, value) {
+				model[key] = string(value)
+			}
+		}
+		want, cached := model[key]
+		if v, ok := c.Get(key); ok != cached || string(v) != want {
+			t.Fatalf("step %d: %s is %q, expected %q", i, key, v, want)
+		}
+	}
+	if c.Len() != len(model) {
+		t.Fatalf("expected %d entries, got %d", len(model), c.Len())
+	}
+	var n int64
+	for key, value := range model {
+		n += int64(len(key) + len(value))
+		if v, ok := c.Get(key); !ok || string(v) != value {
+			t.Fatalf("expected %s to be cached", key)
+		}
+	}
+	if c.Bytes() != n {
+		t.Fatalf("expected %d bytes, got %d", n, c.Bytes())
+	}
+}
@@ -0,0 +1,204 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	busWindow   = 4096 // invalidations kept for replay
+	busMaxBatch = 256
+	busRetryMin = 50 * time.Millisecond
+	busRetryMax = 2 * time.Second
+)
+
+// bus fans invalidations out to every peer asynchronously. Each one gets
+// a sequence number, and the last busWindow of them are kept so that a
+// peer that was unreachable for a while is sent everything it missed once
+// it is back. A peer that missed more than that can't know which keys to
+// drop, so it drops all of its copies of remote values instead.
+type bus struct {
+	origin string
+	epoch  uint64
+	apply  func(group, key string) // drop a copy on this node
+	purge  func()                  // drop every copy of remote values
+
+	mu      sync.Mutex // guards everything below
+	seq     uint64
+	log     []*pb.Invalidation // the replay window, oldest first
+	peers   map[string]*busPeer
+	origins map[string]*busOrigin
+}
+
+// busPeer is the sending side's view of one peer.
+type busPeer struct {
+	send  func(*pb.InvalidationBatch) (uint64, error)
+	acked uint64
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+// busOrigin is the receiving side's view of one sender.
+type busOrigin struct {
+	epoch uint64
+	seq   uint64
+}
+
+func newBus(origin string, apply func(group, key string), purge func()) *bus {
+	return &bus{
+		origin:  origin,
+		epoch:   uint64(time.Now().UnixNano()),
+		apply:   apply,
+		purge:   purge,
+		peers:   make(map[string]*busPeer),
+		origins: make(map[string]*busOrigin),
+	}
+}
+
+// publish queues an invalidation for every peer.
+func (b *bus) publish(group, key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	b.log = append(b.log, &pb.Invalidation{Seq: b.seq, Group: group, Key: key})
+	if len(b.log) > busWindow {
+		b.log = b.log[len(b.log)-busWindow:]
+	}
+	for _, bp := range b.peers {
+		bp.signal()
+	}
+}
+
+// setPeers starts sending to the peers in senders that are new and stops
+// sending to those that are gone. New peers only get invalidations
+// published from now on.
+func (b *bus) setPeers(senders map[string]func(*pb.InvalidationBatch) (uint64, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, bp := range b.peers {
+		if _, ok := senders[name]; !ok {
+			close(bp.done)
+			delete(b.peers, name)
+		}
+	}
+	for name, send := range senders {
+		if bp, ok := b.peers[name]; ok {
+			bp.send = send
+			continue
+		}
+		bp := &busPeer{
+			send:  send,
+			acked: b.seq,
+			wake:  make(chan struct{}, 1),
+			done:  make(chan struct{}),
+		}
+		b.peers[name] = bp
+		go b.run(name, bp)
+	}
+}
+
+func (bp *busPeer) signal() {
+	select {
+	case bp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers invalidations to one peer, retrying with backoff while it
+// can't be reached.
+func (b *bus) run(name string, bp *busPeer) {
+	retry := time.NewTimer(busRetryMin)
+	retry.Stop()
+	defer retry.Stop()
+	backoff := busRetryMin
+	for {
+		select {
+		case <-bp.done:
+			return
+		case <-bp.wake:
+		case <-retry.C:
+		}
+
+		batch, send := b.pending(bp)
+		if batch == nil {
+			continue
+		}
+		acked, err := send(batch)
+		if err != nil {
+			log.Println("[GeeCache] Failed to send invalidations to", name, err)
+			retry.Reset(backoff)
+			backoff = min(2*backoff, busRetryMax)
+			continue
+		}
+		backoff = busRetryMin
+		b.ack(bp, acked)
+	}
+}
+
+// pending returns the invalidations bp hasn't acknowledged yet, or nil.
+func (b *bus) pending(bp *busPeer) (*pb.InvalidationBatch, func(*pb.InvalidationBatch) (uint64, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bp.acked >= b.seq || len(b.log) == 0 {
+		return nil, nil
+	}
+	// b.log is contiguous, so the first unacknowledged entry is found by
+	// offset; if it has left the window, start at the oldest we have
+	start := 0
+	if first := b.log[0].Seq; bp.acked >= first {
+		start = int(bp.acked - first + 1)
+	}
+	end := min(start+busMaxBatch, len(b.log))
+	return &pb.InvalidationBatch{
+		Origin:        b.origin,
+		Epoch:         b.epoch,
+		Invalidations: b.log[start:end],
+	}, bp.send
+}
+
+func (b *bus) ack(bp *busPeer, seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq > bp.acked {
+		bp.acked = seq
+	}
+	if bp.acked < b.seq {
+		bp.signal()
+	}
+}
+
+// receive applies a batch from another node and returns the highest
+// sequence number applied from that node.
+func (b *bus) receive(batch *pb.InvalidationBatch) uint64 {
+	b.mu.Lock()
+	o, ok := b.origins[batch.Origin]
+	if !ok || o.epoch != batch.Epoch {
+		o = &busOrigin{epoch: batch.Epoch}
+		b.origins[batch.Origin] = o
+	}
+	var apply []*pb.Invalidation
+	gap := false
+	for _, inv := range batch.Invalidations {
+		if inv.Seq <= o.seq {
+			continue
+		}
+		if inv.Seq > o.seq+1 {
+			gap = true
+		}
+		apply = append(apply, inv)
+		o.seq = inv.Seq
+	}
+	seq := o.seq
+	b.mu.Unlock()
+
+	if gap {
+		log.Println("[GeeCache] Missed invalidations from", batch.Origin, "dropping remote copies")
+		b.purge()
+	}
+	for _, inv := range apply {
+		b.apply(inv.Group, inv.Key)
+	}
+	return seq
+}
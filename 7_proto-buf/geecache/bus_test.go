@@ -0,0 +1,198 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// cacheEverywhere puts a copy of key on every node of c.
+func cacheEverywhere(t *testing.T, c *testCluster, key string) {
+	t.Helper()
+	if _, err := c.nodes[0].group.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes {
+		g := node.group
+		if _, ok := g.lookupCache(key); !ok {
+			g.hotCache.add(g.cacheKey(key), ByteView{b: []byte(key)})
+		}
+	}
+}
+
+func cachedOn(c *testCluster, key string) (nodes []*testNode) {
+	for _, node := range c.nodes {
+		if _, ok := node.group.lookupCache(key); ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func TestBusConvergence(t *testing.T) {
+	c := newTestCluster(t, 3, "bus", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+
+	cacheEverywhere(t, c, "k")
+	if _, err := c.nodes[1].group.Remove("k"); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second, func() bool { return len(cachedOn(c, "k")) == 0 }) {
+		t.Fatalf("k still cached on %d nodes", len(cachedOn(c, "k")))
+	}
+}
+
+func TestBusOnSet(t *testing.T) {
+	c := newTestCluster(t, 3, "bus-set", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+
+	sets := map[string]func(g *Group, key string) error{
+		"Set":       func(g *Group, key string) error { return g.Set(key, []byte("new")) },
+		"SetString": func(g *Group, key string) error { return g.SetString(key, "new") },
+		"LeaseSet": func(g *Group, key string) error {
+			// a miss on the owner only, without a broadcast
+			owner := c.owner(key).group
+			owner.mainCache.remove(owner.cacheKey(key))
+			lease, err := g.LeaseGet(key)
+			if err != nil {
+				return err
+			}
+			return g.LeaseSet(key, lease.Token, []byte("new"))
+		},
+	}
+	for name, set := range sets {
+		key := "k-" + name
+		cacheEverywhere(t, c, key)
+		// from a node that doesn't own the key, so both the owner's PUT
+		// and the caller's own copy are covered
+		from := c.nodes[0]
+		if c.owner(key) == from {
+			from = c.nodes[1]
+		}
+		if err := set(from.group, key); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !waitFor(time.Second, func() bool {
+			for _, node := range c.nodes {
+				if v, ok := node.group.lookupCache(key); ok && v.String() != "new" {
+					return false
+				}
+			}
+			return true
+		}) {
+			t.Fatalf("%s: old copies of %s still cached", name, key)
+		}
+	}
+}
+
+func TestBusReplaysToUnreachablePeer(t *testing.T) {
+	c := newTestCluster(t, 3, "bus-replay", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	down := c.nodes[2]
+	// keys down only holds copies of: the copy of an owner that missed a
+	// Remove is left to the caller, who got an error
+	var keys []string
+	for i := 0; len(keys) < 4; i++ {
+		if key := fmt.Sprintf("k-%d", i); c.owner(key) != down {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		cacheEverywhere(t, c, key)
+	}
+
+	down.down.Store(true)
+	for _, key := range keys {
+		c.nodes[0].group.Remove(key)
+	}
+	if !waitFor(time.Second, func() bool {
+		for _, key := range keys {
+			if nodes := cachedOn(c, key); len(nodes) != 1 || nodes[0] != down {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("reachable nodes didn't drop their copies")
+	}
+
+	down.down.Store(false)
+	if !waitFor(5*time.Second, func() bool {
+		for _, key := range keys {
+			if len(cachedOn(c, key)) != 0 {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("node didn't catch up after coming back")
+	}
+}
+
+func TestBusLateRemoveKeepsOwnersValue(t *testing.T) {
+	c := newTestCluster(t, 3, "bus-late", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	key, owner := remoteKey(c)
+	// a key the owner only holds a copy of, to tell when the broadcast
+	// has reached it
+	other := ""
+	for i := 0; other == ""; i++ {
+		if k := fmt.Sprintf("other-%d", i); c.owner(k) != owner {
+			other = k
+		}
+	}
+	cacheEverywhere(t, c, key)
+	cacheEverywhere(t, c, other)
+
+	// the owner misses the Remove and its broadcast until after a Set
+	owner.down.Store(true)
+	c.nodes[0].group.Remove(key)
+	c.nodes[0].group.Remove(other)
+	if err := owner.group.Set(key, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	owner.down.Store(false)
+	if !waitFor(5*time.Second, func() bool {
+		_, ok := owner.group.lookupCache(other)
+		return !ok
+	}) {
+		t.Fatal("owner didn't receive the broadcast")
+	}
+	if v, ok := owner.group.lookupCache(key); !ok || v.String() != "new" {
+		t.Fatalf("expected the owner to keep the value set, got %q, %v", v, ok)
+	}
+}
+
+func TestBusGap(t *testing.T) {
+	var applied []string
+	purged := false
+	b := newBus("self", func(group, key string) {
+		applied = append(applied, key)
+	}, func() { purged = true })
+
+	batch := &pb.InvalidationBatch{Origin: "peer", Epoch: 1, Invalidations: []*pb.Invalidation{
+		{Seq: 1, Group: "g", Key: "a"},
+		{Seq: 2, Group: "g", Key: "b"},
+	}}
+	if seq := b.receive(batch); seq != 2 || purged {
+		t.Fatalf("expected seq 2 without a purge, got %d, %v", seq, purged)
+	}
+	// a replay of what was already applied is ignored
+	if seq := b.receive(batch); seq != 2 || len(applied) != 2 {
+		t.Fatalf("expected the replay to be ignored, got %d, %v", seq, applied)
+	}
+	// 3 and 4 fell out of the sender's window
+	batch.Invalidations = []*pb.Invalidation{{Seq: 5, Group: "g", Key: "e"}}
+	if seq := b.receive(batch); seq != 5 || !purged {
+		t.Fatalf("expected seq 5 and a purge, got %d, %v", seq, purged)
+	}
+	// a restarted sender starts over
+	purged = false
+	batch = &pb.InvalidationBatch{Origin: "peer", Epoch: 2, Invalidations: []*pb.Invalidation{
+		{Seq: 1, Group: "g", Key: "f"},
+	}}
+	if seq := b.receive(batch); seq != 1 || purged || applied[len(applied)-1] != "f" {
+		t.Fatalf("expected the new epoch to start at 1, got %d, %v", seq, applied)
+	}
+}
@@ -1,23 +1,317 @@
 package geecache
 
-// A ByteView holds an immutable view of bytes.
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// A ByteView holds an immutable view of bytes, backed by either a byte
+// slice or a string.
+//
+// The methods that read the data, from ByteSlice to Equal, see it
+// decrypted and decompressed. On a compressed or encrypted view each call
+// decodes the value again; Slice returns a plain view of the decoded data
+// for repeated use.
 type ByteView struct {
+	// If b is non-nil, b is used, else s is used.
 	b []byte
+	s string
+	e time.Time // zero if the value doesn't expire
+	c Codec     // b is compressed with c, if set
+	// b is encrypted with the key kid of k, if kid is set; encrypted
+	// after being compressed, as the value of key
+	k   *keyring
+	kid string
+	key string
+}
+
+// Expire returns the time the value expires at, or the zero time if it
+// doesn't.
+func (v ByteView) Expire() time.Time {
+	return v.e
 }
 
-// Len returns the view's length
+func (v ByteView) expired(now time.Time) bool {
+	return !v.e.IsZero() && !now.Before(v.e)
+}
+
+// Len returns the view's length, compressed and encrypted if the view is:
+// what it takes in the cache.
 func (v ByteView) Len() int {
-	return len(v.b)
+	if v.b != nil {
+		return len(v.b)
+	}
+	return len(v.s)
 }
 
-// ByteSlice returns a copy of the data as a byte slice.
+// ByteSlice returns a copy of the data as a byte slice, decrypted and
+// decompressed.
 func (v ByteView) ByteSlice() []byte {
-	return cloneBytes(v.b)
+	if v.encoded() {
+		return v.decoded()
+	}
+	if v.b != nil {
+		return cloneBytes(v.b)
+	}
+	return []byte(v.s)
 }
 
 // String returns the data as a string, making a copy if necessary.
 func (v ByteView) String() string {
-	return string(v.b)
+	if v.encoded() {
+		return string(v.decoded())
+	}
+	if v.b != nil {
+		return string(v.b)
+	}
+	return v.s
+}
+
+// At returns the byte at index i.
+func (v ByteView) At(i int) byte {
+	v = v.plain()
+	if v.b != nil {
+		return v.b[i]
+	}
+	return v.s[i]
+}
+
+// Slice slices the view between the provided from and to indices.
+func (v ByteView) Slice(from, to int) ByteView {
+	v = v.plain()
+	if v.b != nil {
+		return ByteView{b: v.b[from:to], e: v.e}
+	}
+	return ByteView{s: v.s[from:to], e: v.e}
+}
+
+// SliceFrom slices the view from the provided index until the end.
+func (v ByteView) SliceFrom(from int) ByteView {
+	v = v.plain()
+	if v.b != nil {
+		return ByteView{b: v.b[from:], e: v.e}
+	}
+	return ByteView{s: v.s[from:], e: v.e}
+}
+
+// Reader returns an io.ReadSeeker for the bytes in v, without copying
+// them.
+func (v ByteView) Reader() io.ReadSeeker {
+	v = v.plain()
+	if v.b != nil {
+		return bytes.NewReader(v.b)
+	}
+	return strings.NewReader(v.s)
+}
+
+// ReadAt implements io.ReaderAt on the bytes in v.
+func (v ByteView) ReadAt(p []byte, off int64) (n int, err error) {
+	v = v.plain()
+	if off < 0 {
+		return 0, errors.New("view: invalid offset")
+	}
+	if off >= int64(v.Len()) {
+		return 0, io.EOF
+	}
+	if v.b != nil {
+		n = copy(p, v.b[off:])
+	} else {
+		n = copy(p, v.s[off:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// WriteTo implements io.WriterTo on the bytes in v, without copying them.
+func (v ByteView) WriteTo(w io.Writer) (n int64, err error) {
+	v = v.plain()
+	var m int
+	if v.b != nil {
+		m, err = w.Write(v.b)
+	} else {
+		m, err = io.WriteString(w, v.s)
+	}
+	if err == nil && m < v.Len() {
+		err = io.ErrShortWrite
+	}
+	n = int64(m)
+	return
+}
+
+// Equal returns whether the bytes in v are the same as the bytes in b2.
+func (v ByteView) Equal(b2 ByteView) bool {
+	b2 = b2.plain()
+	if b2.b == nil {
+		return v.EqualString(b2.s)
+	}
+	return v.EqualBytes(b2.b)
+}
+
+// EqualString returns whether the bytes in v are the same as the bytes
+// in s.
+func (v ByteView) EqualString(s string) bool {
+	v = v.plain()
+	if v.b == nil {
+		return v.s == s
+	}
+	return string(v.b) == s
+}
+
+// EqualBytes returns whether the bytes in v are the same as the bytes in
+// b2.
+func (v ByteView) EqualBytes(b2 []byte) bool {
+	v = v.plain()
+	if v.b != nil {
+		return bytes.Equal(v.b, b2)
+	}
+	return v.s == string(b2)
+}
+
+// encoded reports whether v is compressed or encrypted.
+func (v ByteView) encoded() bool {
+	return v.c != nil || v.kid != ""
+}
+
+// plain returns a view of v's data decrypted and decompressed, or v
+// itself if it is neither compressed nor encrypted.
+func (v ByteView) plain() ByteView {
+	if !v.encoded() {
+		return v
+	}
+	return ByteView{b: v.decoded(), e: v.e}
+}
+
+// open is plain for a view that may not decode: it returns the error
+// rather than an empty view.
+func (v ByteView) open() (ByteView, error) {
+	if !v.encoded() {
+		return v, nil
+	}
+	b, err := v.decode()
+	if err != nil {
+		return ByteView{}, err
+	}
+	return ByteView{b: b, e: v.e}, nil
+}
+
+// raw returns the view's bytes as they are stored, which are only copied
+// if the view is backed by a string.
+func (v ByteView) raw() []byte {
+	if v.b != nil {
+		return v.b
+	}
+	return []byte(v.s)
+}
+
+// decode returns the data decrypted and decompressed.
+func (v ByteView) decode() ([]byte, error) {
+	b := v.b
+	if v.kid != "" {
+		var err error
+		if b, err = v.k.open(v.kid, b, v.key, v.codecName()); err != nil {
+			return nil, fmt.Errorf("decrypting a value with key %q: %v", v.kid, err)
+		}
+	}
+	if v.c != nil {
+		var err error
+		if b, err = v.c.Decompress(b); err != nil {
+			return nil, fmt.Errorf("decompressing a %s value: %v", v.c.Name(), err)
+		}
+	}
+	return b, nil
+}
+
+// decoded is decode for the methods that can't return an error, which
+// read a value that doesn't decode as empty. Get and LeaseGet never
+// return such a view: they decode it with open first.
+func (v ByteView) decoded() []byte {
+	b, err := v.decode()
+	if err != nil {
+		log.Println("[GeeCache]", err)
+	}
+	return b
+}
+
+// codecName returns the name of the view's codec, or "" if it isn't
+// compressed.
+func (v ByteView) codecName() string {
+	if v.c == nil {
+		return ""
+	}
+	return v.c.Name()
+}
+
+// marshalView and unmarshalView keep a view's expiry, codec and key ID
+// with its bytes, for storage that only holds byte slices:
+//
+//	8-byte expiry in unix nanoseconds
+//	codec name length byte | codec name
+//	key ID length byte | key ID
+//	bytes
+//
+// unmarshalView gives encrypted views keys to be decrypted with, and the
+// key they are the value of, from the cache key they are stored under.
+func marshalView(v ByteView) []byte {
+	name := v.codecName()
+	b := make([]byte, 8, 10+len(name)+len(v.kid)+v.Len())
+	binary.LittleEndian.PutUint64(b, uint64(unixNano(v.e)))
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	b = append(b, byte(len(v.kid)))
+	b = append(b, v.kid...)
+	if v.b != nil {
+		return append(b, v.b...)
+	}
+	return append(b, v.s...)
+}
+
+func unmarshalView(cacheKey string, b []byte, keys *keyring) (ByteView, error) {
+	short := errors.New("short value")
+	if len(b) < 9 {
+		return ByteView{}, short
+	}
+	v := ByteView{e: fromUnixNano(int64(binary.LittleEndian.Uint64(b)))}
+	b = b[8:]
+	var fields [2]string
+	for i := range fields {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return ByteView{}, short
+		}
+		fields[i], b = string(b[1:1+int(b[0])]), b[1+int(b[0]):]
+	}
+	codec, ok := codecNamed(fields[0])
+	if !ok {
+		return ByteView{}, fmt.Errorf("value compressed with unknown codec %q", fields[0])
+	}
+	v.b, v.c = b, codec
+	if v.kid = fields[1]; v.kid != "" {
+		v.k, v.key = keys, plainKey(cacheKey)
+	}
+	return v, nil
+}
+
+// unixNano and fromUnixNano carry expiry times between peers, with 0 for
+// none.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
 }
 
 func cloneBytes(b []byte) []byte {
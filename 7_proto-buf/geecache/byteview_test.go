@@ -0,0 +1,65 @@
+package geecache
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestByteView(t *testing.T) {
+	const data = "hello, geecache"
+	compressed := ByteView{b: []byte(data)}
+	compressed.c = GzipCodec{}
+	compressed.b, _ = GzipCodec{}.Compress([]byte(data))
+	for name, v := range map[string]ByteView{
+		"bytes":      {b: []byte(data)},
+		"string":     {s: data},
+		"compressed": compressed,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if v.String() != data || string(v.ByteSlice()) != data {
+				t.Fatalf("expected %q, got %q", data, v.String())
+			}
+			if v.At(7) != 'g' || v.Slice(7, 10).String() != "gee" || v.SliceFrom(7).String() != "geecache" {
+				t.Fatal("At or Slice failed")
+			}
+			if b, err := io.ReadAll(v.Reader()); err != nil || string(b) != data {
+				t.Fatalf("Reader failed: %q %v", b, err)
+			}
+			p := make([]byte, 5)
+			if n, err := v.ReadAt(p, 7); n != 5 || err != nil || string(p) != "geeca" {
+				t.Fatalf("ReadAt failed: %q %v", p, err)
+			}
+			if n, err := v.ReadAt(p, 12); n != 3 || err != io.EOF {
+				t.Fatalf("expected a short ReadAt to return EOF, got %d %v", n, err)
+			}
+			var buf bytes.Buffer
+			if n, err := v.WriteTo(&buf); n != int64(len(data)) || err != nil || buf.String() != data {
+				t.Fatalf("WriteTo failed: %d %v", n, err)
+			}
+			if !v.Equal(ByteView{s: data}) || !v.Equal(ByteView{b: []byte(data)}) || !v.EqualString(data) ||
+				!v.EqualBytes([]byte(data)) || v.EqualString(data+"!") || v.Equal(ByteView{s: "hello"}) {
+				t.Fatal("Equal failed")
+			}
+		})
+	}
+}
+
+func TestSetString(t *testing.T) {
+	g := newGroup("set-string", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, nil
+	}))
+	value := strings.Repeat("x", 100)
+	g.SetString("a", value)
+	v, ok := g.lookupCache("a")
+	if !ok || v.b != nil || v.s != value || v.Len() != 100 {
+		t.Fatalf("expected a to be kept as a string, got %+v", v)
+	}
+
+	g.SetCompression(Compression{Codec: FlateCodec{}, MinBytes: 10})
+	g.SetString("b", value)
+	if v, ok := g.lookupCache("b"); !ok || v.codecName() != "flate" || !v.EqualString(value) {
+		t.Fatal("expected b to be compressed")
+	}
+}
@@ -1,35 +1,314 @@
 package geecache
 
 import (
-	"Dcache/7_proto-buf/geecache/lru"
+	"Dcache/7_proto-buf/geecache/logstore"
+	"log"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type cache struct {
 	mu         sync.Mutex
-	lru        *lru.Cache
+	store      storage
 	cacheBytes int64
+	// if set, store is an arena of this many shards, see UseArena
+	arenaShards int
+	// tag index, kept in step with store through onEvicted
+	tags    map[string]map[string]struct{} // tag -> keys
+	keyTags map[string][]string            // key -> tags
+	// optional second tier that entries evicted from store spill to; a
+	// key is in one tier or the other, see l2.go
+	l2     *logstore.Store
+	l2Hits atomic.Int64
+	// writes waiting to be made to l2, which count as made, and the
+	// writer that makes them
+	spills    map[string]*spill
+	spillWake chan struct{}
+	spillStop chan struct{}
+	spillDone chan struct{}
+	// the keys written to l2, so that it is only read for keys it has
+	onL2 map[string]*l2Key
+	// set while entries are removed rather than evicted, so that they
+	// don't spill to l2
+	removing bool
+	// the group's keys, for values that are stored marshaled
+	keys *keyring
 }
 
-func (c *cache) add(key string, value ByteView) {
+func (c *cache) add(key string, value ByteView, tags ...string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.New(c.cacheBytes, nil)
+	c.init()
+	// index first: if the entry is evicted straight away, onEvicted
+	// cleans up after it
+	c.untag(key)
+	c.tag(key, tags)
+	c.l2Delete(key)
+	if !c.store.Add(key, value) {
+		c.untag(key)
+	}
+}
+
+// init creates the cache's storage on first use.
+func (c *cache) init() {
+	if c.store != nil {
+		return
+	}
+	if c.arenaShards > 0 && c.cacheBytes > 0 {
+		c.store = newArenaStorage(c.cacheBytes, c.arenaShards, c.keys, c.onEvicted)
+	} else {
+		c.store = newLRUStorage(c.cacheBytes, c.onEvicted)
 	}
-	c.lru.Add(key, value)
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
+	if c.store == nil {
+		return
+	}
+
+	if v, ok := c.store.Get(key); ok {
+		if v.expired(time.Now()) {
+			c.removeKey(key)
+			return ByteView{}, false
+		}
+		return v, ok
+	}
+
+	return c.promote(key)
+}
+
+// peek returns the value and tags of key if it is in store, without
+// marking it used or looking in l2.
+func (c *cache) peek(key string) (value ByteView, tags []string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return
+	}
+	value, ok = c.store.Peek(key)
+	if !ok || value.expired(time.Now()) {
+		return ByteView{}, nil, false
+	}
+	return value, c.keyTags[key], true
+}
+
+// touch sets the expiry of key to expire, if key is cached and hasn't
+// expired, and reports whether it was.
+func (c *cache) touch(key string, expire time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return false
+	}
+	value, ok := c.store.Peek(key)
+	if !ok {
+		value, ok = c.promote(key)
+	}
+	if !ok || value.expired(time.Now()) {
+		return false
+	}
+	value.e = expire
+	if !c.store.Add(key, value) {
+		c.untag(key)
+		return false
+	}
+	return true
+}
+
+// promote moves key from l2 back into store. It releases c.mu while it
+// reads from disk.
+func (c *cache) promote(key string) (ByteView, bool) {
+	if c.l2 == nil {
+		return ByteView{}, false
+	}
+	e, ok := c.l2Get(key)
+	if !ok {
+		return ByteView{}, false
+	}
+	value, err := unmarshalView(key, e.Value, c.keys)
+	if err != nil {
+		log.Println("[GeeCache] l2:", err)
+		c.l2Delete(key)
+		return ByteView{}, false
+	}
+	c.l2Hits.Add(1)
+	c.tag(key, e.Tags)
+	c.l2Delete(key)
+	if !c.store.Add(key, value) {
+		c.untag(key)
+	}
+	return value, true
+}
+
+func (c *cache) remove(key string) (value ByteView, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
 		return
 	}
 
-	if v, ok := c.lru.Get(key); ok {
-		return v.(ByteView), ok
+	if v, ok := c.store.Get(key); ok {
+		c.removeKey(key)
+		return v, true
+	}
+	if c.l2 != nil {
+		e, ok := c.l2Get(key)
+		c.l2Delete(key)
+		if ok {
+			value, err := unmarshalView(key, e.Value, c.keys)
+			return value, err == nil
+		}
 	}
 
 	return
 }
+
+// removeTag removes every entry tagged with tag and returns their keys.
+func (c *cache) removeTag(tag string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.tags[tag]))
+	for key := range c.tags[tag] {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		c.removeKey(key)
+	}
+	c.l2DeleteFunc(func(_ string, tags []string) bool {
+		return slices.Contains(tags, tag)
+	})
+	return keys
+}
+
+// removePrefix removes every entry whose key starts with prefix and
+// returns their keys.
+func (c *cache) removePrefix(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+
+	var keys []string
+	for _, key := range c.store.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			c.removeKey(key)
+			keys = append(keys, key)
+		}
+	}
+	c.l2DeleteFunc(func(key string, _ []string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	return keys
+}
+
+// removeKey removes key from store without spilling it to l2, and drops
+// any copy in l2.
+func (c *cache) removeKey(key string) {
+	c.removing = true
+	c.store.Remove(key)
+	c.removing = false
+	c.untag(key)
+	c.l2Delete(key)
+}
+
+// onEvicted is called by store for every entry it evicts. value may point
+// into the store, and is only valid during the call.
+func (c *cache) onEvicted(key string, value ByteView) {
+	tags := c.keyTags[key]
+	c.untag(key)
+	if c.l2 == nil || c.removing || value.expired(time.Now()) {
+		return
+	}
+	c.spill(key, logstore.Entry{Value: marshalView(value), Expire: value.e, Tags: tags})
+}
+
+func (c *cache) tag(key string, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	if c.tags == nil {
+		c.tags = make(map[string]map[string]struct{})
+		c.keyTags = make(map[string][]string)
+	}
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][key] = struct{}{}
+	}
+	c.keyTags[key] = tags
+}
+
+func (c *cache) untag(key string) {
+	for _, tag := range c.keyTags[key] {
+		delete(c.tags[tag], key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	delete(c.keyTags, key)
+}
+
+// cacheEntry is a copy of an entry taken out of the cache.
+type cacheEntry struct {
+	key   string
+	value ByteView
+	tags  []string
+}
+
+// entries returns the entries whose key match accepts, from most to least
+// recently used, without changing their order. An arena has no such order;
+// its entries come newest first, shard by shard.
+func (c *cache) entries(match func(key string) bool) []cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+
+	var entries []cacheEntry
+	now := time.Now()
+	for _, key := range c.store.Keys() {
+		if !match(key) {
+			continue
+		}
+		v, ok := c.store.Peek(key)
+		if !ok || v.expired(now) {
+			continue
+		}
+		entries = append(entries, cacheEntry{key: key, value: v, tags: c.keyTags[key]})
+	}
+	return entries
+}
+
+// stats returns the size of the cache.
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return CacheStats{}
+	}
+	return CacheStats{Bytes: c.store.Bytes(), Items: int64(c.store.Len())}
+}
+
+// l2Stats returns the size of the second tier.
+func (c *cache) l2Stats() CacheStats {
+	c.mu.Lock()
+	l2 := c.l2
+	c.mu.Unlock()
+	if l2 == nil {
+		return CacheStats{}
+	}
+	st := l2.Stats()
+	return CacheStats{Bytes: st.Bytes, Items: st.Items}
+}
@@ -0,0 +1,110 @@
+package geecache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCluster runs several nodes in one process. Each node has its own
+// HTTPPool and its own instance of the group, served over httptest.
+type testCluster struct {
+	name   string
+	getter Getter
+	nodes  []*testNode
+}
+
+type testNode struct {
+	addr       string
+	pool       *HTTPPool
+	group      *Group
+	srv        *httptest.Server
+	down       atomic.Bool // answer every request with 503
+	registered bool
+}
+
+func newTestCluster(t *testing.T, n int, name string, getter Getter) *testCluster {
+	t.Helper()
+	c := &testCluster{name: name, getter: getter}
+	for i := 0; i < n; i++ {
+		c.addNode()
+	}
+	c.setPeers()
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.pool.Close()
+			node.srv.Close()
+		}
+	})
+	return c
+}
+
+// addNode starts a new node. It joins the ring at the next setPeers.
+func (c *testCluster) addNode() *testNode {
+	node := &testNode{}
+	node.srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if node.down.Load() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			node.pool.ServeHTTP(w, r)
+		}))
+	node.addr = node.srv.URL
+	node.group = newGroup(c.name, 2<<10, c.getter)
+	node.pool = NewHTTPPool(node.addr)
+	node.pool.groups = map[string]*Group{c.name: node.group}
+	c.nodes = append(c.nodes, node)
+	return node
+}
+
+// setPeers gives every node the current list of nodes.
+func (c *testCluster) setPeers() {
+	var addrs []string
+	for _, node := range c.nodes {
+		addrs = append(addrs, node.addr)
+	}
+	for _, node := range c.nodes {
+		node.pool.Set(addrs...)
+		if !node.registered {
+			node.group.RegisterPeers(node.pool)
+			node.registered = true
+		}
+	}
+}
+
+// owner returns the node that owns key.
+func (c *testCluster) owner(key string) *testNode {
+	for _, node := range c.nodes {
+		if _, ok := node.pool.PickPeer(key); !ok {
+			return node
+		}
+	}
+	return nil
+}
+
+// oddKey returns a key with a space and a plus sign, which must survive
+// the trip through a URL path, that nodes[0] sends to a peer.
+func oddKey(c *testCluster) (string, *testNode) {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("a b+%d", i)
+		if owner := c.owner(key); owner != c.nodes[0] {
+			return key, owner
+		}
+	}
+}
+
+// waitFor polls cond until it holds or timeout passes.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,153 @@
+package geecache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"log"
+	"sync"
+)
+
+// A Codec compresses values. Compressed values carry the name of their
+// codec between peers and into snapshots, so every node needs the codecs
+// its peers use, registered with RegisterCodec.
+type Codec interface {
+	Name() string
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+// GzipCodec compresses with compress/gzip at Level, or the default level
+// if blank.
+type GzipCodec struct{ Level int }
+
+// FlateCodec compresses with compress/flate at Level, or the default
+// level if blank.
+type FlateCodec struct{ Level int }
+
+func (GzipCodec) Name() string { return "gzip" }
+
+func (c GzipCodec) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level(c.Level))
+	if err != nil {
+		return nil, err
+	}
+	return finish(&buf, w, b)
+}
+
+func (GzipCodec) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (FlateCodec) Name() string { return "flate" }
+
+func (c FlateCodec) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level(c.Level))
+	if err != nil {
+		return nil, err
+	}
+	return finish(&buf, w, b)
+}
+
+func (FlateCodec) Decompress(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func level(l int) int {
+	if l == 0 {
+		return flate.DefaultCompression
+	}
+	return l
+}
+
+// finish writes b through w and returns what w wrote to buf.
+func finish(buf *bytes.Buffer, w io.WriteCloser, b []byte) ([]byte, error) {
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"gzip":  GzipCodec{},
+		"flate": FlateCodec{},
+	}
+)
+
+// RegisterCodec makes c available to decompress the values peers send
+// compressed with it. The gzip and flate codecs are always registered.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// codecNamed returns the registered codec called name, or nil for "".
+func codecNamed(name string) (Codec, bool) {
+	if name == "" {
+		return nil, true
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Compression configures how a group compresses its values.
+type Compression struct {
+	// Codec compresses the values. If nil, they aren't compressed.
+	Codec Codec
+
+	// MinBytes is the size below which values are kept as they are. If
+	// blank, it defaults to 1KB.
+	MinBytes int
+}
+
+// SetCompression makes the group keep the values it loads or is given
+// compressed, once they are at least MinBytes and if compressing makes
+// them smaller. Compressed values count against the cache at their
+// compressed size, and are sent to peers as they are. It should be called
+// before the group is used.
+func (g *Group) SetCompression(c Compression) {
+	if c.Codec == nil {
+		g.compression.Store(nil)
+		return
+	}
+	if c.MinBytes <= 0 {
+		c.MinBytes = 1 << 10
+	}
+	g.compression.Store(&c)
+}
+
+// compress compresses v with the group's codec, unless it is compressed
+// or encrypted already, too small, or doesn't shrink.
+func (g *Group) compress(v ByteView) ByteView {
+	c := g.compression.Load()
+	if c == nil || v.c != nil || v.kid != "" || v.Len() < c.MinBytes {
+		return v
+	}
+	b, err := c.Codec.Compress(v.raw())
+	if err != nil {
+		log.Printf("[GeeCache] %s: compressing with %s: %v", g.name, c.Codec.Name(), err)
+		return v
+	}
+	if len(b) >= v.Len() {
+		return v
+	}
+	return ByteView{b: b, e: v.e, c: c.Codec}
+}
@@ -0,0 +1,121 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/logstore"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecs(t *testing.T) {
+	value := []byte(strings.Repeat("geecache ", 100))
+	for _, c := range []Codec{GzipCodec{}, FlateCodec{Level: 9}} {
+		b, err := c.Compress(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) >= len(value) {
+			t.Fatalf("%s: expected %d bytes to shrink, got %d", c.Name(), len(value), len(b))
+		}
+		if d, err := c.Decompress(b); err != nil || !bytes.Equal(d, value) {
+			t.Fatalf("%s: round trip failed: %v", c.Name(), err)
+		}
+		if found, ok := codecNamed(c.Name()); !ok || found.Name() != c.Name() {
+			t.Fatalf("expected %s to be registered", c.Name())
+		}
+	}
+	if _, ok := codecNamed("zstd"); ok {
+		t.Fatal("expected zstd not to be registered")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		if key == "small" {
+			return []byte("small"), nil
+		}
+		return []byte(strings.Repeat(key, 1000)), nil
+	})
+	for _, shards := range []int{0, 4} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			g := newGroup("compression", 64<<10, getter)
+			g.UseArena(shards)
+			g.SetCompression(Compression{Codec: GzipCodec{}, MinBytes: 100})
+
+			if v, err := g.Get("big"); err != nil || v.String() != strings.Repeat("big", 1000) {
+				t.Fatalf("expected big to be decompressed, got %v", err)
+			}
+			if v, ok := g.lookupCache("big"); !ok || v.codecName() != "gzip" || v.Len() >= 3000 {
+				t.Fatalf("expected big to be cached compressed, got %d bytes with %q", v.Len(), v.codecName())
+			}
+			g.Get("small")
+			if v, ok := g.lookupCache("small"); !ok || v.codecName() != "" {
+				t.Fatal("expected small to be cached as it is")
+			}
+
+			var buf bytes.Buffer
+			if err := g.Snapshot(&buf); err != nil {
+				t.Fatal(err)
+			}
+			restored := newGroup("compression", 64<<10, getter)
+			if err := restored.Restore(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if v, ok := restored.lookupCache("big"); !ok || v.codecName() != "gzip" || v.String() != strings.Repeat("big", 1000) {
+				t.Fatal("expected big to be restored compressed")
+			}
+		})
+	}
+}
+
+func TestCompressionSpillsToL2(t *testing.T) {
+	store, err := logstore.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte(strings.Repeat(key, 1000)), nil
+	})
+	// room for one compressed entry in memory
+	g := newGroup("compression-l2", 20, getter)
+	g.SetCompression(Compression{Codec: FlateCodec{}, MinBytes: 100})
+	g.SetL2(store)
+
+	g.Get("a")
+	g.Get("b")
+	if !waitFor(time.Second, func() bool { return g.Stats().L2.Items == 1 }) {
+		t.Fatalf("expected a to spill to L2, got %+v", g.Stats())
+	}
+	if v, ok := g.lookupCache("a"); !ok || v.codecName() != "flate" || v.String() != strings.Repeat("a", 1000) {
+		t.Fatal("expected a back from L2 compressed")
+	}
+}
+
+func TestCompressionAcrossPeers(t *testing.T) {
+	c := newTestCluster(t, 3, "compression-peers", GetterFunc(func(key string) ([]byte, error) {
+		return []byte(strings.Repeat(key, 100)), nil
+	}))
+	key, owner := remoteKey(c)
+	// only the owner compresses; the others decompress with the codec it
+	// names
+	owner.group.SetCompression(Compression{Codec: GzipCodec{}, MinBytes: 100})
+
+	peer, ok := c.nodes[0].pool.PickPeer(key)
+	if !ok {
+		t.Fatalf("expected %s to be remote", key)
+	}
+	v, err := c.nodes[0].group.getFromPeer(context.Background(), peer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.codecName() != "gzip" || v.Len() >= 100*len(key) || v.String() != strings.Repeat(key, 100) {
+		t.Fatalf("expected %s compressed over the wire, got %d bytes with %q", key, v.Len(), v.codecName())
+	}
+	if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != strings.Repeat(key, 100) {
+		t.Fatalf("expected %s through Get, got %v", key, err)
+	}
+}
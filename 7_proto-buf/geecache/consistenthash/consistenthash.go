@@ -2,6 +2,8 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"math"
+	"slices"
 	"sort"
 	"strconv"
 )
@@ -48,7 +50,29 @@ func (m *Map) Get(key string) string {
 		return ""
 	}
 
+	return m.owner(int(m.hash([]byte(key))))
+}
+
+// GetN returns up to n distinct items in the order they follow key on the
+// ring, starting with the one Get returns.
+func (m *Map) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
 	hash := int(m.hash([]byte(key)))
+	idx := sort.SearchInts(m.keys, hash)
+	var items []string
+	for i := 0; i < len(m.keys) && len(items) < n; i++ {
+		item := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// owner returns the item owning hash.
+func (m *Map) owner(hash int) string {
 	// Binary search for appropriate replica.
 	idx := sort.Search(len(m.keys), func(i int) bool {
 		return m.keys[i] >= hash
@@ -56,3 +80,65 @@ func (m *Map) Get(key string) string {
 
 	return m.hashMap[m.keys[idx%len(m.keys)]]
 }
+
+// Hash returns the hash of key, as used to place it on the ring.
+func (m *Map) Hash(key string) uint32 {
+	return m.hash([]byte(key))
+}
+
+// A Range is a span of hashes, Start to End inclusive, that moved from
+// one item to another.
+type Range struct {
+	Start, End uint32
+	From, To   string
+}
+
+// Contains reports whether hash falls in r.
+func (r Range) Contains(hash uint32) bool {
+	return r.Start <= hash && hash <= r.End
+}
+
+// Diff returns the ranges of hashes whose owner differs between old and
+// new. Both maps must use the same hash function. Ranges owned by no one
+// in either map are left out.
+func Diff(old, new *Map) []Range {
+	if len(old.keys) == 0 || len(new.keys) == 0 {
+		return nil
+	}
+	points := make([]int, 0, len(old.keys)+len(new.keys))
+	points = append(points, old.keys...)
+	points = append(points, new.keys...)
+	sort.Ints(points)
+
+	var ranges []Range
+	add := func(start, end int) {
+		if start > end {
+			return
+		}
+		from, to := old.owner(end), new.owner(end)
+		if from == to {
+			return
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].End+1 == uint32(start) &&
+			ranges[n-1].From == from && ranges[n-1].To == to {
+			ranges[n-1].End = uint32(end)
+			return
+		}
+		ranges = append(ranges, Range{Start: uint32(start), End: uint32(end), From: from, To: to})
+	}
+
+	// Each point owns the hashes from just after the previous point up to
+	// itself; the first point also owns the wrap-around past the last.
+	add(0, points[0])
+	for i := 1; i < len(points); i++ {
+		add(points[i-1]+1, points[i])
+	}
+	last := points[len(points)-1]
+	if last < math.MaxUint32 {
+		from, to := old.owner(math.MaxUint32), new.owner(math.MaxUint32)
+		if from != to {
+			ranges = append(ranges, Range{Start: uint32(last + 1), End: math.MaxUint32, From: from, To: to})
+		}
+	}
+	return ranges
+}
@@ -1,6 +1,7 @@
 package consistenthash
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -41,3 +42,64 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add("6", "4", "2")
+
+	testCases := map[string][]string{
+		"3":  {"4", "6", "2"},
+		"15": {"6", "2", "4"},
+		"27": {"2", "4", "6"},
+	}
+	for k, v := range testCases {
+		if got := hash.GetN(k, 5); !reflect.DeepEqual(got, v) {
+			t.Errorf("Asking for %s, got %v, want %v", k, got, v)
+		}
+	}
+	if got := hash.GetN("3", 2); !reflect.DeepEqual(got, []string{"4", "6"}) {
+		t.Errorf("Asking for 2 items, got %v", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	hash := func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	}
+	old := New(3, hash)
+	old.Add("6", "4", "2")
+	new := New(3, hash)
+	new.Add("6", "4", "2", "8")
+
+	// 8 takes over 7-8, 17-18 and 27-28 from 2
+	expect := []Range{
+		{Start: 7, End: 8, From: "2", To: "8"},
+		{Start: 17, End: 18, From: "2", To: "8"},
+		{Start: 27, End: 28, From: "2", To: "8"},
+	}
+	if ranges := Diff(old, new); !reflect.DeepEqual(expect, ranges) {
+		t.Errorf("expected ranges %v, got %v", expect, ranges)
+	}
+
+	// and gives them back when it leaves
+	for _, r := range Diff(new, old) {
+		if r.From != "8" || r.To != "2" {
+			t.Errorf("unexpected range %v", r)
+		}
+	}
+
+	for _, k := range []string{"7", "8", "17", "27", "28", "29", "100"} {
+		moved := false
+		for _, r := range Diff(old, new) {
+			moved = moved || r.Contains(new.Hash(k))
+		}
+		if moved != (old.Get(k) != new.Get(k)) {
+			t.Errorf("%s moved from %s to %s, but Diff says moved=%v", k, old.Get(k), new.Get(k), moved)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package geecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultDiscoveryInterval = 10 * time.Second
+	// a peer set that keeps changing is applied at most this many
+	// debounce periods after the first change
+	maxDebouncePeriods = 10
+)
+
+// Discovery finds the peers of a cluster.
+type Discovery interface {
+	// Discover sends the current peer URLs on ch, and sends them again
+	// every time they change, until ctx is done.
+	Discover(ctx context.Context, ch chan<- []string) error
+}
+
+// Discover keeps the pool's peers in step with d until ctx is done. The
+// first peer set is applied at once; later ones are applied after the set
+// has been stable for debounce, so that a flapping node doesn't reshuffle
+// the ring every time it flaps. Once the first set is applied the pool
+// announces itself with Join, in case an earlier process at this address
+// drained.
+func (p *HTTPPool) Discover(ctx context.Context, d Discovery, debounce time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan []string)
+	errc := make(chan error, 1)
+	go func() { errc <- d.Discover(ctx, ch) }()
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+	var (
+		pending  []string
+		deadline time.Time
+		first    = true
+	)
+	for {
+		select {
+		case peers := <-ch:
+			if first {
+				first = false
+				p.setIfChanged(peers)
+				go func() {
+					if err := p.Join(); err != nil {
+						p.Log("join: %v", err)
+					}
+				}()
+				continue
+			}
+			if pending == nil {
+				deadline = time.Now().Add(maxDebouncePeriods * debounce)
+			}
+			pending = peers
+			timer.Reset(min(debounce, time.Until(deadline)))
+		case <-timer.C:
+			p.setIfChanged(pending)
+			pending = nil
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+// setIfChanged calls Set unless peers are already the pool's peers.
+func (p *HTTPPool) setIfChanged(peers []string) {
+	p.mu.Lock()
+	same := slices.Equal(peers, p.members)
+	p.mu.Unlock()
+	if !same {
+		p.Log("peers changed to %v", peers)
+		p.Set(peers...)
+	}
+}
+
+// StaticDiscovery is a fixed list of peers.
+type StaticDiscovery []string
+
+// Discover implements Discovery.
+func (d StaticDiscovery) Discover(ctx context.Context, ch chan<- []string) error {
+	select {
+	case ch <- normalizePeers(d):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// FileDiscovery reads the peers from a JSON file of the form
+// {"peers": ["http://10.0.0.1:8001", ...]}, polling it for changes.
+type FileDiscovery struct {
+	Path     string
+	Interval time.Duration // defaults to 10s
+}
+
+// Discover implements Discovery.
+func (d *FileDiscovery) Discover(ctx context.Context, ch chan<- []string) error {
+	return poll(ctx, ch, d.Interval, func(context.Context) ([]string, error) {
+		data, err := os.ReadFile(d.Path)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Peers []string `json:"peers"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", d.Path, err)
+		}
+		return file.Peers, nil
+	})
+}
+
+// A Resolver looks up DNS records. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery finds the peers in DNS, polling for changes. With SRV set,
+// Name is looked up as an SRV record (e.g. "_geecache._tcp.example.com")
+// and each target and port is a peer. Otherwise each A/AAAA address of
+// Name is a peer listening on Port.
+type DNSDiscovery struct {
+	Name     string
+	SRV      bool
+	Port     int
+	Scheme   string        // defaults to "http"
+	Interval time.Duration // defaults to 10s
+	Resolver Resolver      // defaults to net.DefaultResolver
+}
+
+// Discover implements Discovery.
+func (d *DNSDiscovery) Discover(ctx context.Context, ch chan<- []string) error {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	peer := func(host string, port int) string {
+		return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	return poll(ctx, ch, d.Interval, func(ctx context.Context) ([]string, error) {
+		var peers []string
+		if d.SRV {
+			_, srvs, err := resolver.LookupSRV(ctx, "", "", d.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, srv := range srvs {
+				host := srv.Target
+				if len(host) > 0 && host[len(host)-1] == '.' {
+					host = host[:len(host)-1]
+				}
+				peers = append(peers, peer(host, int(srv.Port)))
+			}
+			return peers, nil
+		}
+		addrs, err := resolver.LookupHost(ctx, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			peers = append(peers, peer(addr, d.Port))
+		}
+		return peers, nil
+	})
+}
+
+// poll calls lookup every interval and sends its result on ch whenever it
+// changes. Failed lookups are logged and the last good result is kept.
+func poll(ctx context.Context, ch chan<- []string, interval time.Duration,
+	lookup func(context.Context) ([]string, error)) error {
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []string
+	for {
+		peers, err := lookup(ctx)
+		if err != nil {
+			log.Println("[GeeCache] Failed to discover peers", err)
+		} else if peers = normalizePeers(peers); last == nil || !slices.Equal(peers, last) {
+			select {
+			case ch <- peers:
+				last = peers
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// normalizePeers returns a sorted copy of peers without duplicates.
+func normalizePeers(peers []string) []string {
+	out := make([]string, 0, len(peers))
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		if !seen[peer] {
+			seen[peer] = true
+			out = append(out, peer)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,152 @@
+package geecache
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discover runs d and returns the channel it sends peer sets on.
+func discover(t *testing.T, d Discovery) <-chan []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ch := make(chan []string)
+	go d.Discover(ctx, ch)
+	return ch
+}
+
+func expectPeers(t *testing.T, ch <-chan []string, expect ...string) {
+	t.Helper()
+	select {
+	case peers := <-ch:
+		if !reflect.DeepEqual(expect, peers) {
+			t.Fatalf("expected peers %v, got %v", expect, peers)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected peers %v, got nothing", expect)
+	}
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	ch := discover(t, StaticDiscovery{"http://b", "http://a", "http://b"})
+	expectPeers(t, ch, "http://a", "http://b")
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"peers": ["http://a", "http://b"]}`)
+	ch := discover(t, &FileDiscovery{Path: path, Interval: 10 * time.Millisecond})
+	expectPeers(t, ch, "http://a", "http://b")
+
+	// a broken file is ignored, the next good one is picked up
+	write(`{"peers": [`)
+	time.Sleep(30 * time.Millisecond)
+	write(`{"peers": ["http://a", "http://c"]}`)
+	expectPeers(t, ch, "http://a", "http://c")
+}
+
+type fakeResolver struct {
+	hosts []string
+	srvs  []*net.SRV
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.hosts, nil
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.srvs, nil
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	resolver := &fakeResolver{
+		hosts: []string{"10.0.0.2", "10.0.0.1", "fd00::1"},
+		srvs: []*net.SRV{
+			{Target: "cache-1.example.com.", Port: 8001},
+			{Target: "cache-0.example.com.", Port: 8001},
+		},
+	}
+	ch := discover(t, &DNSDiscovery{Name: "cache.example.com", Port: 8001, Resolver: resolver})
+	expectPeers(t, ch, "http://10.0.0.1:8001", "http://10.0.0.2:8001", "http://[fd00::1]:8001")
+
+	ch = discover(t, &DNSDiscovery{Name: "_geecache._tcp.example.com", SRV: true, Scheme: "https", Resolver: resolver})
+	expectPeers(t, ch, "https://cache-0.example.com:8001", "https://cache-1.example.com:8001")
+}
+
+// chanDiscovery sends whatever the test puts on its channel.
+type chanDiscovery chan []string
+
+func (d chanDiscovery) Discover(ctx context.Context, ch chan<- []string) error {
+	for {
+		select {
+		case peers := <-d:
+			ch <- peers
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestDiscoverDebounce(t *testing.T) {
+	p := NewHTTPPool("http://a")
+	var mu sync.Mutex
+	sets := 0
+	p.Watch(func() {
+		mu.Lock()
+		sets++
+		mu.Unlock()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := make(chanDiscovery)
+	go p.Discover(ctx, d, 50*time.Millisecond)
+
+	d <- []string{"http://a", "http://b"}
+	if !waitFor(time.Second, func() bool { return len(p.AllPeers()) == 1 }) {
+		t.Fatal("the first peer set should be applied at once")
+	}
+
+	// http://c flaps
+	for i := 0; i < 5; i++ {
+		d <- []string{"http://a", "http://b", "http://c"}
+		time.Sleep(5 * time.Millisecond)
+		d <- []string{"http://a", "http://b"}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d <- []string{"http://a", "http://b", "http://c"}
+	if !waitFor(time.Second, func() bool { return len(p.AllPeers()) == 2 }) {
+		t.Fatal("the last peer set should be applied once stable")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sets != 2 {
+		t.Fatalf("expected the ring to change twice, got %d", sets)
+	}
+}
+
+func TestPoolFindsItselfAmongDiscoveredPeers(t *testing.T) {
+	p := NewHTTPPool("http://Cache-1.example:8001/")
+	p.Set("http://cache-1.example:8001", "http://cache-2.example:8001/")
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if peer, ok := p.PickPeer(key); ok && peer.(*httpGetter).baseURL == "http://cache-1.example:8001"+defaultBasePath {
+			t.Fatalf("expected %s to be served here, not forwarded to this node", key)
+		}
+	}
+	if len(p.AllPeers()) != 1 {
+		t.Fatalf("expected one other peer, got %d", len(p.AllPeers()))
+	}
+}
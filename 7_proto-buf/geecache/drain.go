@@ -0,0 +1,224 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/consistenthash"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// how long peers keep a drained node out of their ring if it doesn't
+	// join again
+	departedTTL = 2 * time.Minute
+	drainPoll   = 100 * time.Millisecond
+)
+
+// Drain takes this node out of the cluster ahead of a shutdown. It asks
+// every peer to drop it from their ring and keeps serving until they all
+// have, then hands up to handoff of the most recently used entries of
+// each group to their new owners. Peers that can't be reached at all are
+// taken to have left themselves, as they can't send this node requests
+// either. If the others haven't converged by the time ctx is done, the
+// entries are handed off all the same and ctx's error is returned.
+func (p *HTTPPool) Drain(ctx context.Context, handoff int) error {
+	p.mu.Lock()
+	pending := make(map[string]*httpGetter)
+	for _, peer := range p.members {
+		if peer != p.self {
+			pending[peer] = p.controlGetter(peer)
+		}
+	}
+	p.mu.Unlock()
+
+	p.Log("draining")
+	p.draining.Store(true)
+	var timeout error
+	for len(pending) > 0 && timeout == nil {
+		for peer, getter := range pending {
+			view, err := getter.leave(p.self)
+			if err != nil {
+				p.Log("leave %s: %v", peer, err)
+				var status *statusError
+				if !errors.As(err, &status) {
+					delete(pending, peer)
+				}
+				continue
+			}
+			if !slices.Contains(view, p.self) {
+				delete(pending, peer)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			timeout = ctx.Err()
+			p.Log("%d peers still route to this node: %v", len(pending), timeout)
+		case <-time.After(drainPoll):
+		}
+	}
+
+	if handoff > 0 {
+		p.mu.Lock()
+		cur := p.peers
+		var others []string
+		for peer := range p.httpGetters {
+			if peer != p.self {
+				others = append(others, peer)
+			}
+		}
+		p.mu.Unlock()
+		if cur != nil && len(others) > 0 {
+			ring := consistenthash.New(p.opts.Replicas, p.opts.HashFn)
+			ring.Add(others...)
+			p.handoff(cur, ring, cur, handoff)
+		}
+	}
+	if timeout != nil {
+		return timeout
+	}
+	p.Log("drained")
+	return nil
+}
+
+// Join tells every peer that this node is serving, undoing an earlier
+// Drain by this or a previous process at the same address.
+func (p *HTTPPool) Join() error {
+	p.draining.Store(false)
+	p.mu.Lock()
+	var getters []*httpGetter
+	for _, peer := range p.members {
+		if peer != p.self {
+			getters = append(getters, p.controlGetter(peer))
+		}
+	}
+	p.mu.Unlock()
+
+	var errs []error
+	for _, getter := range getters {
+		errs = append(errs, getter.membership("join", p.self))
+	}
+	return errors.Join(errs...)
+}
+
+// serveMembership handles POST /<basepath>/_leave?peer= and
+// /<basepath>/_join?peer= sent by Drain and Join.
+func (p *HTTPPool) serveMembership(w http.ResponseWriter, r *http.Request, op string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peer := r.URL.Query().Get("peer")
+	if peer == "" || peer == p.self {
+		http.Error(w, "bad peer", http.StatusBadRequest)
+		return
+	}
+	if op == "leave" {
+		p.depart(peer)
+	} else {
+		p.rejoin(peer)
+	}
+}
+
+// servePeers handles GET /<basepath>/_peers, answering with the peers in
+// this node's ring, one per line.
+func (p *HTTPPool) servePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	peers := make([]string, 0, len(p.httpGetters))
+	for peer := range p.httpGetters {
+		peers = append(peers, peer)
+	}
+	p.mu.Unlock()
+	slices.Sort(peers)
+	w.Header().Set("Content-Type", "text/plain")
+	for _, peer := range peers {
+		w.Write([]byte(peer + "\n"))
+	}
+}
+
+// depart leaves peer out of the ring until it joins again or departedTTL
+// passes.
+func (p *HTTPPool) depart(peer string) {
+	p.mu.Lock()
+	if p.departed == nil {
+		p.departed = make(map[string]time.Time)
+	}
+	until, ok := p.departed[peer]
+	already := ok && time.Now().Before(until)
+	p.departed[peer] = time.Now().Add(departedTTL)
+	p.mu.Unlock()
+	if already {
+		return
+	}
+	p.Log("%s is draining", peer)
+	p.rebuild()
+	time.AfterFunc(departedTTL, func() { p.expireDeparted(peer) })
+}
+
+// rejoin puts a departed peer back in the ring.
+func (p *HTTPPool) rejoin(peer string) {
+	p.mu.Lock()
+	_, ok := p.departed[peer]
+	delete(p.departed, peer)
+	p.mu.Unlock()
+	if ok {
+		p.Log("%s joined again", peer)
+		p.rebuild()
+	}
+}
+
+func (p *HTTPPool) expireDeparted(peer string) {
+	p.mu.Lock()
+	until, ok := p.departed[peer]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	if wait := time.Until(until); wait > 0 {
+		// the peer left again in the meantime
+		p.mu.Unlock()
+		time.AfterFunc(wait, func() { p.expireDeparted(peer) })
+		return
+	}
+	delete(p.departed, peer)
+	p.mu.Unlock()
+	p.rebuild()
+}
+
+// controlGetter returns a getter for one-off control requests to peer.
+func (p *HTTPPool) controlGetter(peer string) *httpGetter {
+	return &httpGetter{baseURL: peer + p.basePath, transport: p.transport(), timeout: p.opts.Timeout}
+}
+
+func (h *httpGetter) membership(op, self string) error {
+	_, err := h.send(http.MethodPost, h.baseURL+"_"+op+"?peer="+url.QueryEscape(self), nil)
+	return err
+}
+
+// leave asks h's node to drop self from its ring and returns the peers
+// left in it.
+func (h *httpGetter) leave(self string) ([]string, error) {
+	if err := h.membership("leave", self); err != nil {
+		return nil, err
+	}
+	return h.view()
+}
+
+// view returns the peers in the ring of h's node.
+func (h *httpGetter) view() ([]string, error) {
+	body, err := h.send(http.MethodGet, h.baseURL+"_peers", nil)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(body)), nil
+}
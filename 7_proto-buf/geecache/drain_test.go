@@ -0,0 +1,127 @@
+package geecache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	var loads atomic.Int32
+	c := newTestCluster(t, 3, "drain", GetterFunc(
+		func(key string) ([]byte, error) {
+			loads.Add(1)
+			return []byte(key), nil
+		}))
+	leaving := c.nodes[2]
+
+	var owned []string
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := c.nodes[0].group.Get(key); err != nil {
+			t.Fatal(err)
+		}
+		if c.owner(key) == leaving {
+			owned = append(owned, key)
+		}
+	}
+	if len(owned) < 2 {
+		t.Fatal("too few keys owned by the leaving node")
+	}
+	before := loads.Load()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leaving.pool.Drain(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range c.nodes[:2] {
+		for i := 0; i < 60; i++ {
+			if peer, ok := node.pool.PickPeer(fmt.Sprintf("key-%d", i)); ok && peer.(*httpGetter).baseURL == leaving.addr+defaultBasePath {
+				t.Fatalf("%s still picks the drained node", node.addr)
+			}
+		}
+	}
+
+	// Only the most recently used entry was handed off.
+	handed := 0
+	for _, key := range owned {
+		for _, node := range c.nodes[:2] {
+			if _, ok := node.group.mainCache.get(node.group.cacheKey(key)); ok {
+				handed++
+			}
+		}
+	}
+	if handed != 1 {
+		t.Fatalf("expected 1 entry handed off, got %d", handed)
+	}
+	last := owned[len(owned)-1]
+	if _, err := c.nodes[0].group.Get(last); err != nil {
+		t.Fatal(err)
+	}
+	if n := loads.Load(); n != before {
+		t.Fatalf("expected the hottest key to be served without a load, got %d loads", n-before)
+	}
+
+	if err := leaving.pool.Join(); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes[:2] {
+		view, err := (&httpGetter{baseURL: node.addr + defaultBasePath}).view()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(view) != 3 {
+			t.Fatalf("expected the node back in %s's ring, got %v", node.addr, view)
+		}
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	c := newTestCluster(t, 3, "drain-timeout", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	leaving, staying := c.nodes[0], c.nodes[1]
+	c.nodes[2].down.Store(true)
+	var owned []string
+	for i := 0; i < 120; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if c.owner(key) == leaving {
+			leaving.group.Get(key)
+			owned = append(owned, key)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := leaving.pool.Drain(ctx, 100); err != context.DeadlineExceeded {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+	// the peer that answered still got its share of the entries
+	for _, key := range owned {
+		if _, ok := staying.pool.PickPeer(key); ok {
+			continue
+		}
+		if _, ok := staying.group.mainCache.get(staying.group.cacheKey(key)); !ok {
+			t.Fatalf("expected %s to be handed off despite the timeout", key)
+		}
+	}
+}
+
+func TestDrainUnreachablePeer(t *testing.T) {
+	c := newTestCluster(t, 3, "drain-unreachable", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	c.nodes[2].srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.nodes[0].pool.Drain(ctx, 0); err != nil {
+		t.Fatalf("expected an unreachable peer not to hold up the drain, got %v", err)
+	}
+}
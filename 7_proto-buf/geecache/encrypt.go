@@ -0,0 +1,201 @@
+package geecache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A KeyProvider supplies the AES keys a group encrypts its values with.
+// Every key has an ID, which is kept with the values it encrypted, so keys
+// can be rotated: add the new key to every node, then encrypt with it
+// everywhere, then drop the old one once the values it encrypted have
+// expired, been evicted or been invalidated.
+type KeyProvider interface {
+	// EncryptionKey returns the key new values are encrypted with and
+	// its ID.
+	EncryptionKey() (id string, key []byte, err error)
+	// DecryptionKey returns the key with the given ID.
+	DecryptionKey(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider of keys held in memory.
+type StaticKeys struct {
+	// Keys maps key IDs to AES keys of 16, 24 or 32 bytes.
+	Keys map[string][]byte
+
+	// EncryptWith is the ID of the key new values are encrypted with.
+	EncryptWith string
+
+	mu sync.Mutex
+}
+
+// SetKeys replaces the keys and the key encrypted with, e.g. after the
+// file they come from changed.
+func (k *StaticKeys) SetKeys(keys map[string][]byte, encryptWith string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.Keys, k.EncryptWith = keys, encryptWith
+}
+
+func (k *StaticKeys) EncryptionKey() (string, []byte, error) {
+	k.mu.Lock()
+	id := k.EncryptWith
+	k.mu.Unlock()
+	key, err := k.DecryptionKey(id)
+	return id, key, err
+}
+
+func (k *StaticKeys) DecryptionKey(id string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no encryption key %q", id)
+	}
+	return key, nil
+}
+
+// SetEncryption makes the group encrypt its values with AES-GCM under the
+// keys of p, after compressing them: in its caches, on disk, in snapshots
+// and between peers, which forward values as they are. Values given to Set
+// or LeaseSet are encrypted before they are sent to their owner, and are
+// only decrypted by Get, so every node that serves clients needs the
+// keys. A nil p turns encryption off for new values. It should be called
+// before the group is used.
+func (g *Group) SetEncryption(p KeyProvider) {
+	g.keys.mu.Lock()
+	defer g.keys.mu.Unlock()
+	g.keys.provider = p
+}
+
+// encode compresses and encrypts v, the value of key, as the group is
+// configured to, unless it is encrypted already.
+func (g *Group) encode(key string, v ByteView) (ByteView, error) {
+	if v.kid != "" {
+		return v, nil
+	}
+	return g.keys.seal(key, g.compress(v))
+}
+
+// keyring encrypts and decrypts the values of a group.
+type keyring struct {
+	group    string
+	mu       sync.Mutex
+	provider KeyProvider
+	aeads    map[string]keyAEAD // by key ID
+}
+
+type keyAEAD struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+var errNoKeys = errors.New("no encryption keys")
+
+// aead returns the AEAD of key, whose ID is id.
+func (k *keyring) aead(id string, key []byte) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// the provider may have replaced the key behind an ID
+	if a, ok := k.aeads[id]; ok && bytes.Equal(a.key, key) {
+		return a.aead, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %q: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if k.aeads == nil {
+		k.aeads = make(map[string]keyAEAD)
+	}
+	k.aeads[id] = keyAEAD{key: key, aead: aead}
+	return aead, nil
+}
+
+func (k *keyring) getProvider() KeyProvider {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.provider
+}
+
+// seal encrypts v, the value of key, with the current key, if there is a
+// provider. The nonce is prepended to the ciphertext, which is
+// authenticated with additionalData.
+func (k *keyring) seal(key string, v ByteView) (ByteView, error) {
+	p := k.getProvider()
+	if p == nil {
+		return v, nil
+	}
+	id, secret, err := p.EncryptionKey()
+	if err != nil {
+		return ByteView{}, err
+	}
+	if id == "" {
+		return ByteView{}, errors.New("encryption key without an ID")
+	}
+	aead, err := k.aead(id, secret)
+	if err != nil {
+		return ByteView{}, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+v.Len()+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return ByteView{}, err
+	}
+	b := aead.Seal(nonce, nonce, v.raw(), k.additionalData(key, v.codecName()))
+	return ByteView{b: b, e: v.e, c: v.c, k: k, kid: id, key: key}, nil
+}
+
+// open decrypts b, the value of key sealed under the key id.
+func (k *keyring) open(id string, b []byte, key, codec string) ([]byte, error) {
+	p := k.getProvider()
+	if p == nil {
+		return nil, errNoKeys
+	}
+	secret, err := p.DecryptionKey(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(id, secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("short ciphertext")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], k.additionalData(key, codec))
+}
+
+// additionalData is what a value is authenticated with besides its bytes:
+// the group and key it belongs to, so that it can't be passed off as the
+// value of another, and the codec it is compressed with.
+func (k *keyring) additionalData(key, codec string) []byte {
+	var b []byte
+	for _, s := range []string{k.group, key, codec} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// canOpen reports whether values encrypted under the key id can be
+// decrypted, so that they aren't cached only to fail every read.
+func (k *keyring) canOpen(id string) error {
+	p := k.getProvider()
+	if p == nil {
+		return errNoKeys
+	}
+	_, err := p.DecryptionKey(id)
+	return err
+}
@@ -0,0 +1,213 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/logstore"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeys(ids ...string) *StaticKeys {
+	k := &StaticKeys{Keys: make(map[string][]byte), EncryptWith: ids[len(ids)-1]}
+	for _, id := range ids {
+		k.Keys[id] = bytes.Repeat([]byte(id[len(id)-1:]), 32)
+	}
+	return k
+}
+
+func TestEncryption(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte("secret-" + strings.Repeat(key, 100)), nil
+	})
+	for _, shards := range []int{0, 4} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			keys := testKeys("k1")
+			g := newGroup("encryption", 64<<10, getter)
+			g.UseArena(shards)
+			g.SetCompression(Compression{Codec: GzipCodec{}, MinBytes: 100})
+			g.SetEncryption(keys)
+
+			if v, err := g.Get("a"); err != nil || v.String() != "secret-"+strings.Repeat("a", 100) {
+				t.Fatalf("expected a to be decrypted, got %v", err)
+			}
+			v, ok := g.lookupCache("a")
+			if !ok || v.kid != "k1" || v.codecName() != "gzip" || bytes.Contains(v.b, []byte("secret")) {
+				t.Fatalf("expected a to be cached compressed and encrypted, got %q with key %q", v.b, v.kid)
+			}
+
+			var buf bytes.Buffer
+			if err := g.Snapshot(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(buf.Bytes(), []byte("secret")) {
+				t.Fatal("expected the snapshot to be encrypted")
+			}
+			restored := newGroup("encryption", 64<<10, getter)
+			restored.SetEncryption(keys)
+			if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if v, ok := restored.lookupCache("a"); !ok || v.String() != "secret-"+strings.Repeat("a", 100) {
+				t.Fatal("expected a to be restored")
+			}
+			keyless := newGroup("encryption", 64<<10, getter)
+			if err := keyless.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := keyless.lookupCache("a"); ok {
+				t.Fatal("expected a group without the keys to skip a")
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	keys := testKeys("k1")
+	g := newGroup("encryption-rotation", 64<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("secret-" + key), nil
+	}))
+	g.SetEncryption(keys)
+	g.Get("a")
+
+	keys.SetKeys(testKeys("k1", "k2").Keys, "k2")
+	g.Get("b")
+	a, _ := g.lookupCache("a")
+	b, _ := g.lookupCache("b")
+	if a.kid != "k1" || b.kid != "k2" {
+		t.Fatalf("expected a under k1 and b under k2, got %q and %q", a.kid, b.kid)
+	}
+	if a.String() != "secret-a" || b.String() != "secret-b" {
+		t.Fatal("expected both keys to decrypt")
+	}
+
+	keys.SetKeys(testKeys("k2").Keys, "k2")
+	if _, err := a.open(); err == nil {
+		t.Fatal("expected a to be unreadable once k1 is dropped")
+	}
+	// rather than answering with an empty value, Get loads a again
+	if v, err := g.Get("a"); err != nil || v.String() != "secret-a" {
+		t.Fatalf("expected a to be loaded again, got %q, %v", v, err)
+	}
+	if a, _ := g.lookupCache("a"); a.kid != "k2" {
+		t.Fatalf("expected a to be cached under k2, got %q", a.kid)
+	}
+}
+
+func TestEncryptionBindsKey(t *testing.T) {
+	g := newGroup("encryption-binding", 64<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("secret-" + key), nil
+	}))
+	g.SetEncryption(testKeys("k1"))
+	g.Get("a")
+	a, _ := g.lookupCache("a")
+
+	// a's ciphertext doesn't pass for b's value, nor for a's in another
+	// group
+	moved := a
+	moved.key = "b"
+	if _, err := moved.open(); err == nil {
+		t.Fatal("expected a's value not to open as b's")
+	}
+	other := newGroup("encryption-binding-other", 64<<10, g.getter)
+	other.SetEncryption(testKeys("k1"))
+	moved = a
+	moved.k = &other.keys
+	if _, err := moved.open(); err == nil {
+		t.Fatal("expected a's value not to open in another group")
+	}
+}
+
+func TestEncryptionSpillsToL2(t *testing.T) {
+	store, err := logstore.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// room for one entry in memory
+	g := newGroup("encryption-l2", 60, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("secret-" + key), nil
+	}))
+	g.SetEncryption(testKeys("k1"))
+	g.SetL2(store)
+
+	g.Get("a")
+	g.Get("b")
+	var e logstore.Entry
+	var ok bool
+	waitFor(time.Second, func() bool {
+		e, ok, _ = store.Get(g.cacheKey("a"))
+		return ok
+	})
+	if !ok || bytes.Contains(e.Value, []byte("secret")) {
+		t.Fatalf("expected a to spill to L2 encrypted, got %q", e.Value)
+	}
+	if v, ok := g.lookupCache("a"); !ok || v.String() != "secret-a" {
+		t.Fatal("expected a back from L2")
+	}
+}
+
+func TestEncryptionAcrossPeers(t *testing.T) {
+	c := newTestCluster(t, 3, "encryption-peers", GetterFunc(func(key string) ([]byte, error) {
+		return []byte("secret-" + key), nil
+	}))
+	key, owner := remoteKey(c)
+	keys := testKeys("k1")
+	owner.group.SetEncryption(keys)
+
+	peer, _ := c.nodes[0].pool.PickPeer(key)
+	if _, err := c.nodes[0].group.getFromPeer(context.Background(), peer, key); err == nil {
+		t.Fatal("expected a node without the keys to refuse an encrypted value")
+	}
+
+	c.nodes[0].group.SetEncryption(keys)
+	v, err := c.nodes[0].group.getFromPeer(context.Background(), peer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.kid != "k1" || bytes.Contains(v.b, []byte("secret")) || v.String() != "secret-"+key {
+		t.Fatalf("expected %s encrypted over the wire, got %q with key %q", key, v.b, v.kid)
+	}
+	owned, _ := owner.group.lookupCache(key)
+	if !bytes.Equal(owned.b, v.b) {
+		t.Fatal("expected the owner to send its ciphertext as it is")
+	}
+}
+
+func TestEncryptionOfSetsToPeers(t *testing.T) {
+	c := newTestCluster(t, 3, "encryption-sets", GetterFunc(func(key string) ([]byte, error) {
+		return nil, fmt.Errorf("no %s", key)
+	}))
+	from := c.nodes[0]
+	// the owners encrypt with k2, so a value that reaches them under k1
+	// was encrypted before it was sent
+	from.group.SetEncryption(testKeys("k1"))
+	for _, node := range c.nodes[1:] {
+		node.group.SetEncryption(testKeys("k1", "k2"))
+	}
+
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprintf("k-%d", i); c.owner(key) != from {
+			keys = append(keys, key)
+		}
+	}
+	if err := from.group.Set(keys[0], []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := from.group.LeaseGet(keys[1])
+	if err != nil || lease.Token == 0 {
+		t.Fatalf("expected a lease on %s, got %+v, %v", keys[1], lease, err)
+	}
+	if err := from.group.LeaseSet(keys[1], lease.Token, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		v, ok := c.owner(key).group.lookupCache(key)
+		if !ok || v.kid != "k1" || v.String() != "secret" {
+			t.Fatalf("expected %s to reach its owner encrypted with k1, got %q with key %q", key, v.b, v.kid)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	defaultTimeout      = 10 * time.Second
+	defaultRetryBackoff = 20 * time.Millisecond
+	// fetches timed before hedging on the 95th percentile
+	latencyWindow     = 256
+	minLatencySamples = 20
+)
+
+// fetch gets in from h, retrying failures with backoff and hedging slow
+// attempts as the pool's options say. Lease requests hand out a token
+// and are neither retried nor hedged.
+func (p *HTTPPool) fetch(ctx context.Context, h *httpGetter, in *pb.Request, out *pb.Response) error {
+	retries := p.opts.Retries
+	if in.GetLease() {
+		retries = 0
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(jitter(p.opts.RetryBackoff << (attempt - 1))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			p.Log("retrying %s/%s, attempt %d: %v", in.GetGroup(), in.GetKey(), attempt+1, err)
+		}
+		err = p.attempt(ctx, h, in, out)
+		if err == nil || ctx.Err() != nil || !failed(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// attempt makes one timed request for in, hedged by a request to the next
+// peer on the ring if the first is slow.
+func (p *HTTPPool) attempt(ctx context.Context, h *httpGetter, in *pb.Request, out *pb.Response) error {
+	ctx, cancel := context.WithTimeout(ctx, p.opts.Timeout)
+	defer cancel()
+
+	var hedge *httpGetter
+	delay, ok := p.hedgeDelay()
+	if ok && !in.GetLease() {
+		hedge = p.nextPeer(h, in.GetKey())
+	}
+	if hedge == nil {
+		start := time.Now()
+		err := h.get(ctx, in, out, false)
+		if err == nil {
+			p.latencies.add(time.Since(start))
+		}
+		return err
+	}
+
+	type result struct {
+		res *pb.Response
+		err error
+	}
+	results := make(chan result, 2)
+	send := func(g *httpGetter, local bool) {
+		res := &pb.Response{}
+		start := time.Now()
+		err := g.get(ctx, in, res, local)
+		if err == nil && !local {
+			p.latencies.add(time.Since(start))
+		}
+		results <- result{res, err}
+	}
+	go send(h, false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			p.Log("hedging %s/%s to %s", in.GetGroup(), in.GetKey(), hedge.baseURL)
+			go send(hedge, true)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// returning cancels the slower request
+				proto.Merge(out, r.res)
+				return nil
+			}
+			if err == nil {
+				err = r.err
+			}
+		}
+	}
+	return err
+}
+
+// hedgeDelay returns how long to wait before hedging, or false if fetches
+// aren't hedged.
+func (p *HTTPPool) hedgeDelay() (time.Duration, bool) {
+	if !p.opts.Hedge {
+		return 0, false
+	}
+	if p.opts.HedgeDelay > 0 {
+		return p.opts.HedgeDelay, true
+	}
+	return p.latencies.p95()
+}
+
+// nextPeer returns the first available peer after h on key's ring
+// order, or nil if that is this node.
+func (p *HTTPPool) nextPeer(h *httpGetter, key string) *httpGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil
+	}
+	seen := false
+	for _, peer := range p.peers.GetN(key, len(p.httpGetters)) {
+		switch {
+		case p.httpGetters[peer] == h:
+			seen = true
+		case !seen:
+		case peer == p.self:
+			return nil
+		case p.health[peer].available():
+			return p.httpGetters[peer]
+		}
+	}
+	return nil
+}
+
+// getHere returns key from this node's cache, or loads it through the
+// Getter, without asking the key's owner. It serves hedged requests,
+// which are only sent when the owner is slow. A value it loads isn't
+// cached: the key belongs to the owner, which caches its own load.
+func (g *Group) getHere(ctx context.Context, key string) (ByteView, error) {
+	if v, ok := g.lookupCache(key); ok {
+		return v, nil
+	}
+	if l := g.limiter.Load(); l != nil {
+		if err := l.acquire(ctx); err != nil {
+			if errors.Is(err, ErrOverloaded) {
+				g.stats.loadsRejected.Add(1)
+			}
+			return ByteView{}, err
+		}
+		defer l.release()
+	}
+	bytes, _, err := g.getTagged(key)
+	g.stats.hedgedLoads.Add(1)
+	if err != nil {
+		return ByteView{}, err
+	}
+	return g.encode(key, ByteView{b: cloneBytes(bytes)})
+}
+
+// latencies keeps the durations of recent fetches.
+type latencies struct {
+	mu      sync.Mutex
+	samples [latencyWindow]time.Duration
+	n       int // total added
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.n%latencyWindow] = d
+	l.n++
+}
+
+// p95 returns the 95th percentile of the recent fetches, or false if there
+// have been too few to tell.
+func (l *latencies) p95() (time.Duration, bool) {
+	l.mu.Lock()
+	n := min(l.n, latencyWindow)
+	if n < minLatencySamples {
+		l.mu.Unlock()
+		return 0, false
+	}
+	sorted := slices.Clone(l.samples[:n])
+	l.mu.Unlock()
+	slices.Sort(sorted)
+	return sorted[n*95/100], true
+}
@@ -0,0 +1,239 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// faultTransport injects failures and delays into requests for values,
+// by the host they are sent to.
+type faultTransport struct {
+	mu     sync.Mutex
+	fail   map[string]int // fail this many more requests
+	delay  map[string]time.Duration
+	gets   map[string]int
+	hedged atomic.Int32
+}
+
+func newFaultTransport() *faultTransport {
+	return &faultTransport{
+		fail:  make(map[string]int),
+		delay: make(map[string]time.Duration),
+		gets:  make(map[string]int),
+	}
+}
+
+func (f *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || strings.HasPrefix(strings.TrimPrefix(req.URL.Path, defaultBasePath), "_") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	host := "http://" + req.URL.Host
+	f.mu.Lock()
+	f.gets[host]++
+	fail := f.fail[host] > 0
+	if fail {
+		f.fail[host]--
+	}
+	delay := f.delay[host]
+	f.mu.Unlock()
+	if req.URL.Query().Get("local") != "" {
+		f.hedged.Add(1)
+	}
+
+	if fail {
+		return nil, errors.New("injected failure")
+	}
+	select {
+	case <-time.After(delay):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (f *faultTransport) count(host string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets[host]
+}
+
+// newFetchCluster starts n nodes whose pools use opts and ft.
+func newFetchCluster(t *testing.T, n int, name string, opts HTTPPoolOptions, ft *faultTransport) (*testCluster, *atomic.Int32) {
+	loads := new(atomic.Int32)
+	c := newTestCluster(t, 0, name, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads.Add(1)
+			return []byte(key), nil
+		}))
+	opts.Transport = ft
+	for i := 0; i < n; i++ {
+		node := c.addNode()
+		node.pool = NewHTTPPoolOpts(node.addr, &opts)
+		node.pool.groups = map[string]*Group{name: node.group}
+	}
+	c.setPeers()
+	return c, loads
+}
+
+// remoteKey returns a key that nodes[0] fetches from a peer.
+func remoteKey(c *testCluster) (string, *testNode) {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner := c.owner(key); owner != c.nodes[0] {
+			return key, owner
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	ft := newFaultTransport()
+	c, loads := newFetchCluster(t, 2, "fetch-retries", HTTPPoolOptions{
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	}, ft)
+	key, owner := remoteKey(c)
+
+	ft.fail[owner.addr] = 2
+	if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != key {
+		t.Fatalf("expected %s, got %v, %v", key, v, err)
+	}
+	if n := ft.count(owner.addr); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+	if _, ok := c.nodes[0].group.mainCache.get(c.nodes[0].group.cacheKey(key)); ok {
+		t.Fatal("expected the value to come from the owner, not a local load")
+	}
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("expected 1 load, got %d", n)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	ft := newFaultTransport()
+	c, _ := newFetchCluster(t, 2, "fetch-timeout", HTTPPoolOptions{
+		Timeout: 50 * time.Millisecond,
+	}, ft)
+	key, owner := remoteKey(c)
+
+	ft.delay[owner.addr] = time.Second
+	start := time.Now()
+	if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != key {
+		t.Fatalf("expected %s from a local load, got %v, %v", key, v, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected the attempt to time out, took %v", d)
+	}
+}
+
+func TestControlRequestTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer srv.Close()
+	defer close(hung)
+	pool := NewHTTPPoolOpts("http://localhost:1", &HTTPPoolOptions{Timeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	if err := pool.controlGetter(srv.URL).membership("leave", pool.self); err == nil {
+		t.Fatal("expected a hung peer to fail the request")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected the request to time out, took %v", d)
+	}
+}
+
+func TestFetchRespectsContext(t *testing.T) {
+	ft := newFaultTransport()
+	c, loads := newFetchCluster(t, 2, "fetch-context", HTTPPoolOptions{
+		Retries:      5,
+		RetryBackoff: 10 * time.Millisecond,
+	}, ft)
+	key, owner := remoteKey(c)
+
+	ft.delay[owner.addr] = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.nodes[0].group.GetContext(ctx, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the caller's deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected GetContext to return at the deadline, took %v", d)
+	}
+	if n := ft.count(owner.addr); n != 1 {
+		t.Fatalf("expected no retries past the deadline, got %d attempts", n)
+	}
+	if n := loads.Load(); n != 0 {
+		t.Fatalf("expected no local load, got %d", n)
+	}
+}
+
+func TestFetchHedge(t *testing.T) {
+	ft := newFaultTransport()
+	c, _ := newFetchCluster(t, 3, "fetch-hedge", HTTPPoolOptions{
+		Hedge:      true,
+		HedgeDelay: 20 * time.Millisecond,
+	}, ft)
+	var key string
+	var owner *testNode
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key-%d", i)
+		owner = c.owner(key)
+		// the hedge goes to the next peer, which must not be nodes[0]
+		if owner != c.nodes[0] && c.nodes[0].pool.nextPeer(c.nodes[0].pool.httpGetters[owner.addr], key) != nil {
+			break
+		}
+	}
+
+	ft.delay[owner.addr] = time.Second
+	start := time.Now()
+	if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != key {
+		t.Fatalf("expected %s, got %v, %v", key, v, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected the hedged request to answer first, took %v", d)
+	}
+	if n := ft.hedged.Load(); n != 1 {
+		t.Fatalf("expected 1 hedged request, got %d", n)
+	}
+	// the peer hedged to doesn't own the key, so it loads without caching
+	hedge := c.nodes[0].pool.nextPeer(c.nodes[0].pool.httpGetters[owner.addr], key)
+	found := false
+	for _, node := range c.nodes {
+		if hedge.baseURL != node.addr+defaultBasePath {
+			continue
+		}
+		found = true
+		if n := node.group.Stats().HedgedLoads; n != 1 {
+			t.Fatalf("expected 1 hedged load, got %d", n)
+		}
+		if _, ok := node.group.lookupCache(key); ok {
+			t.Fatal("expected the hedged load not to be cached")
+		}
+	}
+	if !found {
+		t.Fatal("no node was hedged to")
+	}
+}
+
+func TestLatenciesP95(t *testing.T) {
+	var l latencies
+	if _, ok := l.p95(); ok {
+		t.Fatal("expected no percentile without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	if d, ok := l.p95(); !ok || d != 96*time.Millisecond {
+		t.Fatalf("expected 96ms, got %v", d)
+	}
+}
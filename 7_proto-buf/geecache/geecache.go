@@ -3,9 +3,14 @@ package geecache
 import (
 	pb "Dcache/7_proto-buf/geecache/geecachepb"
 	"Dcache/7_proto-buf/geecache/singleflight"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // A Group is a cache namespace and associated data loaded spread over
@@ -13,10 +18,28 @@ type Group struct {
 	name      string
 	getter    Getter
 	mainCache cache
-	peers     PeerPicker
+	// hotCache holds a few of the values owned by other peers, so
+	// that popular keys don't all hit the same owner
+	hotCache cache
+	peers    PeerPicker
 	// use singleflight.Group to make sure that
 	// each key is only fetched once
 	loader *singleflight.Group
+	// keys registered with KeepWarm
+	warm *warmer
+	// leases on missing keys, see LeaseGet
+	leases leaseTable
+	// mixed into cache keys, see InvalidateAll
+	generation atomic.Uint64
+	stats      groupStats
+	// caps loads through the Getter, see SetLoadLimit
+	limiter atomic.Pointer[loadLimiter]
+	// see SetCompression
+	compression atomic.Pointer[Compression]
+	// see SetEncryption
+	keys keyring
+	// recent writes, removals and invalidations, see acceptHandoff
+	changes changeLog
 }
 
 // A Getter loads data for a key.
@@ -32,6 +55,27 @@ func (f GetterFunc) Get(key string) ([]byte, error) {
 	return f(key)
 }
 
+// A TaggedGetter is a Getter that can also tag the values it loads, so
+// that they can be dropped together with InvalidateTag.
+type TaggedGetter interface {
+	Getter
+	GetTagged(key string) (value []byte, tags []string, err error)
+}
+
+// A TaggedGetterFunc implements TaggedGetter with a function.
+type TaggedGetterFunc func(key string) ([]byte, []string, error)
+
+// Get implements Getter interface function
+func (f TaggedGetterFunc) Get(key string) ([]byte, error) {
+	value, _, err := f(key)
+	return value, err
+}
+
+// GetTagged implements TaggedGetter interface function
+func (f TaggedGetterFunc) GetTagged(key string) ([]byte, []string, error) {
+	return f(key)
+}
+
 var (
 	mu     sync.RWMutex
 	groups = make(map[string]*Group)
@@ -39,18 +83,29 @@ var (
 
 // NewGroup create a new instance of Group
 func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
+	g := newGroup(name, cacheBytes, getter)
+	mu.Lock()
+	defer mu.Unlock()
+	groups[name] = g
+	return g
+}
+
+// newGroup creates a Group without registering it.
+func newGroup(name string, cacheBytes int64, getter Getter) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
-	mu.Lock()
-	defer mu.Unlock()
 	g := &Group{
 		name:      name,
 		getter:    getter,
 		mainCache: cache{cacheBytes: cacheBytes},
+		hotCache:  cache{cacheBytes: cacheBytes / 8},
 		loader:    &singleflight.Group{},
 	}
-	groups[name] = g
+	g.keys.group = name
+	g.mainCache.keys = &g.keys
+	g.hotCache.keys = &g.keys
+	g.warm = &warmer{g: g}
 	return g
 }
 
@@ -63,18 +118,59 @@ func GetGroup(name string) *Group {
 	return g
 }
 
+// allGroups returns every group created with NewGroup.
+func allGroups() []*Group {
+	mu.RLock()
+	defer mu.RUnlock()
+	all := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	return all
+}
+
 // Get value for a key from cache
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with a context that bounds any request to a peer.
+// Loads through the Getter are not cancelled.
+func (g *Group) GetContext(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
 
-	if v, ok := g.mainCache.get(key); ok {
+	v, err := g.get(ctx, key)
+	if err != nil {
+		return ByteView{}, err
+	}
+	plain, err := v.open()
+	if err == nil {
+		return plain, nil
+	}
+	// e.g. encrypted under a key since dropped: load it again rather than
+	// answer with an empty value
+	log.Printf("[GeeCache] %s: dropping %s: %v", g.name, key, err)
+	g.mainCache.remove(g.cacheKey(key))
+	g.hotCache.remove(g.cacheKey(key))
+	if v, err = g.load(ctx, key); err != nil {
+		return ByteView{}, err
+	}
+	return v.open()
+}
+
+// get is GetContext without decoding the value, for peers, which are sent
+// values as they are cached.
+func (g *Group) get(ctx context.Context, key string) (ByteView, error) {
+	g.stats.gets.Add(1)
+	if v, ok := g.lookupCache(key); ok {
 		log.Println("[GeeCache] hit")
+		g.stats.cacheHits.Add(1)
 		return v, nil
 	}
 
-	return g.load(key)
+	return g.load(ctx, key)
 }
 
 // RegisterPeers registers a PeerPicker for choosing remote peer
@@ -83,22 +179,221 @@ func (g *Group) RegisterPeers(peers PeerPicker) {
 		panic("RegisterPeerPicker called more than once")
 	}
 	g.peers = peers
+	if w, ok := peers.(PeerWatcher); ok {
+		w.Watch(g.warm.rebalance)
+	}
+}
+
+// KeepWarm keeps key loaded by reloading it through the Getter about
+// every interval, a little early and with jitter so that registered keys
+// don't all reload at once. The key is registered with its owner, which
+// is the only node that reloads it. An interval of zero stops keeping the
+// key warm.
+func (g *Group) KeepWarm(key string, interval time.Duration) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if interval < 0 {
+		return fmt.Errorf("negative interval %v", interval)
+	}
+	if peer, ok := g.pickPeer(key); ok {
+		pw, ok := peer.(PeerWarmer)
+		if !ok {
+			return fmt.Errorf("peer can't keep %s warm", key)
+		}
+		return pw.KeepWarm(g.name, key, interval)
+	}
+	g.keepWarmLocally(key, interval)
+	return nil
+}
+
+// Set stores value for key in the cache of its owner, tagged with tags.
+// Any lease outstanding on the key is revoked, so that a load already in
+// flight can't overwrite the new value, and the write is broadcast so that
+// every other node drops its old copy shortly after.
+func (g *Group) Set(key string, value []byte, tags ...string) error {
+	return g.SetExpire(key, value, time.Time{}, tags...)
+}
+
+// SetExpire is Set for a value that expires at expire. After that it is
+// loaded through the Getter again, like a value that was never set.
+func (g *Group) SetExpire(key string, value []byte, expire time.Time, tags ...string) error {
+	return g.set(key, ByteView{b: value, e: expire}, tags)
+}
+
+// SetString is Set for a string value. A string is immutable, so the
+// owner keeps it without copying it, unless it compresses or encrypts it.
+func (g *Group) SetString(key, value string, tags ...string) error {
+	return g.set(key, ByteView{s: value}, tags)
+}
+
+// set sends value to the owner of key, or stores it if that is this node.
+// value may hold the caller's bytes: they are copied before being kept.
+func (g *Group) set(key string, value ByteView, tags []string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if peer, ok := g.pickPeer(key); ok {
+		ps, ok := peer.(PeerSetter)
+		if !ok {
+			return fmt.Errorf("peer can't set %s", key)
+		}
+		e, err := g.peerEntry(key, value, tags)
+		if err != nil {
+			return err
+		}
+		if err := ps.Set(g.name, e); err != nil {
+			return err
+		}
+		g.hotCache.remove(g.cacheKey(key))
+		return nil
+	}
+	if value.b != nil {
+		value.b = cloneBytes(value.b)
+	}
+	g.setLocally(key, value, tags)
+	return nil
+}
+
+// setLocally stores a value on its owner and broadcasts the write.
+func (g *Group) setLocally(key string, value ByteView, tags []string) {
+	g.leases.revoke(key, ByteView{}, false)
+	g.changes.key(key)
+	g.populateCache(key, value, tags...)
+	g.broadcast(key)
+}
+
+// Touch sets the expiry of key in the cache of its owner to expire, and
+// reports whether the key was cached there. Unlike SetExpire, it neither
+// loads a missing key nor writes the value again.
+func (g *Group) Touch(key string, expire time.Time) (bool, error) {
+	if key == "" {
+		return false, fmt.Errorf("key is required")
+	}
+	if peer, ok := g.pickPeer(key); ok {
+		pt, ok := peer.(PeerToucher)
+		if !ok {
+			return false, fmt.Errorf("peer can't touch %s", key)
+		}
+		touched, err := pt.Touch(g.name, key, expire)
+		if err != nil {
+			return false, err
+		}
+		g.hotCache.remove(g.cacheKey(key))
+		return touched, nil
+	}
+	return g.touchLocally(key, expire), nil
+}
+
+// touchLocally changes the expiry of a key on its owner and broadcasts
+// the change, so that other nodes drop copies with the old expiry.
+func (g *Group) touchLocally(key string, expire time.Time) bool {
+	if !g.mainCache.touch(g.cacheKey(key), expire) {
+		return false
+	}
+	g.changes.key(key)
+	g.broadcast(key)
+	return true
 }
 
-func (g *Group) load(key string) (value ByteView, err error) {
+// Remove removes key from the cache of its owner and revokes any lease
+// outstanding on it, so that a load already in flight can't put the old
+// value back. The removal is then broadcast so that every other node
+// drops its copy shortly after. It reports whether the owner had the key
+// cached.
+func (g *Group) Remove(key string) (bool, error) {
+	if key == "" {
+		return false, fmt.Errorf("key is required")
+	}
+	var err error
+	removed := false
+	peer, remote := g.pickPeer(key)
+	if remote {
+		if pr, ok := peer.(PeerRemover); ok {
+			removed, err = pr.Remove(g.name, key)
+		} else {
+			err = fmt.Errorf("peer can't remove %s", key)
+		}
+	}
+	if ok := g.removeLocally(key); !remote {
+		removed = ok
+	}
+	g.broadcast(key)
+	return removed, err
+}
+
+// broadcast tells every other node to drop its copy of key, if the peers
+// can be told.
+func (g *Group) broadcast(key string) {
+	if b, ok := g.peers.(PeerBroadcaster); ok {
+		b.Broadcast(g.name, key)
+	}
+}
+
+// removeLocally removes key from this node and reports whether its main
+// cache had it.
+func (g *Group) removeLocally(key string) bool {
+	g.changes.key(key)
+	value, ok := g.mainCache.remove(g.cacheKey(key))
+	g.hotCache.remove(g.cacheKey(key))
+	g.leases.revoke(key, value, ok)
+	return ok
+}
+
+// dropCopy drops the copy of key a broadcast says is stale. The owner's
+// copy is left alone: the change was made there synchronously, and a
+// broadcast that arrives late mustn't remove a value set since.
+func (g *Group) dropCopy(key string) {
+	if _, ok := g.pickPeer(key); !ok {
+		g.hotCache.remove(g.cacheKey(key))
+		return
+	}
+	g.removeLocally(key)
+}
+
+func (g *Group) keepWarmLocally(key string, interval time.Duration) {
+	if interval == 0 {
+		g.warm.remove(key)
+		return
+	}
+	g.warm.add(key, interval)
+}
+
+func (g *Group) pickPeer(key string) (PeerGetter, bool) {
+	if g.peers == nil {
+		return nil, false
+	}
+	return g.peers.PickPeer(key)
+}
+
+func (g *Group) load(ctx context.Context, key string) (value ByteView, err error) {
 	// each key is only fetched once (either locally or remotely)
 	// regardless of the number of concurrent callers.
 	viewi, err := g.loader.Do(key, func() (interface{}, error) {
+		g.stats.loads.Add(1)
 		if g.peers != nil {
 			if peer, ok := g.peers.PickPeer(key); ok {
-				if value, err = g.getFromPeer(peer, key); err == nil {
+				if value, err = g.getFromPeer(ctx, peer, key); err == nil {
+					g.stats.peerLoads.Add(1)
+					// keep a copy of one in ten remote values
+					if rand.Intn(10) == 0 {
+						g.hotCache.add(g.cacheKey(key), value)
+					}
 					return value, nil
 				}
+				g.stats.peerErrors.Add(1)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if errors.Is(err, ErrOverloaded) {
+					// loading it here would only add to the backend's load
+					return nil, err
+				}
 				log.Println("[GeeCache] Failed to get from peer", err)
 			}
 		}
 
-		return g.getLocally(key)
+		return g.getLocally(ctx, key)
 	})
 
 	if err == nil {
@@ -107,30 +402,178 @@ func (g *Group) load(key string) (value ByteView, err error) {
 	return
 }
 
-func (g *Group) populateCache(key string, value ByteView) {
-	g.mainCache.add(key, value)
+// reload loads key through the Getter even if it is cached, sharing the
+// load with any concurrent miss for the same key.
+func (g *Group) reload(ctx context.Context, key string) (ByteView, error) {
+	viewi, err := g.loader.Do(key, func() (interface{}, error) {
+		return g.getLocally(ctx, key)
+	})
+	if err != nil {
+		return ByteView{}, err
+	}
+	return viewi.(ByteView), nil
 }
 
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key)
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, ok := g.mainCache.get(g.cacheKey(key)); ok {
+		return v, true
+	}
+	return g.hotCache.get(g.cacheKey(key))
+}
+
+func (g *Group) populateCache(key string, value ByteView, tags ...string) {
+	value, err := g.encode(key, value)
 	if err != nil {
-		return ByteView{}, err
+		log.Printf("[GeeCache] %s: not caching %s: %v", g.name, key, err)
+		return
+	}
+	g.mainCache.add(g.cacheKey(key), value, tags...)
+}
+
+// getLocally loads key through the Getter under a lease, so that a Remove
+// racing with the load stops the loaded value from being cached. Waiting
+// for a load slot ends with ctx.
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	for {
+		token, held, _, _ := g.leases.acquire(key)
+		if held != nil {
+			// a remote client is filling the key, wait for it
+			held.wait()
+			if v, ok := g.lookupCache(key); ok {
+				return v, nil
+			}
+			continue
+		}
+
+		if l := g.limiter.Load(); l != nil {
+			if err := l.acquire(ctx); err != nil {
+				if errors.Is(err, ErrOverloaded) {
+					g.stats.loadsRejected.Add(1)
+				}
+				g.leases.release(key, token)
+				return ByteView{}, err
+			}
+			defer l.release()
+		}
+		bytes, tags, err := g.getTagged(key)
+		g.stats.localLoads.Add(1)
+		if err != nil {
+			g.stats.localLoadErrs.Add(1)
+			g.leases.release(key, token)
+			return ByteView{}, err
+		}
+		value, err := g.encode(key, ByteView{b: cloneBytes(bytes)})
+		if err != nil {
+			g.leases.release(key, token)
+			return ByteView{}, err
+		}
+		if g.leases.release(key, token) {
+			g.populateCache(key, value, tags...)
+		}
+		return value, nil
+	}
+}
+
+func (g *Group) getTagged(key string) ([]byte, []string, error) {
+	if tg, ok := g.getter.(TaggedGetter); ok {
+		return tg.GetTagged(key)
+	}
+	bytes, err := g.getter.Get(key)
+	return bytes, nil, err
+}
 
+// answer serves a request from a peer. If local is set, key is looked up
+// or loaded here even if another peer owns it.
+func (g *Group) answer(ctx context.Context, in *pb.Request, local bool) (*pb.Response, error) {
+	g.setGeneration(in.GetGeneration())
+
+	var res *pb.Response
+	if in.GetLease() {
+		lease := g.leaseGetLocally(in.GetKey())
+		res = &pb.Response{
+			Value:       lease.Value.raw(),
+			Expire:      unixNano(lease.Value.Expire()),
+			Compression: lease.Value.codecName(),
+			KeyId:       lease.Value.kid,
+			Lease:       lease.Token,
+			Wait:        lease.Wait,
+			Stale:       lease.Stale,
+		}
+	} else {
+		get := g.get
+		if local {
+			get = g.getHere
+		}
+		view, err := get(ctx, in.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		res = &pb.Response{
+			Value:       view.raw(),
+			Expire:      unixNano(view.Expire()),
+			Compression: view.codecName(),
+			KeyId:       view.kid,
+		}
 	}
-	value := ByteView{b: cloneBytes(bytes)}
-	g.populateCache(key, value)
-	return value, nil
+	res.Generation = g.Generation()
+	return res, nil
 }
 
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
 	req := &pb.Request{
-		Group: g.name,
-		Key:   key,
+		Group:      g.name,
+		Key:        key,
+		Generation: g.generation.Load(),
 	}
 	res := &pb.Response{}
-	err := peer.Get(req, res)
+	var err error
+	if pc, ok := peer.(PeerContextGetter); ok {
+		err = pc.GetContext(ctx, req, res)
+	} else {
+		err = peer.Get(req, res)
+	}
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{b: res.Value}, nil
+	g.setGeneration(res.Generation)
+	return g.peerView(key, res.Value, res.Expire, res.Compression, res.KeyId)
+}
+
+// peerEntry encodes value, the value of key, as the group is configured
+// to, so that it reaches its owner as it is cached there.
+func (g *Group) peerEntry(key string, value ByteView, tags []string) (*pb.Entry, error) {
+	value, err := g.encode(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Entry{
+		Key:         key,
+		Value:       value.raw(),
+		Tags:        tags,
+		Expire:      unixNano(value.Expire()),
+		Compression: value.codecName(),
+		KeyId:       value.kid,
+	}, nil
+}
+
+// entryView returns the value of an entry a peer sent, as peerView does.
+func (g *Group) entryView(e *pb.Entry) (ByteView, error) {
+	return g.peerView(e.GetKey(), e.GetValue(), e.GetExpire(), e.GetCompression(), e.GetKeyId())
+}
+
+// peerView returns the value of key a peer sent as it was sent, compressed
+// with the named codec and encrypted with the key keyID if they are set.
+func (g *Group) peerView(key string, value []byte, expire int64, codecName, keyID string) (ByteView, error) {
+	codec, ok := codecNamed(codecName)
+	if !ok {
+		return ByteView{}, fmt.Errorf("value compressed with unknown codec %q", codecName)
+	}
+	v := ByteView{b: value, e: fromUnixNano(expire), c: codec}
+	if keyID != "" {
+		if err := g.keys.canOpen(keyID); err != nil {
+			return ByteView{}, fmt.Errorf("value encrypted with key %q: %v", keyID, err)
+		}
+		v.k, v.kid, v.key = &g.keys, keyID, key
+	}
+	return v, nil
 }
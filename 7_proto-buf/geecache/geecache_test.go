@@ -5,6 +5,7 @@ import (
 	"log"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var db = map[string]string{
@@ -65,3 +66,84 @@ func TestGetGroup(t *testing.T) {
 		t.Fatalf("expect nil, but %s got", group.name)
 	}
 }
+
+func TestSetExpire(t *testing.T) {
+	c := newTestCluster(t, 2, "expire", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("loaded"), nil
+		}))
+
+	expire := time.Now().Add(100 * time.Millisecond)
+	for i, node := range c.nodes {
+		key := fmt.Sprintf("key-%d", i)
+		if err := c.nodes[0].group.SetExpire(key, []byte("set"), expire); err != nil {
+			t.Fatal(err)
+		}
+		view, err := node.group.Get(key)
+		if err != nil || view.String() != "set" || !view.Expire().Equal(expire) {
+			t.Fatalf("expected the set value to expire at %v, got %v, %v, %v", expire, view, view.Expire(), err)
+		}
+	}
+
+	time.Sleep(time.Until(expire))
+	for i, node := range c.nodes {
+		node.group.hotCache.removePrefix("")
+		if view, err := node.group.Get(fmt.Sprintf("key-%d", i)); err != nil || view.String() != "loaded" {
+			t.Fatalf("expected the expired value to be loaded again, got %v, %v", view, err)
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c := newTestCluster(t, 2, "touch", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("loaded"), nil
+		}))
+
+	expire := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	for i := range c.nodes {
+		key := fmt.Sprintf("key-%d", i)
+		owner := c.owner(key)
+		if touched, err := c.nodes[0].group.Touch(key, expire); err != nil || touched {
+			t.Fatalf("expected %s not to be touched before it is cached, got %v, %v", key, touched, err)
+		}
+		if _, ok := owner.group.mainCache.get(owner.group.cacheKey(key)); ok {
+			t.Fatalf("expected touching %s not to load it", key)
+		}
+		if err := c.nodes[0].group.Set(key, []byte("set")); err != nil {
+			t.Fatal(err)
+		}
+		if touched, err := c.nodes[0].group.Touch(key, expire); err != nil || !touched {
+			t.Fatalf("expected %s to be touched, got %v, %v", key, touched, err)
+		}
+		view, ok := owner.group.mainCache.get(owner.group.cacheKey(key))
+		if !ok || view.String() != "set" || !view.Expire().Equal(expire) {
+			t.Fatalf("expected the set value to expire at %v, got %v, %v", expire, view, view.Expire())
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	g := newGroup("stats", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s %w", key, ErrNotFound)
+		}))
+	for _, key := range []string{"Tom", "Tom", "Sam", "unknown"} {
+		g.Get(key)
+	}
+
+	want := Stats{
+		Gets:          4,
+		CacheHits:     1,
+		Loads:         3,
+		LocalLoads:    3,
+		LocalLoadErrs: 1,
+		MainCache:     CacheStats{Bytes: int64(len(g.cacheKey("Tom") + "630" + g.cacheKey("Sam") + "567")), Items: 2},
+	}
+	if got := g.Stats(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
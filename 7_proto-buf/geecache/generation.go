@@ -0,0 +1,123 @@
+package geecache
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"strings"
+	"time"
+)
+
+// generationNodeBits are the low bits of the generations a node picks
+// that tell it apart from the other nodes, see nextGeneration.
+const generationNodeBits = 16
+
+// InvalidateAll drops every entry of the group on every peer. Rather than
+// walking the caches, it bumps the group's generation, which is part of
+// every cache key: entries from older generations are never hit again and
+// age out of the LRU on their own.
+//
+// Peers adopt the highest generation they see, both from InvalidateAll and
+// from the generation carried on every peer request, so a peer that missed
+// the broadcast catches up the next time it talks to the others.
+func (g *Group) InvalidateAll() error {
+	gen := g.nextGeneration()
+	return g.invalidatePeers(func(pi PeerInvalidator) error {
+		return pi.InvalidateAll(g.name, gen)
+	})
+}
+
+// nextGeneration moves the group to a generation above the current one
+// and returns it. Two calls mustn't pick the same one, or entries cached
+// between them would survive the second: the generation is the clock in
+// milliseconds, or one more than the current generation if the clock is
+// behind it, over low bits that identify this node.
+func (g *Group) nextGeneration() uint64 {
+	now := uint64(time.Now().UnixMilli())
+	node := g.generationNode()
+	for {
+		cur := g.generation.Load()
+		gen := max(now, cur>>generationNodeBits+1)<<generationNodeBits | node
+		if g.generation.CompareAndSwap(cur, gen) {
+			g.generationChanged(gen)
+			return gen
+		}
+	}
+}
+
+// generationNode returns the low bits of the generations this node picks:
+// a hash of its address, if its peers know it.
+func (g *Group) generationNode() uint64 {
+	s, ok := g.peers.(interface{ selfAddr() string })
+	if !ok {
+		return 0
+	}
+	return uint64(crc32.ChecksumIEEE([]byte(s.selfAddr()))) & (1<<generationNodeBits - 1)
+}
+
+// invalidatePeers calls fn for every remote peer and returns the errors
+// of those it couldn't reach. It fails if the group has peers it can't
+// list, rather than leave them to serve what was invalidated.
+func (g *Group) invalidatePeers(fn func(PeerInvalidator) error) error {
+	if g.peers == nil {
+		return nil
+	}
+	lister, ok := g.peers.(PeerLister)
+	if !ok {
+		return fmt.Errorf("peers of %s can't be listed to invalidate them", g.name)
+	}
+	var errs []error
+	for _, peer := range lister.AllPeers() {
+		pi, ok := peer.(PeerInvalidator)
+		if !ok {
+			errs = append(errs, fmt.Errorf("peer can't invalidate %s", g.name))
+			continue
+		}
+		if err := fn(pi); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Generation returns the group's current generation.
+func (g *Group) Generation() uint64 {
+	return g.generation.Load()
+}
+
+// setGeneration moves the group forward to gen if it is newer than the
+// current generation. Leases handed out under the old generation are
+// revoked so that loads in flight can't populate the new one.
+func (g *Group) setGeneration(gen uint64) {
+	for {
+		cur := g.generation.Load()
+		if gen <= cur {
+			return
+		}
+		if g.generation.CompareAndSwap(cur, gen) {
+			break
+		}
+	}
+	g.generationChanged(gen)
+}
+
+// generationChanged revokes the leases handed out under the generation
+// the group just left.
+func (g *Group) generationChanged(gen uint64) {
+	g.leases.revokeAll()
+	log.Printf("[GeeCache] %s moved to generation %d", g.name, gen)
+}
+
+// cacheKey mixes the group's current generation into key.
+func (g *Group) cacheKey(key string) string {
+	return fmt.Sprintf("%d/%s", g.generation.Load(), key)
+}
+
+// plainKey is the key a cache key was made of.
+func plainKey(cacheKey string) string {
+	if _, key, ok := strings.Cut(cacheKey, "/"); ok {
+		return key
+	}
+	return cacheKey
+}
@@ -0,0 +1,114 @@
+package geecache
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInvalidateAll(t *testing.T) {
+	loads := 0
+	g := NewGroup("generation", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}))
+	picker := &fakePicker{peer: &fakePeer{}}
+	g.RegisterPeers(picker)
+
+	g.Get("a")
+	g.Get("b")
+	if loads != 2 {
+		t.Fatalf("expected 2 loads, got %d", loads)
+	}
+	if err := g.InvalidateAll(); err != nil {
+		t.Fatal(err)
+	}
+	g.Get("a")
+	g.Get("b")
+	if loads != 4 {
+		t.Fatalf("expected every key to be reloaded, got %d loads", loads)
+	}
+	if gen := picker.peer.generations[g.name]; gen == 0 || gen != g.Generation() {
+		t.Fatalf("expected peers to move to generation %d, got %d", g.Generation(), gen)
+	}
+}
+
+func TestInvalidateAllConcurrently(t *testing.T) {
+	// two nodes invalidating at once, from the same generation, must not
+	// pick the same next one, whether it comes from the clock or not
+	for _, cur := range []uint64{0, uint64(time.Now().UnixNano()) + 1<<40} {
+		a := &Group{name: "generation-a", peers: NewHTTPPool("http://a")}
+		b := &Group{name: "generation-b", peers: NewHTTPPool("http://b")}
+		a.setGeneration(cur)
+		b.setGeneration(cur)
+		genA, genB := a.nextGeneration(), b.nextGeneration()
+		if genA <= cur || genB <= cur || genA == genB {
+			t.Fatalf("expected two new generations above %d, got %d and %d", cur, genA, genB)
+		}
+	}
+}
+
+func TestNextGenerationIncreases(t *testing.T) {
+	// a node invalidating again and again, even from several goroutines
+	// at once, never picks a generation twice
+	g := &Group{name: "generation-increases"}
+	gens := make(chan uint64, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				gens <- g.nextGeneration()
+			}
+		}()
+	}
+	wg.Wait()
+	close(gens)
+	seen := make(map[uint64]bool)
+	var last uint64
+	for gen := range gens {
+		if seen[gen] {
+			t.Fatalf("generation %d picked twice", gen)
+		}
+		seen[gen] = true
+		last = max(last, gen)
+	}
+	if gen := g.Generation(); gen != last {
+		t.Fatalf("expected the group to be at the last generation picked, %d, got %d", last, gen)
+	}
+}
+
+func TestGenerationOverHTTP(t *testing.T) {
+	owner := NewGroup("generation-http", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	srv := httptest.NewServer(NewHTTPPool("http://owner"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+
+	if err := peer.InvalidateAll(owner.name, 3); err != nil {
+		t.Fatal(err)
+	}
+	if gen := owner.Generation(); gen != 3 {
+		t.Fatalf("expected generation 3, got %d", gen)
+	}
+	// an older generation is ignored
+	if err := peer.InvalidateAll(owner.name, 2); err != nil || owner.Generation() != 3 {
+		t.Fatalf("expected generation to stay at 3, got %d, %v", owner.Generation(), err)
+	}
+
+	// a peer that missed the broadcast catches up on its next request,
+	// and so does the owner if it is the one behind
+	g := &Group{name: owner.name}
+	if _, err := g.getFromPeer(context.Background(), peer, "k"); err != nil || g.Generation() != 3 {
+		t.Fatalf("expected the caller to catch up to 3, got %d, %v", g.Generation(), err)
+	}
+	g.setGeneration(5)
+	g.getFromPeer(context.Background(), peer, "k")
+	if gen := owner.Generation(); gen != 5 {
+		t.Fatalf("expected the owner to catch up to 5, got %d", gen)
+	}
+}
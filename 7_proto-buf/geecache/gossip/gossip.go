@@ -0,0 +1,616 @@
+// Package gossip implements SWIM-style cluster membership: nodes probe
+// each other directly and, failing that, through a few others; members
+// that can't be reached are suspected before they are declared dead; and
+// membership changes are piggybacked on the probes themselves. A suspected
+// node that is still alive refutes the suspicion by bumping its
+// incarnation number.
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval  = time.Second
+	defaultProbeTimeout   = 300 * time.Millisecond
+	defaultIndirectProbes = 3
+	defaultSyncInterval   = 30 * time.Second
+	// updates are piggybacked this many times log(n) before they are
+	// considered disseminated
+	retransmitMult = 4
+	maxPiggyback   = 16
+)
+
+// State is a member's state as seen by this node.
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+// A Member is a node of the cluster.
+type Member struct {
+	Name        string // the node's peer URL, e.g. "http://10.0.0.2:8001"
+	Addr        string // the node's gossip address, e.g. "10.0.0.2:8001"
+	State       State
+	Incarnation uint64
+}
+
+// Config configures a Node. Name and Addr are required.
+type Config struct {
+	Name  string
+	Addr  string
+	Seeds []string // gossip addresses of nodes to join through
+
+	ProbeInterval    time.Duration // defaults to 1s
+	ProbeTimeout     time.Duration // defaults to 300ms
+	IndirectProbes   int           // defaults to 3
+	SuspicionTimeout time.Duration // defaults to 5 probe intervals
+	// how often to exchange full state with a random member, dead ones
+	// included, so that partitions heal; defaults to 30s
+	SyncInterval time.Duration
+
+	Transport Transport // defaults to UDP on Addr
+
+	// Signer, if not nil, signs outgoing messages and verifies incoming
+	// ones, so that only nodes with the keys can change the membership.
+	Signer Signer
+}
+
+// A Signer authenticates gossip messages. *geecache.PeerKeys is a Signer,
+// so gossip can share the keys the peers sign their requests with.
+type Signer interface {
+	// SignMessage returns msg with its signature.
+	SignMessage(msg []byte) ([]byte, error)
+	// VerifyMessage checks the signature of b and returns the message
+	// it signs.
+	VerifyMessage(b []byte) ([]byte, error)
+}
+
+type msgType int
+
+const (
+	msgPing msgType = iota
+	msgPingReq
+	msgAck
+	msgSync
+	msgSyncReply
+)
+
+type message struct {
+	Type     msgType  `json:"type"`
+	Seq      uint64   `json:"seq,omitempty"`
+	FromAddr string   `json:"from_addr"`
+	Target   *Member  `json:"target,omitempty"` // for pingReq
+	Updates  []Member `json:"updates,omitempty"`
+}
+
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// A Node is this process's view of cluster membership. It implements
+// geecache's Discovery interface, so it can drive an HTTPPool directly.
+type Node struct {
+	cfg       Config
+	transport Transport
+
+	mu          sync.Mutex // guards everything below
+	self        Member
+	members     map[string]*Member
+	suspicions  map[string]*time.Timer
+	queue       map[string]*broadcast // pending updates, by member name
+	probeOrder  []string
+	seq         uint64
+	acks        map[uint64]func()
+	subscribers []chan struct{}
+	left        bool
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// New creates a node and starts gossiping. It joins the cluster through
+// the seeds, if any.
+func New(cfg Config) (*Node, error) {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = defaultProbeInterval
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = defaultProbeTimeout
+	}
+	if cfg.IndirectProbes <= 0 {
+		cfg.IndirectProbes = defaultIndirectProbes
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = 5 * cfg.ProbeInterval
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = defaultSyncInterval
+	}
+	if cfg.Transport == nil {
+		t, err := ListenUDP(cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Transport = t
+	}
+
+	n := &Node{
+		cfg:        cfg,
+		transport:  cfg.Transport,
+		self:       Member{Name: cfg.Name, Addr: cfg.Addr, State: Alive},
+		members:    make(map[string]*Member),
+		suspicions: make(map[string]*time.Timer),
+		queue:      make(map[string]*broadcast),
+		acks:       make(map[uint64]func()),
+		stop:       make(chan struct{}),
+	}
+	n.members[cfg.Name] = &Member{Name: cfg.Name, Addr: cfg.Addr, State: Alive}
+	n.enqueue(n.self)
+
+	n.done.Add(2)
+	go n.receiveLoop()
+	go n.probeLoop()
+	for _, seed := range cfg.Seeds {
+		if seed != cfg.Addr {
+			n.send(seed, &message{Type: msgSync, Updates: n.state()})
+		}
+	}
+	return n, nil
+}
+
+// Members returns every member this node knows about, dead ones included,
+// sorted by name.
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sortedMembers()
+}
+
+// Live returns the names of the members that are alive or suspected.
+// Suspected members stay in the ring until they are declared dead, so that
+// a slow probe doesn't reshuffle keys.
+func (n *Node) Live() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.live()
+}
+
+func (n *Node) live() []string {
+	var names []string
+	for _, m := range n.members {
+		if m.State != Dead {
+			names = append(names, m.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (n *Node) sortedMembers() []Member {
+	all := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		all = append(all, *m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Discover sends the live members' names on ch every time they change,
+// until ctx is done. It implements geecache.Discovery.
+func (n *Node) Discover(ctx context.Context, ch chan<- []string) error {
+	changed := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.subscribers = append(n.subscribers, changed)
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.subscribers = slices.DeleteFunc(n.subscribers, func(c chan struct{}) bool {
+			return c == changed
+		})
+	}()
+	changed <- struct{}{}
+
+	for {
+		select {
+		case <-changed:
+			select {
+			case ch <- n.Live():
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Leave tells the other members that this node is leaving and stops
+// gossiping. Unlike a crash, the others drop the node at once rather than
+// after the suspicion timeout.
+func (n *Node) Leave() {
+	n.mu.Lock()
+	n.left = true
+	n.self.State = Dead
+	n.members[n.self.Name].State = Dead
+	leave := &message{Type: msgPing, Updates: []Member{n.self}}
+	var addrs []string
+	for _, m := range n.members {
+		if m.Name != n.self.Name && m.State != Dead {
+			addrs = append(addrs, m.Addr)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, addr := range addrs {
+		n.send(addr, leave)
+	}
+	n.Stop()
+}
+
+// Stop stops gossiping without telling anyone, as if the node crashed.
+func (n *Node) Stop() {
+	select {
+	case <-n.stop:
+		return
+	default:
+	}
+	close(n.stop)
+	n.transport.Close()
+	n.done.Wait()
+	n.mu.Lock()
+	for _, t := range n.suspicions {
+		t.Stop()
+	}
+	n.mu.Unlock()
+}
+
+func (n *Node) probeLoop() {
+	defer n.done.Done()
+	ticker := time.NewTicker(n.cfg.ProbeInterval)
+	defer ticker.Stop()
+	lastSync := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stop:
+			return
+		}
+		if time.Since(lastSync) >= n.cfg.SyncInterval {
+			lastSync = time.Now()
+			n.syncRandom()
+		}
+		n.probe()
+	}
+}
+
+// probe checks the next member in round-robin order: directly first,
+// then through IndirectProbes others, and suspects it if neither works
+// within the probe interval.
+func (n *Node) probe() {
+	target, ok := n.nextTarget()
+	if !ok {
+		return
+	}
+	seq, acked := n.expectAck()
+	n.send(target.Addr, &message{Type: msgPing, Seq: seq})
+
+	timeout := time.NewTimer(n.cfg.ProbeTimeout)
+	defer timeout.Stop()
+	select {
+	case <-acked:
+		return
+	case <-timeout.C:
+	case <-n.stop:
+		return
+	}
+
+	for _, m := range n.randomMembers(n.cfg.IndirectProbes, target.Name) {
+		t := target
+		n.send(m.Addr, &message{Type: msgPingReq, Seq: seq, Target: &t})
+	}
+	timeout.Reset(n.cfg.ProbeInterval - n.cfg.ProbeTimeout)
+	select {
+	case <-acked:
+		return
+	case <-timeout.C:
+	case <-n.stop:
+		return
+	}
+
+	n.mu.Lock()
+	delete(n.acks, seq)
+	n.mu.Unlock()
+	n.apply(Member{Name: target.Name, Addr: target.Addr, State: Suspect, Incarnation: target.Incarnation})
+}
+
+// nextTarget returns the next live member to probe. Members are probed in
+// a random order that is reshuffled after every round.
+func (n *Node) nextTarget() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		if len(n.probeOrder) == 0 {
+			for name, m := range n.members {
+				if name != n.self.Name && m.State != Dead {
+					n.probeOrder = append(n.probeOrder, name)
+				}
+			}
+			if len(n.probeOrder) == 0 {
+				return Member{}, false
+			}
+			rand.Shuffle(len(n.probeOrder), func(i, j int) {
+				n.probeOrder[i], n.probeOrder[j] = n.probeOrder[j], n.probeOrder[i]
+			})
+		}
+		name := n.probeOrder[0]
+		n.probeOrder = n.probeOrder[1:]
+		if m, ok := n.members[name]; ok && m.State != Dead {
+			return *m, true
+		}
+	}
+}
+
+// randomMembers returns up to k live members other than this node and
+// exclude.
+func (n *Node) randomMembers(k int, exclude string) []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var candidates []Member
+	for name, m := range n.members {
+		if name != n.self.Name && name != exclude && m.State != Dead {
+			candidates = append(candidates, *m)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// syncRandom exchanges full state with a random member, dead or not.
+// Probes only reach live members, so this is how the two sides of a healed
+// partition find each other again.
+func (n *Node) syncRandom() {
+	n.mu.Lock()
+	var addrs []string
+	for name, m := range n.members {
+		if name != n.self.Name {
+			addrs = append(addrs, m.Addr)
+		}
+	}
+	n.mu.Unlock()
+	if len(addrs) > 0 {
+		n.send(addrs[rand.Intn(len(addrs))], &message{Type: msgSync, Updates: n.state()})
+	}
+}
+
+func (n *Node) state() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sortedMembers()
+}
+
+// expectAck allocates a sequence number and returns a channel that is
+// closed when it is acknowledged.
+func (n *Node) expectAck() (uint64, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	acked := make(chan struct{})
+	n.acks[n.seq] = func() { close(acked) }
+	return n.seq, acked
+}
+
+func (n *Node) receiveLoop() {
+	defer n.done.Done()
+	for {
+		select {
+		case data, ok := <-n.transport.Packets():
+			if !ok {
+				return
+			}
+			if n.cfg.Signer != nil {
+				var err error
+				if data, err = n.cfg.Signer.VerifyMessage(data); err != nil {
+					log.Println("[Gossip] Refused message", err)
+					continue
+				}
+			}
+			msg := &message{}
+			if err := json.Unmarshal(data, msg); err != nil {
+				log.Println("[Gossip] Bad message", err)
+				continue
+			}
+			n.handle(msg)
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *Node) handle(msg *message) {
+	for _, m := range msg.Updates {
+		n.apply(m)
+	}
+
+	switch msg.Type {
+	case msgPing:
+		if msg.Seq != 0 {
+			n.send(msg.FromAddr, &message{Type: msgAck, Seq: msg.Seq})
+		}
+	case msgPingReq:
+		// probe the target on the sender's behalf and relay its ack
+		if msg.Target == nil {
+			return
+		}
+		origin, originSeq := msg.FromAddr, msg.Seq
+		seq, acked := n.expectAck()
+		n.send(msg.Target.Addr, &message{Type: msgPing, Seq: seq})
+		go func() {
+			timer := time.NewTimer(n.cfg.ProbeInterval)
+			defer timer.Stop()
+			select {
+			case <-acked:
+				n.send(origin, &message{Type: msgAck, Seq: originSeq})
+			case <-timer.C:
+				n.mu.Lock()
+				delete(n.acks, seq)
+				n.mu.Unlock()
+			case <-n.stop:
+			}
+		}()
+	case msgAck:
+		n.mu.Lock()
+		fn, ok := n.acks[msg.Seq]
+		delete(n.acks, msg.Seq)
+		n.mu.Unlock()
+		if ok {
+			fn()
+		}
+	case msgSync:
+		n.send(msg.FromAddr, &message{Type: msgSyncReply, Updates: n.state()})
+	}
+}
+
+// apply merges what another node says about m into our view, following
+// the SWIM precedence rules: a higher incarnation wins, and at the same
+// incarnation dead beats suspect beats alive.
+func (n *Node) apply(m Member) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.Name == n.self.Name {
+		if m.State != Alive && !n.left && m.Incarnation >= n.self.Incarnation {
+			// refute: we are alive, and say so with a newer incarnation
+			n.self.Incarnation = m.Incarnation + 1
+			*n.members[n.self.Name] = n.self
+			n.enqueue(n.self)
+		}
+		return
+	}
+
+	cur, known := n.members[m.Name]
+	if !known {
+		if m.State == Dead {
+			return
+		}
+		cur = &Member{Name: m.Name, Addr: m.Addr, State: Dead}
+		n.members[m.Name] = cur
+	} else if m.Incarnation < cur.Incarnation ||
+		m.Incarnation == cur.Incarnation && m.State <= cur.State {
+		return
+	}
+
+	wasLive := cur.State != Dead
+	*cur = m
+	n.enqueue(m)
+
+	if t, ok := n.suspicions[m.Name]; ok && m.State != Suspect {
+		t.Stop()
+		delete(n.suspicions, m.Name)
+	}
+	if m.State == Suspect {
+		if _, ok := n.suspicions[m.Name]; !ok {
+			name, inc := m.Name, m.Incarnation
+			n.suspicions[m.Name] = time.AfterFunc(n.cfg.SuspicionTimeout, func() {
+				n.mu.Lock()
+				delete(n.suspicions, name)
+				n.mu.Unlock()
+				n.apply(Member{Name: name, Addr: m.Addr, State: Dead, Incarnation: inc})
+			})
+		}
+	}
+	if wasLive != (m.State != Dead) {
+		log.Printf("[Gossip] %s: %s is %s", n.self.Name, m.Name, m.State)
+		n.notify()
+	}
+}
+
+// enqueue queues m to be piggybacked on outgoing messages, replacing any
+// older news about the same member.
+func (n *Node) enqueue(m Member) {
+	n.queue[m.Name] = &broadcast{member: m}
+}
+
+// piggyback picks the least transmitted updates to send with a message.
+func (n *Node) piggyback() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.queue) == 0 {
+		return nil
+	}
+	pending := make([]*broadcast, 0, len(n.queue))
+	for _, b := range n.queue {
+		pending = append(pending, b)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].transmits < pending[j].transmits })
+	if len(pending) > maxPiggyback {
+		pending = pending[:maxPiggyback]
+	}
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(n.members)+1))))
+	updates := make([]Member, 0, len(pending))
+	for _, b := range pending {
+		updates = append(updates, b.member)
+		if b.transmits++; b.transmits >= limit {
+			delete(n.queue, b.member.Name)
+		}
+	}
+	return updates
+}
+
+func (n *Node) notify() {
+	for _, ch := range n.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) send(addr string, msg *message) {
+	out := *msg
+	out.FromAddr = n.cfg.Addr
+	out.Updates = append(slices.Clone(msg.Updates), n.piggyback()...)
+	data, err := json.Marshal(&out)
+	if err != nil {
+		log.Println("[Gossip] Failed to encode message", err)
+		return
+	}
+	if n.cfg.Signer != nil {
+		if data, err = n.cfg.Signer.SignMessage(data); err != nil {
+			log.Println("[Gossip] Failed to sign message", err)
+			return
+		}
+	}
+	if err := n.transport.WriteTo(data, addr); err != nil {
+		log.Println("[Gossip] Failed to send to", addr, err)
+	}
+}
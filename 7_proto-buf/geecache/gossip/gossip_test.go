@@ -0,0 +1,246 @@
+package gossip
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNetwork connects in-process nodes. Like UDP, it silently drops
+// packets to nodes that are gone or cut off.
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*memTransport
+	cut   map[[2]string]bool // from, to
+}
+
+type memTransport struct {
+	net     *memNetwork
+	addr    string
+	packets chan []byte
+	closed  bool
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		nodes: make(map[string]*memTransport),
+		cut:   make(map[[2]string]bool),
+	}
+}
+
+func (n *memNetwork) listen(addr string) *memTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t := &memTransport{net: n, addr: addr, packets: make(chan []byte, 256)}
+	n.nodes[addr] = t
+	return t
+}
+
+// partition cuts every link between a and b.
+func (n *memNetwork) partition(a, b []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			n.cut[[2]string{x, y}] = true
+			n.cut[[2]string{y, x}] = true
+		}
+	}
+}
+
+func (n *memNetwork) heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut = make(map[[2]string]bool)
+}
+
+func (t *memTransport) WriteTo(b []byte, addr string) error {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	dst, ok := t.net.nodes[addr]
+	if !ok || dst.closed || t.net.cut[[2]string{t.addr, addr}] {
+		return nil
+	}
+	select {
+	case dst.packets <- slices.Clone(b):
+	default:
+	}
+	return nil
+}
+
+func (t *memTransport) Packets() <-chan []byte {
+	return t.packets
+}
+
+func (t *memTransport) Close() error {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.packets)
+	}
+	return nil
+}
+
+// testCluster runs n gossiping nodes in one process, all joining through
+// the first.
+type testCluster struct {
+	net   *memNetwork
+	nodes []*Node
+	names []string
+}
+
+func newTestCluster(t *testing.T, n int, configure func(*Config)) *testCluster {
+	t.Helper()
+	c := &testCluster{net: newMemNetwork()}
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("node-%d", i)
+		cfg := Config{
+			Name:             "http://" + addr,
+			Addr:             addr,
+			Seeds:            []string{"node-0"},
+			ProbeInterval:    20 * time.Millisecond,
+			ProbeTimeout:     5 * time.Millisecond,
+			SuspicionTimeout: 100 * time.Millisecond,
+			SyncInterval:     100 * time.Millisecond,
+			Transport:        c.net.listen(addr),
+		}
+		if configure != nil {
+			configure(&cfg)
+		}
+		node, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes = append(c.nodes, node)
+		c.names = append(c.names, addr)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+// converged waits until every node in nodes sees exactly expect as live.
+func converged(nodes []*Node, expect int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		ok := true
+		for _, node := range nodes {
+			if len(node.Live()) != expect {
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestJoin(t *testing.T) {
+	c := newTestCluster(t, 5, nil)
+	if !converged(c.nodes, 5, 2*time.Second) {
+		t.Fatalf("nodes didn't find each other: %v", c.nodes[4].Members())
+	}
+}
+
+func TestNodeDeath(t *testing.T) {
+	c := newTestCluster(t, 5, nil)
+	if !converged(c.nodes, 5, 2*time.Second) {
+		t.Fatal("nodes didn't find each other")
+	}
+	c.nodes[4].Stop()
+	if !converged(c.nodes[:4], 4, 2*time.Second) {
+		t.Fatalf("dead node not detected: %v", c.nodes[0].Members())
+	}
+}
+
+func TestPartition(t *testing.T) {
+	c := newTestCluster(t, 5, nil)
+	if !converged(c.nodes, 5, 2*time.Second) {
+		t.Fatal("nodes didn't find each other")
+	}
+
+	c.net.partition(c.names[:3], c.names[3:])
+	if !converged(c.nodes[:3], 3, 2*time.Second) || !converged(c.nodes[3:], 2, 2*time.Second) {
+		t.Fatalf("partition not detected: %v / %v", c.nodes[0].Live(), c.nodes[4].Live())
+	}
+
+	c.net.heal()
+	if !converged(c.nodes, 5, 3*time.Second) {
+		t.Fatalf("partition didn't heal: %v / %v", c.nodes[0].Live(), c.nodes[4].Live())
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	c := newTestCluster(t, 3, func(cfg *Config) { cfg.SuspicionTimeout = time.Second })
+	if !converged(c.nodes, 3, 2*time.Second) {
+		t.Fatal("nodes didn't find each other")
+	}
+
+	// node-0 wrongly suspects node-1, which hears about it and refutes
+	c.nodes[0].apply(Member{Name: "http://node-1", Addr: "node-1", State: Suspect})
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, m := range c.nodes[0].Members() {
+			if m.Name == "http://node-1" && m.State == Alive && m.Incarnation > 0 {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("suspicion not refuted: %v", c.nodes[0].Members())
+}
+
+func TestLeave(t *testing.T) {
+	c := newTestCluster(t, 4, func(cfg *Config) { cfg.SuspicionTimeout = time.Minute })
+	if !converged(c.nodes, 4, 2*time.Second) {
+		t.Fatal("nodes didn't find each other")
+	}
+	c.nodes[3].Leave()
+	if !converged(c.nodes[:3], 3, time.Second) {
+		t.Fatalf("leave not noticed before the suspicion timeout: %v", c.nodes[0].Members())
+	}
+}
+
+func TestDiscoverFeedsHTTPPool(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	pool := geecache.NewHTTPPool("http://node-0")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.Discover(ctx, c.nodes[0], 10*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(pool.AllPeers()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d peers, expected 2", len(pool.AllPeers()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignedGossip(t *testing.T) {
+	c := newTestCluster(t, 4, func(cfg *Config) {
+		secret := []byte("secret")
+		if cfg.Addr == "node-3" {
+			secret = []byte("guess")
+		}
+		cfg.Signer = &geecache.PeerKeys{Keys: map[string][]byte{"k1": secret}, SignWith: "k1", Enforce: true}
+	})
+	if !converged(c.nodes[:3], 3, 2*time.Second) {
+		t.Fatalf("signed nodes didn't find each other: %v", c.nodes[0].Members())
+	}
+	for _, m := range c.nodes[0].Members() {
+		if m.Name == "http://node-3" {
+			t.Fatalf("expected a node without the key to be kept out, got %v", c.nodes[0].Members())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package gossip
+
+import (
+	"net"
+	"sync"
+)
+
+// maxPacketSize is the largest UDP payload. A full state exchange must fit
+// in one packet, which leaves room for a few hundred members.
+const maxPacketSize = 65507
+
+// Transport carries gossip packets between nodes.
+type Transport interface {
+	// WriteTo sends a packet to the node at addr.
+	WriteTo(b []byte, addr string) error
+	// Packets returns the packets received by this node. The channel is
+	// closed by Close.
+	Packets() <-chan []byte
+	Close() error
+}
+
+// UDPTransport is a Transport over UDP.
+type UDPTransport struct {
+	conn    net.PacketConn
+	packets chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+// ListenUDP returns a UDPTransport listening on addr.
+func ListenUDP(addr string) (*UDPTransport, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &UDPTransport{conn: conn, packets: make(chan []byte, 64), done: make(chan struct{})}
+	go t.read()
+	return t, nil
+}
+
+func (t *UDPTransport) read() {
+	defer close(t.packets)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		// nobody may be reading once the transport is closed
+		select {
+		case t.packets <- packet:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// WriteTo implements Transport.
+func (t *UDPTransport) WriteTo(b []byte, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteTo(b, udpAddr)
+	return err
+}
+
+// Packets implements Transport.
+func (t *UDPTransport) Packets() <-chan []byte {
+	return t.packets
+}
+
+// Close implements Transport.
+func (t *UDPTransport) Close() error {
+	var err error
+	t.once.Do(func() {
+		close(t.done)
+		err = t.conn.Close()
+	})
+	return err
+}
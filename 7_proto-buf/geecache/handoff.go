@@ -0,0 +1,256 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/consistenthash"
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	handoffBatchEntries = 256
+	handoffBatchBytes   = 1 << 20
+	// how long a node remembers its changes for acceptHandoff; older
+	// batches are refused
+	handoffWindow = time.Minute
+)
+
+// handoff streams the entries this node owned under old but not under
+// ring to their new owners, so that a node joining the ring doesn't start
+// cold. It runs while traffic is already going to the new owners; entries
+// they have loaded in the meantime are not overwritten. It stops once the
+// pool's ring is neither base nor agrees with ring on a key's owner. If
+// limit is positive, only that many of the most recently used entries of
+// each group are sent.
+func (p *HTTPPool) handoff(old, ring, base *consistenthash.Map, limit int) {
+	var moved []consistenthash.Range
+	for _, r := range consistenthash.Diff(old, ring) {
+		if r.From == p.self {
+			moved = append(moved, r)
+		}
+	}
+	if len(moved) == 0 {
+		return
+	}
+
+	for _, group := range p.allGroups() {
+		gen := group.Generation()
+		prefix := group.cacheKey("")
+		entries := group.mainCache.entries(func(cacheKey string) bool {
+			key, ok := strings.CutPrefix(cacheKey, prefix)
+			if !ok {
+				return false
+			}
+			hash := ring.Hash(key)
+			for _, r := range moved {
+				if r.Contains(hash) {
+					return true
+				}
+			}
+			return false
+		})
+		if limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
+		}
+
+		byOwner := make(map[string][]cacheEntry)
+		for _, e := range entries {
+			owner := ring.Get(strings.TrimPrefix(e.key, prefix))
+			byOwner[owner] = append(byOwner[owner], e)
+		}
+		for owner, entries := range byOwner {
+			p.handoffTo(owner, group, gen, prefix, entries, base)
+		}
+	}
+}
+
+// handoffTo sends entries to owner in rate-limited batches and drops them
+// locally once they are delivered. Entries are looked up again just
+// before their batch is sent, so that those removed or replaced since
+// handoff listed them are skipped or sent as they are now. It gives up if
+// the ring moves on before it is done.
+func (p *HTTPPool) handoffTo(owner string, group *Group, gen uint64, prefix string, entries []cacheEntry, base *consistenthash.Map) {
+	sent := 0
+	for len(entries) > 0 {
+		p.mu.Lock()
+		getter, ok := p.httpGetters[owner]
+		stillOwner := ok && (p.peers == base || p.peers.Get(strings.TrimPrefix(entries[0].key, prefix)) == owner)
+		p.mu.Unlock()
+		if !stillOwner || group.Generation() != gen {
+			p.Log("handoff of %s to %s stopped, the ring changed", group.name, owner)
+			return
+		}
+
+		// the owner compares the snapshot with its own changes, so it is
+		// taken on its clock, before the entries are read
+		snapshot, err := getter.handoffClock()
+		if err != nil {
+			p.Log("handoff of %s to %s failed: %v", group.name, owner, err)
+			return
+		}
+		batch := &pb.HandoffBatch{Group: group.name, Generation: gen, Snapshot: snapshot}
+		size := 0
+		n := 0
+		for ; n < len(entries) && n < handoffBatchEntries && size < handoffBatchBytes; n++ {
+			e := entries[n]
+			value, tags, ok := group.mainCache.peek(e.key)
+			if !ok {
+				continue
+			}
+			batch.Entries = append(batch.Entries, &pb.Entry{
+				Key:         strings.TrimPrefix(e.key, prefix),
+				Value:       value.raw(),
+				Tags:        tags,
+				Expire:      unixNano(value.Expire()),
+				Compression: value.codecName(),
+				KeyId:       value.kid,
+			})
+			size += len(e.key) + value.Len()
+		}
+		if err := getter.handoff(batch); err != nil {
+			p.Log("handoff of %s to %s failed: %v", group.name, owner, err)
+			return
+		}
+		for _, e := range entries[:n] {
+			group.mainCache.remove(e.key)
+		}
+		entries = entries[n:]
+		sent += len(batch.Entries)
+
+		time.Sleep(time.Duration(size) * time.Second / time.Duration(p.opts.HandoffRate))
+	}
+	p.Log("handed %d entries of %s off to %s", sent, group.name, owner)
+}
+
+// serveHandoff handles POST /<basepath>/_handoff with a HandoffBatch as
+// the body, and GET /<basepath>/_handoff, which answers this node's clock
+// in Unix nanoseconds for the snapshot of the next batch.
+func (p *HTTPPool) serveHandoff(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		io.WriteString(w, strconv.FormatInt(time.Now().UnixNano(), 10))
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := &pb.HandoffBatch{}
+	if err := proto.Unmarshal(body, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	group := p.getGroup(batch.Group)
+	if group == nil {
+		http.Error(w, "no such group: "+batch.Group, http.StatusNotFound)
+		return
+	}
+	group.acceptHandoff(batch)
+}
+
+// acceptHandoff caches the entries handed off by their previous owner,
+// unless they are from another generation, the key was loaded, written,
+// removed or invalidated here since the batch was taken, or they are
+// compressed or encrypted in a way this node can't undo. Batches taken
+// longer than handoffWindow ago are refused whole. The batch's snapshot
+// is a time this node gave, so that both are on its clock.
+func (g *Group) acceptHandoff(batch *pb.HandoffBatch) {
+	g.setGeneration(batch.Generation)
+	if g.Generation() != batch.Generation {
+		return
+	}
+	snapshot := time.Unix(0, batch.Snapshot)
+	if time.Since(snapshot) > handoffWindow {
+		return
+	}
+	for _, e := range batch.Entries {
+		if _, ok := g.mainCache.get(g.cacheKey(e.Key)); ok {
+			continue
+		}
+		if g.changes.since(e.Key, snapshot) {
+			continue
+		}
+		value, err := g.entryView(e)
+		if err != nil {
+			continue
+		}
+		g.populateCache(e.Key, value, e.Tags...)
+	}
+}
+
+// changeLog remembers when keys were last written or removed, and when
+// entries were last invalidated by tag or prefix, for handoffWindow.
+type changeLog struct {
+	mu          sync.Mutex
+	keys        map[string]time.Time
+	invalidated time.Time
+	lastPrune   time.Time
+}
+
+// key records a write or removal of key.
+func (l *changeLog) key(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.keys == nil {
+		l.keys = make(map[string]time.Time)
+	}
+	l.keys[key] = now
+	if now.Sub(l.lastPrune) > handoffWindow {
+		for k, at := range l.keys {
+			if now.Sub(at) > handoffWindow {
+				delete(l.keys, k)
+			}
+		}
+		l.lastPrune = now
+	}
+}
+
+// all records an invalidation that may have touched any key.
+func (l *changeLog) all() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.invalidated = time.Now()
+}
+
+// since reports whether key may have changed at or after t.
+func (l *changeLog) since(key string, t time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.invalidated.Before(t) {
+		return true
+	}
+	at, ok := l.keys[key]
+	return ok && !at.Before(t)
+}
+
+// handoffClock returns the peer's clock, for the snapshot of a batch
+// handed off to it.
+func (h *httpGetter) handoffClock() (int64, error) {
+	body, err := h.send(http.MethodGet, h.baseURL+"_handoff", nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(body), 10, 64)
+}
+
+func (h *httpGetter) handoff(batch *pb.HandoffBatch) error {
+	body, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	_, err = h.send(http.MethodPost, h.baseURL+"_handoff", bytes.NewReader(body))
+	return err
+}
@@ -0,0 +1,148 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestHandoffOnJoin(t *testing.T) {
+	var loads atomic.Int32
+	c := newTestCluster(t, 2, "handoff", GetterFunc(
+		func(key string) ([]byte, error) {
+			loads.Add(1)
+			return []byte(key), nil
+		}))
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		if _, err := c.nodes[0].group.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := loads.Load()
+
+	joined := c.addNode()
+	c.setPeers()
+
+	var moved []string
+	for _, key := range keys {
+		if c.owner(key) == joined {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) == 0 {
+		t.Fatal("no key moved to the new node")
+	}
+	if !waitFor(2*time.Second, func() bool {
+		for _, key := range moved {
+			if _, ok := joined.group.mainCache.get(joined.group.cacheKey(key)); !ok {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("moved keys were not handed off to the new owner")
+	}
+
+	for _, key := range moved {
+		for _, node := range c.nodes[:2] {
+			if _, ok := node.group.mainCache.get(node.group.cacheKey(key)); ok {
+				t.Fatalf("%s still cached by its previous owner", key)
+			}
+		}
+		if v, err := joined.group.Get(key); err != nil || v.String() != key {
+			t.Fatalf("expected %s from the new owner, got %v, %v", key, v, err)
+		}
+	}
+	if n := loads.Load(); n != before {
+		t.Fatalf("expected no loads after the handoff, got %d", n-before)
+	}
+}
+
+func TestAcceptHandoffSkipsChanges(t *testing.T) {
+	g := newGroup("handoff-changes", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	batch := func(snapshot time.Time) *pb.HandoffBatch {
+		return &pb.HandoffBatch{
+			Group:      g.name,
+			Generation: g.Generation(),
+			Snapshot:   snapshot.UnixNano(),
+			Entries: []*pb.Entry{
+				{Key: "a", Value: []byte("old a")},
+				{Key: "b", Value: []byte("old b")},
+			},
+		}
+	}
+	cached := func(key string) bool {
+		_, ok := g.lookupCache(key)
+		return ok
+	}
+
+	snapshot := time.Now()
+	g.Remove("b")
+	g.acceptHandoff(batch(snapshot))
+	if !cached("a") || cached("b") {
+		t.Fatal("expected a to be handed off and b, removed since, to be skipped")
+	}
+
+	g.Remove("a")
+	g.acceptHandoff(batch(time.Now().Add(-2 * handoffWindow)))
+	if cached("a") {
+		t.Fatal("expected a batch older than the window to be refused")
+	}
+
+	snapshot = time.Now()
+	g.InvalidatePrefix("a")
+	g.acceptHandoff(batch(snapshot))
+	if cached("a") || cached("b") {
+		t.Fatal("expected every entry to be skipped after an invalidation")
+	}
+}
+
+func TestHandoffSnapshotOnReceiversClock(t *testing.T) {
+	// a receiver whose clock is far behind the sender's
+	const clock = int64(42)
+	batches := make(chan *pb.HandoffBatch, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, clock)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		batch := &pb.HandoffBatch{}
+		if err := proto.Unmarshal(body, batch); err != nil {
+			t.Error(err)
+		}
+		batches <- batch
+	}))
+	defer srv.Close()
+
+	g := newGroup("handoff-clock", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	g.Get("a")
+	p := NewHTTPPool("http://self")
+	p.Set(srv.URL)
+	prefix := g.cacheKey("")
+	p.handoffTo(srv.URL, g, g.Generation(), prefix, g.mainCache.entries(func(string) bool { return true }), p.peers)
+
+	select {
+	case batch := <-batches:
+		if batch.Snapshot != clock || len(batch.Entries) != 1 {
+			t.Fatalf("expected a snapshot of %d with one entry, got %d with %d", clock, batch.Snapshot, len(batch.Entries))
+		}
+	default:
+		t.Fatal("no batch was handed off")
+	}
+}
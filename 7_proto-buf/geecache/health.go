@@ -0,0 +1,171 @@
+package geecache
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultEjectionTime     = 30 * time.Second
+	defaultHealthInterval   = 5 * time.Second
+	defaultRecoveryPeriod   = 30 * time.Second
+	// the ejection time doubles at most this many times for a peer that
+	// keeps failing
+	maxEjectionDoublings = 4
+)
+
+type healthState int
+
+const (
+	healthy healthState = iota
+	ejected
+	recovering
+)
+
+// peerHealth tracks whether requests to a peer are succeeding. A peer that
+// fails FailureThreshold times in a row is ejected: PickPeer skips it
+// until its ejection time is up and a health check has passed. It then
+// gets a share of its traffic back that grows over RecoveryPeriod.
+type peerHealth struct {
+	opts      *HTTPPoolOptions
+	mu        sync.Mutex
+	state     healthState
+	failures  int       // in a row
+	ejections int       // in a row, without a full recovery in between
+	since     time.Time // when state last changed
+}
+
+func newPeerHealth(opts *HTTPPoolOptions) *peerHealth {
+	return &peerHealth{opts: opts}
+}
+
+// observe records the outcome of a request to the peer.
+func (h *peerHealth) observe(err error) {
+	if h == nil {
+		return
+	}
+	if failed(err) {
+		h.failure()
+	} else {
+		h.success()
+	}
+}
+
+// failed reports whether err means the peer itself is unwell, as opposed
+// to the request failing, e.g. because the key doesn't exist.
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusBadGateway ||
+			se.code == http.StatusServiceUnavailable ||
+			se.code == http.StatusGatewayTimeout
+	}
+	return true
+}
+
+func (h *peerHealth) failure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	switch {
+	case h.state == recovering:
+		// a peer on probation goes straight back out
+		h.eject()
+	case h.state == healthy && h.failures >= h.opts.FailureThreshold:
+		h.eject()
+	}
+}
+
+func (h *peerHealth) eject() {
+	h.state = ejected
+	h.since = time.Now()
+	h.failures = 0
+	h.ejections++
+}
+
+func (h *peerHealth) success() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+	if h.state == ejected && !time.Now().Before(h.ejectedUntil()) {
+		h.state = recovering
+		h.since = time.Now()
+	}
+}
+
+func (h *peerHealth) ejectedUntil() time.Time {
+	return h.since.Add(h.opts.EjectionTime << min(h.ejections-1, maxEjectionDoublings))
+}
+
+// available reports whether a request may go to the peer.
+func (h *peerHealth) available() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch h.state {
+	case ejected:
+		return false
+	case recovering:
+		elapsed := time.Since(h.since)
+		if elapsed >= h.opts.RecoveryPeriod {
+			h.state = healthy
+			h.ejections = 0
+			return true
+		}
+		return rand.Float64() < float64(elapsed)/float64(h.opts.RecoveryPeriod)
+	}
+	return true
+}
+
+// probeHealth checks every peer's health endpoint every HealthInterval,
+// until the pool is closed.
+func (p *HTTPPool) probeHealth() {
+	client := &http.Client{Timeout: p.opts.HealthInterval, Transport: p.transport()}
+	ticker := time.NewTicker(p.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+		p.mu.Lock()
+		getters := make([]*httpGetter, 0, len(p.httpGetters))
+		for peer, getter := range p.httpGetters {
+			if peer != p.self {
+				getters = append(getters, getter)
+			}
+		}
+		p.mu.Unlock()
+		for _, getter := range getters {
+			go getter.probe(client)
+		}
+	}
+}
+
+// serveHealth handles GET /<basepath>/_health. A draining node reports
+// itself unavailable so that peers stop sending it traffic.
+func (p *HTTPPool) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if p.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (h *httpGetter) probe(client *http.Client) {
+	res, err := client.Get(h.baseURL + "_health")
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			err = &statusError{code: res.StatusCode, status: res.Status}
+		}
+	}
+	h.health.observe(err)
+}
@@ -0,0 +1,136 @@
+package geecache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPeerHealth(t *testing.T) {
+	opts := &HTTPPoolOptions{
+		FailureThreshold: 2,
+		EjectionTime:     50 * time.Millisecond,
+		RecoveryPeriod:   100 * time.Millisecond,
+	}
+	h := newPeerHealth(opts)
+	down := errors.New("connection refused")
+
+	h.observe(&statusError{code: http.StatusInternalServerError})
+	h.observe(down)
+	if !h.available() {
+		t.Fatal("a 500 answer shouldn't count as a failure")
+	}
+	h.observe(down)
+	if h.available() {
+		t.Fatal("expected the peer to be ejected")
+	}
+	h.observe(nil)
+	if h.available() {
+		t.Fatal("expected the peer to stay ejected for the ejection time")
+	}
+
+	time.Sleep(opts.EjectionTime)
+	h.observe(nil)
+	if h.state != recovering {
+		t.Fatalf("expected the peer to be recovering, got %v", h.state)
+	}
+	time.Sleep(opts.RecoveryPeriod / 5)
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if h.available() {
+			n++
+		}
+	}
+	if n < 50 || n > 600 {
+		t.Fatalf("expected a growing share of traffic during the recovery, got %d/1000", n)
+	}
+
+	// A failure while recovering ejects it again, for twice as long.
+	h.observe(down)
+	time.Sleep(opts.EjectionTime)
+	h.observe(nil)
+	if h.state != ejected {
+		t.Fatal("expected the second ejection to last longer")
+	}
+	time.Sleep(opts.EjectionTime)
+	h.observe(nil)
+	time.Sleep(opts.RecoveryPeriod)
+	if !h.available() || h.state != healthy || h.ejections != 0 {
+		t.Fatal("expected the peer to have recovered")
+	}
+}
+
+func TestPickPeerSkipsEjected(t *testing.T) {
+	c := newTestCluster(t, 0, "health", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}))
+	for i := 0; i < 3; i++ {
+		node := c.addNode()
+		node.pool.opts.FailureThreshold = 2
+		node.pool.opts.EjectionTime = 100 * time.Millisecond
+		node.pool.opts.HealthInterval = 20 * time.Millisecond
+		node.pool.opts.RecoveryPeriod = 100 * time.Millisecond
+	}
+	c.setPeers()
+	sick := c.nodes[2]
+
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if c.owner(key) == sick {
+			keys = append(keys, key)
+		}
+	}
+
+	picks := func(key string) bool {
+		peer, ok := c.nodes[0].pool.PickPeer(key)
+		return ok && peer.(*httpGetter).baseURL == sick.addr+defaultBasePath
+	}
+
+	sick.down.Store(true)
+	for _, key := range keys {
+		if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != key {
+			t.Fatalf("expected %s despite the sick owner, got %v, %v", key, v, err)
+		}
+	}
+	if !waitFor(time.Second, func() bool { return !picks(keys[0]) }) {
+		t.Fatal("expected the sick peer to be ejected")
+	}
+	for _, key := range keys {
+		if picks(key) {
+			t.Fatalf("%s still goes to the ejected peer", key)
+		}
+	}
+
+	sick.down.Store(false)
+	if !waitFor(2*time.Second, func() bool {
+		for i := 0; i < 10; i++ {
+			if !picks(keys[0]) {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("expected the peer to get its traffic back")
+	}
+}
+
+func TestHealthProbesStopOnClose(t *testing.T) {
+	p := NewHTTPPoolOpts("http://self", &HTTPPoolOptions{HealthInterval: 10 * time.Millisecond})
+	done := make(chan struct{})
+	go func() {
+		p.probeHealth()
+		close(done)
+	}()
+	p.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the probes to stop once the pool was closed")
+	}
+	// closing twice is harmless
+	p.Close()
+}
@@ -3,38 +3,224 @@ package geecache
 import (
 	"Dcache/7_proto-buf/geecache/consistenthash"
 	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 )
 
 const (
-	defaultBasePath = "/_geecache/"
-	defaultReplicas = 50
+	defaultBasePath    = "/_geecache/"
+	defaultReplicas    = 50
+	defaultHandoffRate = 4 << 20
+	defaultMaxBody     = 64 << 20
 )
 
+// HTTPPoolOptions are the configurations of a HTTPPool.
+type HTTPPoolOptions struct {
+	// BasePath specifies the HTTP path that will serve geecache requests.
+	// If blank, it defaults to "/_geecache/".
+	BasePath string
+
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If blank, it defaults to 50.
+	Replicas int
+
+	// HashFn specifies the hash function of the consistent hash.
+	// If blank, it defaults to crc32.ChecksumIEEE.
+	HashFn consistenthash.Hash
+
+	// HandoffRate caps the bytes per second streamed to new owners after
+	// the ring changes. If blank, it defaults to 4MB/s.
+	HandoffRate int64
+
+	// FailureThreshold is the number of failures in a row after which a
+	// peer is ejected. If blank, it defaults to 5.
+	FailureThreshold int
+
+	// EjectionTime is how long a peer stays ejected the first time; it
+	// doubles every time the peer is ejected again before it has fully
+	// recovered. If blank, it defaults to 30s.
+	EjectionTime time.Duration
+
+	// HealthInterval specifies how often peers' health is checked. If
+	// blank, it defaults to 5s; if negative, there are no health checks.
+	HealthInterval time.Duration
+
+	// RecoveryPeriod is how long a peer that has recovered takes to get
+	// all its traffic back. If blank, it defaults to 30s.
+	RecoveryPeriod time.Duration
+
+	// Timeout limits each attempt to fetch a value from a peer, and each
+	// request to set, remove or invalidate values or to hand them off. If
+	// blank, it defaults to 10s.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed fetch is retried. If blank,
+	// failed fetches are not retried.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry; it doubles for
+	// each retry after that. If blank, it defaults to 20ms.
+	RetryBackoff time.Duration
+
+	// Hedge sends a second request for a slow fetch to the next peer on
+	// the ring, and takes whichever answer comes first.
+	Hedge bool
+
+	// HedgeDelay is how long a fetch may take before it is hedged. If
+	// blank, it is the 95th percentile of recent fetches.
+	HedgeDelay time.Duration
+
+	// Transport is used for requests to peers. If nil,
+	// http.DefaultTransport is used, configured with TLS if set.
+	Transport http.RoundTripper
+
+	// StreamBytes is the size from which values are streamed to the
+	// peers that fetch them rather than sent in a protobuf message, so
+	// that neither side copies them whole. If blank, it defaults to 1MB;
+	// if negative, values are never streamed.
+	StreamBytes int
+
+	// TLS secures peer traffic. The pool must then be served with
+	// TLSConfig, and the peers' URLs be https:// ones.
+	TLS *PeerTLS
+
+	// Keys, if set, sign the requests to peers and check the signatures
+	// of the requests served.
+	Keys *PeerKeys
+
+	// MaxBodyBytes caps the body of the requests served, which is read
+	// whole to check its signature or decode it. If blank, it defaults
+	// to 64MB.
+	MaxBodyBytes int64
+}
+
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
 type HTTPPool struct {
 	// this peer's base URL, e.g. "https://example.net:8000"
 	self        string
+	opts        HTTPPoolOptions
 	basePath    string
-	mu          sync.Mutex // guards peers and httpGetters
+	mu          sync.Mutex           // guards members, departed, peers and httpGetters
+	members     []string             // as passed to Set
+	departed    map[string]time.Time // members left out of the ring until then
 	peers       *consistenthash.Map
 	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	health      map[string]*peerHealth // kept across Set
+	probing     sync.Once
+	stop        chan struct{} // closed by Close
+	draining    atomic.Bool
+	latencies   latencies // of recent fetches, for hedging
+	rt          http.RoundTripper
+	rtOnce      sync.Once
+	watchers    []func() // called after every Set
+	bus         *bus     // invalidations for every peer
+	// groups served by this pool; nil means those created with
+	// NewGroup. Tests set it to run several nodes in one process.
+	groups map[string]*Group
 }
 
 // NewHTTPPool initializes an HTTP pool of peers.
 func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
-		self:     self,
-		basePath: defaultBasePath,
+	return NewHTTPPoolOpts(self, nil)
+}
+
+// NewHTTPPoolOpts initializes an HTTP pool of peers with the given options.
+func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) *HTTPPool {
+	p := &HTTPPool{self: normalizePeer(self)}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.BasePath == "" {
+		p.opts.BasePath = defaultBasePath
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.HandoffRate == 0 {
+		p.opts.HandoffRate = defaultHandoffRate
+	}
+	if p.opts.FailureThreshold == 0 {
+		p.opts.FailureThreshold = defaultFailureThreshold
+	}
+	if p.opts.EjectionTime == 0 {
+		p.opts.EjectionTime = defaultEjectionTime
+	}
+	if p.opts.HealthInterval == 0 {
+		p.opts.HealthInterval = defaultHealthInterval
 	}
+	if p.opts.RecoveryPeriod == 0 {
+		p.opts.RecoveryPeriod = defaultRecoveryPeriod
+	}
+	if p.opts.Timeout == 0 {
+		p.opts.Timeout = defaultTimeout
+	}
+	if p.opts.RetryBackoff == 0 {
+		p.opts.RetryBackoff = defaultRetryBackoff
+	}
+	if p.opts.StreamBytes == 0 {
+		p.opts.StreamBytes = defaultStreamBytes
+	}
+	if p.opts.MaxBodyBytes == 0 {
+		p.opts.MaxBodyBytes = defaultMaxBody
+	}
+	p.basePath = p.opts.BasePath
+	p.bus = newBus(self, p.applyInvalidation, p.purgeHotCaches)
+	p.stop = make(chan struct{})
+	return p
+}
+
+// Close stops the pool's health probes and invalidation senders. It
+// doesn't stop serving; the pool mustn't be Set once closed.
+func (p *HTTPPool) Close() {
+	p.mu.Lock()
+	select {
+	case <-p.stop:
+		p.mu.Unlock()
+		return
+	default:
+	}
+	close(p.stop)
+	p.mu.Unlock()
+	p.bus.setPeers(nil)
+}
+
+func (p *HTTPPool) getGroup(name string) *Group {
+	if p.groups != nil {
+		return p.groups[name]
+	}
+	return GetGroup(name)
+}
+
+func (p *HTTPPool) allGroups() []*Group {
+	return poolGroups(p.groups)
+}
+
+// poolGroups returns the groups of a pool whose groups are groups, or
+// every group created with NewGroup if groups is nil.
+func poolGroups(groups map[string]*Group) []*Group {
+	if groups != nil {
+		all := make([]*Group, 0, len(groups))
+		for _, g := range groups {
+			all = append(all, g)
+		}
+		return all
+	}
+	return allGroups()
 }
 
 // Log info with server name
@@ -42,14 +228,44 @@ func (p *HTTPPool) Log(format string, v ...interface{}) {
 	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
 }
 
+// selfAddr returns this peer's address, which tells its generations
+// apart from the other peers'.
+func (p *HTTPPool) selfAddr() string {
+	return p.self
+}
+
 // ServeHTTP handle all http requests
 func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !strings.HasPrefix(r.URL.Path, p.basePath) {
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
 	p.Log("%s %s", r.Method, r.URL.Path)
+	if !p.authorized(r) {
+		p.Log("refused a client certificate that names no member")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, p.opts.MaxBodyBytes)
+	if err := p.verifySignature(r); err != nil {
+		p.Log("refused %s %s: %v", r.Method, r.URL.Path, err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := r.URL.Path[len(p.basePath):]
+	// /<basepath>/_<op>[/...] are control requests between peers
+	if strings.HasPrefix(path, "_") {
+		op, rest, _ := strings.Cut(path[1:], "/")
+		p.serveControl(w, r, op, rest)
+		return
+	}
+
 	// /<basepath>/<groupname>/<key> required
-	parts := strings.SplitN(r.URL.Path[len(p.basePath):], "/", 2)
+	parts := strings.SplitN(path, "/", 2)
 	if len(parts) != 2 {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
@@ -58,20 +274,51 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	groupName := parts[0]
 	key := parts[1]
 
-	group := GetGroup(groupName)
+	group := p.getGroup(groupName)
 	if group == nil {
 		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
 		return
 	}
 
-	view, err := group.Get(key)
+	switch r.Method {
+	case http.MethodGet:
+		p.serveGet(w, r, group, key)
+	case http.MethodPut:
+		p.serveSet(w, r, group, key)
+	case http.MethodDelete:
+		if !group.removeLocally(key) {
+			http.Error(w, "not cached: "+key, http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveGet handles GET /<basepath>/<groupname>/<key>[?lease=1|?local=1][&generation=]
+func (p *HTTPPool) serveGet(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	q := r.URL.Query()
+	in := &pb.Request{Group: group.name, Key: key, Lease: q.Get("lease") != ""}
+	in.Generation, _ = strconv.ParseUint(q.Get("generation"), 10, 64)
+	res, err := group.answer(r.Context(), in, q.Get("local") != "")
+	if errors.Is(err, ErrOverloaded) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if p.streams(r, res) {
+		w.Header().Set("Content-Type", streamContentType)
+		if err := writeStream(w, res); err != nil {
+			p.Log("streaming %s/%s: %v", group.name, key, err)
+		}
+		return
+	}
+
 	// Write the value to the response body as a proto message.
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()})
+	body, err := proto.Marshal(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -81,50 +328,429 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
-// Set updates the pool's list of peers.
+// serveSet handles PUT /<basepath>/<groupname>/<key>[?lease=<token>|?tag=...&expire=]
+// [&compression=][&key_id=] with the value as the body, compressed and
+// encrypted as those say.
+func (p *HTTPPool) serveSet(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	value, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	expire, _ := strconv.ParseInt(q.Get("expire"), 10, 64)
+	v, err := group.entryView(&pb.Entry{
+		Key:         key,
+		Value:       value,
+		Expire:      expire,
+		Compression: q.Get("compression"),
+		KeyId:       q.Get("key_id"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !q.Has("lease") {
+		group.setLocally(key, v, q["tag"])
+		return
+	}
+
+	token, err := strconv.ParseUint(q.Get("lease"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad lease", http.StatusBadRequest)
+		return
+	}
+	if err := group.leaseSetLocally(key, token, v); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// serveControl handles /<basepath>/_<op>/<rest>.
+func (p *HTTPPool) serveControl(w http.ResponseWriter, r *http.Request, op, rest string) {
+	switch op {
+	case "keepwarm":
+		p.serveKeepWarm(w, r, rest)
+	case "touch":
+		p.serveTouch(w, r, rest)
+	case "generation":
+		p.serveGeneration(w, r, rest)
+	case "invalidate":
+		p.serveInvalidate(w, r, rest)
+	case "bus":
+		p.serveBus(w, r)
+	case "handoff":
+		p.serveHandoff(w, r)
+	case "leave", "join":
+		p.serveMembership(w, r, op)
+	case "peers":
+		p.servePeers(w, r)
+	case "health":
+		p.serveHealth(w, r)
+	default:
+		http.Error(w, "unknown operation: "+op, http.StatusNotFound)
+	}
+}
+
+// serveKeepWarm handles POST /<basepath>/_keepwarm/<groupname>/<key>?interval=
+func (p *HTTPPool) serveKeepWarm(w http.ResponseWriter, r *http.Request, rest string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group, key, ok := p.groupKey(w, rest)
+	if !ok {
+		return
+	}
+	interval, err := time.ParseDuration(r.URL.Query().Get("interval"))
+	if err != nil || interval < 0 {
+		http.Error(w, "bad interval", http.StatusBadRequest)
+		return
+	}
+	// The sender picked us as the owner. Register the key even if our
+	// view of the ring disagrees; the warmer hands it on if need be.
+	group.keepWarmLocally(key, interval)
+}
+
+// serveTouch handles POST /<basepath>/_touch/<groupname>/<key>?expire=
+// and answers 404 if the key isn't cached.
+func (p *HTTPPool) serveTouch(w http.ResponseWriter, r *http.Request, rest string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group, key, ok := p.groupKey(w, rest)
+	if !ok {
+		return
+	}
+	expire, err := strconv.ParseInt(r.URL.Query().Get("expire"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad expire", http.StatusBadRequest)
+		return
+	}
+	if !group.touchLocally(key, fromUnixNano(expire)) {
+		http.Error(w, "not cached: "+key, http.StatusNotFound)
+	}
+}
+
+// serveGeneration handles POST /<basepath>/_generation/<groupname>?generation=
+// sent by InvalidateAll.
+func (p *HTTPPool) serveGeneration(w http.ResponseWriter, r *http.Request, groupName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group := p.getGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	gen, err := strconv.ParseUint(r.URL.Query().Get("generation"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad generation", http.StatusBadRequest)
+		return
+	}
+	group.setGeneration(gen)
+}
+
+// serveInvalidate handles POST /<basepath>/_invalidate/<groupname>?tag=
+// and ?prefix= sent by InvalidateTag and InvalidatePrefix.
+func (p *HTTPPool) serveInvalidate(w http.ResponseWriter, r *http.Request, groupName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	group := p.getGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case q.Get("tag") != "":
+		group.invalidateTagLocally(q.Get("tag"))
+	case q.Get("prefix") != "":
+		group.invalidatePrefixLocally(q.Get("prefix"))
+	default:
+		http.Error(w, "tag or prefix required", http.StatusBadRequest)
+	}
+}
+
+// serveBus handles POST /<basepath>/_bus with an InvalidationBatch as the
+// body, and answers with an InvalidationAck.
+func (p *HTTPPool) serveBus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := &pb.InvalidationBatch{}
+	if err := proto.Unmarshal(body, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err = proto.Marshal(&pb.InvalidationAck{Seq: p.bus.receive(batch)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+func (p *HTTPPool) applyInvalidation(groupName, key string) {
+	if group := p.getGroup(groupName); group != nil {
+		group.dropCopy(key)
+	}
+}
+
+func (p *HTTPPool) purgeHotCaches() {
+	for _, group := range p.allGroups() {
+		group.hotCache.removePrefix("")
+	}
+}
+
+// groupKey splits <groupname>/<key> and looks the group up, writing an
+// error response if either is missing.
+func (p *HTTPPool) groupKey(w http.ResponseWriter, rest string) (*Group, string, bool) {
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return nil, "", false
+	}
+	group := p.getGroup(parts[0])
+	if group == nil {
+		http.Error(w, "no such group: "+parts[0], http.StatusNotFound)
+		return nil, "", false
+	}
+	return group, parts[1], true
+}
+
+// Set updates the pool's list of peers. Peers that are draining stay out
+// of the ring until they join again. Peers are matched against the pool's
+// own URL after normalizing both, so this node must be listed under the
+// URL it was created with, e.g. its advertised address rather than
+// localhost; otherwise it would forward its own keys to itself.
 func (p *HTTPPool) Set(peers ...string) {
+	peers = slices.Clone(peers)
+	found := false
+	for i, peer := range peers {
+		peers[i] = normalizePeer(peer)
+		found = found || peers[i] == p.self
+	}
+	if len(peers) > 0 && !found {
+		p.Log("this node isn't among its %d peers; is %s the URL they know it by?", len(peers), p.self)
+	}
 	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.peers = consistenthash.New(defaultReplicas, nil)
+	p.members = peers
+	p.mu.Unlock()
+	p.rebuild()
+}
+
+// normalizePeer returns a peer's base URL with a lower-case scheme and
+// host and without a trailing slash.
+func normalizePeer(peer string) string {
+	u, err := url.Parse(strings.TrimSuffix(peer, "/"))
+	if err != nil || u.Host == "" {
+		return peer
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// rebuild makes a new ring of the members that haven't departed.
+func (p *HTTPPool) rebuild() {
+	p.mu.Lock()
+	var peers []string
+	now := time.Now()
+	for _, peer := range p.members {
+		if until, ok := p.departed[peer]; !ok || now.After(until) {
+			peers = append(peers, peer)
+		}
+	}
+	old := p.peers
+	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
 	p.peers.Add(peers...)
+	ring := p.peers
 	p.httpGetters = make(map[string]*httpGetter, len(peers))
+	health := make(map[string]*peerHealth, len(peers))
+	senders := make(map[string]func(*pb.InvalidationBatch) (uint64, error))
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.basePath}
+		health[peer] = p.health[peer]
+		if health[peer] == nil {
+			health[peer] = newPeerHealth(&p.opts)
+		}
+		getter := &httpGetter{
+			baseURL:   peer + p.basePath,
+			health:    health[peer],
+			pool:      p,
+			transport: p.transport(),
+			timeout:   p.opts.Timeout,
+		}
+		p.httpGetters[peer] = getter
+		if peer != p.self {
+			senders[peer] = getter.sendInvalidations
+		}
+	}
+	p.health = health
+	p.bus.setPeers(senders)
+	watchers := p.watchers
+	p.mu.Unlock()
+
+	if p.opts.HealthInterval > 0 && len(peers) > 1 {
+		p.probing.Do(func() { go p.probeHealth() })
+	}
+	if old != nil {
+		go p.handoff(old, ring, ring, 0)
 	}
+	for _, fn := range watchers {
+		go fn()
+	}
+}
+
+// AllPeers returns a getter for every peer other than this one.
+func (p *HTTPPool) AllPeers() []PeerGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	all := make([]PeerGetter, 0, len(p.httpGetters))
+	for peer, getter := range p.httpGetters {
+		if peer != p.self {
+			all = append(all, getter)
+		}
+	}
+	return all
+}
+
+// Broadcast tells every peer to drop its copy of key. It returns at once;
+// delivery is retried in the background until each peer acknowledges it.
+func (p *HTTPPool) Broadcast(group, key string) {
+	p.bus.publish(group, key)
+}
+
+// Watch registers fn to be called whenever the list of peers changes.
+func (p *HTTPPool) Watch(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watchers = append(p.watchers, fn)
 }
 
-// PickPeer picks a peer according to key
+// PickPeer picks a peer according to key. If the owner is ejected, it
+// picks the next peer on the ring instead, or none if that is this one.
 func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if peer := p.peers.Get(key); peer != "" && peer != p.self {
-		p.Log("Pick peer %s", peer)
-		return p.httpGetters[peer], true
+	if p.peers == nil {
+		// no peers discovered yet
+		return nil, false
 	}
-	return nil, false
+	peer := p.peers.Get(key)
+	if peer == "" || peer == p.self {
+		return nil, false
+	}
+	if !p.health[peer].available() {
+		peer = ""
+		for _, next := range p.peers.GetN(key, len(p.httpGetters))[1:] {
+			if next == p.self {
+				return nil, false
+			}
+			if p.health[next].available() {
+				peer = next
+				break
+			}
+		}
+		if peer == "" {
+			return nil, false
+		}
+	}
+	p.Log("Pick peer %s", peer)
+	return p.httpGetters[peer], true
 }
 
 var _ PeerPicker = (*HTTPPool)(nil)
+var _ PeerWatcher = (*HTTPPool)(nil)
+var _ PeerLister = (*HTTPPool)(nil)
+var _ PeerBroadcaster = (*HTTPPool)(nil)
 
 type httpGetter struct {
-	baseURL string
+	baseURL   string
+	health    *peerHealth // nil for one-off control requests
+	pool      *HTTPPool   // nil for one-off control requests
+	transport http.RoundTripper
+	// limits each control request; if blank, it defaults to 10s
+	timeout time.Duration
+}
+
+func (h *httpGetter) client() *http.Client {
+	return &http.Client{Transport: h.transport}
 }
 
 func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
+	return h.GetContext(context.Background(), in, out)
+}
+
+// GetContext fetches in from the peer under the pool's timeout, retry and
+// hedging policy.
+func (h *httpGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	if h.pool == nil {
+		return h.get(ctx, in, out, false)
+	}
+	return h.pool.fetch(ctx, h, in, out)
+}
+
+// get makes a single request for in. If local is set, the peer answers
+// from its own cache or Getter rather than asking the key's owner.
+func (h *httpGetter) get(ctx context.Context, in *pb.Request, out *pb.Response, local bool) error {
 	u := fmt.Sprintf(
 		"%v%v/%v",
 		h.baseURL,
-		url.QueryEscape(in.GetGroup()),
-		url.QueryEscape(in.GetKey()),
+		url.PathEscape(in.GetGroup()),
+		url.PathEscape(in.GetKey()),
 	)
-	res, err := http.Get(u)
+	q := url.Values{}
+	if in.GetLease() {
+		q.Set("lease", "1")
+	}
+	if gen := in.GetGeneration(); gen != 0 {
+		q.Set("generation", strconv.FormatUint(gen, 10))
+	}
+	if local {
+		q.Set("local", "1")
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Accept", streamContentType)
+	res, err := h.client().Do(req)
+	if err != nil {
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			// the caller giving up says nothing about the peer
+			h.health.observe(err)
+		}
+		return err
+	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned: %v", res.Status)
+		err := &statusError{code: res.StatusCode, status: res.Status}
+		h.health.observe(err)
+		return err
+	}
+	h.health.observe(nil)
+
+	if res.Header.Get("Content-Type") == streamContentType {
+		if err := readStream(res.Body, out, h.maxValue(in.GetGroup())); err != nil {
+			return fmt.Errorf("reading streamed response: %v", err)
+		}
+		return nil
 	}
 
 	bytes, err := ioutil.ReadAll(res.Body)
@@ -139,4 +765,210 @@ func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
 	return nil
 }
 
+// maxValue is the largest value streamed for group that get accepts:
+// the size of the group's cache, which couldn't hold a larger one, or the
+// pool's MaxBodyBytes if the group isn't known here or its cache has no
+// bound.
+func (h *httpGetter) maxValue(group string) int64 {
+	if h.pool == nil {
+		return defaultMaxBody
+	}
+	if g := h.pool.getGroup(group); g != nil && g.mainCache.cacheBytes > 0 {
+		return g.mainCache.cacheBytes
+	}
+	return h.pool.opts.MaxBodyBytes
+}
+
+func (h *httpGetter) KeepWarm(group, key string, interval time.Duration) error {
+	u := fmt.Sprintf(
+		"%v_keepwarm/%v/%v?interval=%v",
+		h.baseURL,
+		url.PathEscape(group),
+		url.PathEscape(key),
+		url.QueryEscape(interval.String()),
+	)
+	_, err := h.send(http.MethodPost, u, nil)
+	return err
+}
+
+func (h *httpGetter) Set(group string, e *pb.Entry) error {
+	u := fmt.Sprintf(
+		"%v%v/%v",
+		h.baseURL,
+		url.PathEscape(group),
+		url.PathEscape(e.GetKey()),
+	)
+	if q := entryQuery(e); len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	_, err := h.send(http.MethodPut, u, bytes.NewReader(e.GetValue()))
+	return err
+}
+
+// entryQuery is the query of a PUT of e, whose value is the body.
+func entryQuery(e *pb.Entry) url.Values {
+	q := url.Values{}
+	if len(e.GetTags()) > 0 {
+		q["tag"] = e.GetTags()
+	}
+	if e.GetExpire() != 0 {
+		q.Set("expire", strconv.FormatInt(e.GetExpire(), 10))
+	}
+	if e.GetCompression() != "" {
+		q.Set("compression", e.GetCompression())
+	}
+	if e.GetKeyId() != "" {
+		q.Set("key_id", e.GetKeyId())
+	}
+	return q
+}
+
+func (h *httpGetter) Touch(group, key string, expire time.Time) (bool, error) {
+	u := fmt.Sprintf(
+		"%v_touch/%v/%v?expire=%d",
+		h.baseURL,
+		url.PathEscape(group),
+		url.PathEscape(key),
+		unixNano(expire),
+	)
+	_, err := h.send(http.MethodPost, u, nil)
+	if se, ok := err.(*statusError); ok && se.code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *httpGetter) Remove(group, key string) (bool, error) {
+	u := fmt.Sprintf(
+		"%v%v/%v",
+		h.baseURL,
+		url.PathEscape(group),
+		url.PathEscape(key),
+	)
+	_, err := h.send(http.MethodDelete, u, nil)
+	if se, ok := err.(*statusError); ok && se.code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *httpGetter) LeaseSet(group string, token uint64, e *pb.Entry) error {
+	u := fmt.Sprintf(
+		"%v%v/%v",
+		h.baseURL,
+		url.PathEscape(group),
+		url.PathEscape(e.GetKey()),
+	)
+	q := entryQuery(e)
+	q.Set("lease", strconv.FormatUint(token, 10))
+	_, err := h.send(http.MethodPut, u+"?"+q.Encode(), bytes.NewReader(e.GetValue()))
+	if se, ok := err.(*statusError); ok && se.code == http.StatusConflict {
+		return ErrLeaseInvalid
+	}
+	return err
+}
+
+func (h *httpGetter) InvalidateAll(group string, generation uint64) error {
+	u := fmt.Sprintf(
+		"%v_generation/%v?generation=%d",
+		h.baseURL,
+		url.PathEscape(group),
+		generation,
+	)
+	_, err := h.send(http.MethodPost, u, nil)
+	return err
+}
+
+func (h *httpGetter) InvalidateTag(group, tag string) error {
+	u := fmt.Sprintf(
+		"%v_invalidate/%v?tag=%v",
+		h.baseURL,
+		url.PathEscape(group),
+		url.QueryEscape(tag),
+	)
+	_, err := h.send(http.MethodPost, u, nil)
+	return err
+}
+
+func (h *httpGetter) InvalidatePrefix(group, prefix string) error {
+	u := fmt.Sprintf(
+		"%v_invalidate/%v?prefix=%v",
+		h.baseURL,
+		url.PathEscape(group),
+		url.QueryEscape(prefix),
+	)
+	_, err := h.send(http.MethodPost, u, nil)
+	return err
+}
+
+func (h *httpGetter) sendInvalidations(batch *pb.InvalidationBatch) (uint64, error) {
+	body, err := proto.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	res, err := h.send(http.MethodPost, h.baseURL+"_bus", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ack := &pb.InvalidationAck{}
+	if err = proto.Unmarshal(res, ack); err != nil {
+		return 0, fmt.Errorf("decoding response body: %v", err)
+	}
+	return ack.Seq, nil
+}
+
+// send issues a control request to the peer and returns the response
+// body, or a *statusError if the peer didn't answer 200 OK.
+func (h *httpGetter) send(method, u string, body io.Reader) ([]byte, error) {
+	timeout := h.timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.client().Do(req)
+	if err != nil {
+		h.health.observe(err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := &statusError{code: res.StatusCode, status: res.Status}
+		h.health.observe(err)
+		return nil, err
+	}
+	h.health.observe(nil)
+	return ioutil.ReadAll(res.Body)
+}
+
+// statusError reports a non-200 answer from a peer.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned: %v", e.status)
+}
+
+// Unwrap lets a peer's 429 be recognized as ErrOverloaded.
+func (e *statusError) Unwrap() error {
+	if e.code == http.StatusTooManyRequests {
+		return ErrOverloaded
+	}
+	return nil
+}
+
 var _ PeerGetter = (*httpGetter)(nil)
+var _ PeerContextGetter = (*httpGetter)(nil)
+var _ PeerWarmer = (*httpGetter)(nil)
+var _ PeerSetter = (*httpGetter)(nil)
+var _ PeerRemover = (*httpGetter)(nil)
+var _ PeerToucher = (*httpGetter)(nil)
+var _ PeerLeaser = (*httpGetter)(nil)
+var _ PeerInvalidator = (*httpGetter)(nil)
@@ -0,0 +1,59 @@
+// Package server holds what the servers for other protocols, resp and
+// memcache, share: accepting connections and mapping keys to groups.
+package server
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"log"
+	"net"
+	"strings"
+)
+
+// ListenAndServe listens on the TCP address addr and passes the listener
+// to serve.
+func ListenAndServe(addr string, serve func(l net.Listener) error) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serve(l)
+}
+
+// Serve accepts connections from l and serves each on its own goroutine
+// with serveConn, which closes it. A connection whose handler panics is
+// closed and logged rather than taking down the process. Serve returns
+// when l fails, e.g. because it was closed.
+func Serve(l net.Listener, serveConn func(nc net.Conn)) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					nc.Close()
+					log.Printf("[GeeCache] connection from %s panicked: %v", nc.RemoteAddr(), err)
+				}
+			}()
+			serveConn(nc)
+		}()
+	}
+}
+
+// Group returns the group key belongs to and the key within it. With a
+// separator such as ":", the key "scores:Tom" is Tom in the group scores;
+// a key whose prefix isn't a group belongs to the group named fallback.
+func Group(key, separator, fallback string) (*geecache.Group, string, bool) {
+	if separator != "" {
+		if name, rest, ok := strings.Cut(key, separator); ok {
+			if g := geecache.GetGroup(name); g != nil {
+				return g, rest, true
+			}
+		}
+	}
+	if g := geecache.GetGroup(fallback); g != nil {
+		return g, key, true
+	}
+	return nil, "", false
+}
@@ -0,0 +1,133 @@
+package geecache
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// warmer reloads a set of registered keys on a timer so that they never
+// go cold. Only the owner of a key reloads it; any other node that finds
+// a key registered with it hands the key off to the owner.
+type warmer struct {
+	g    *Group
+	mu   sync.Mutex // guards keys
+	keys map[string]*warmKey
+}
+
+type warmKey struct {
+	interval time.Duration
+	timer    *time.Timer
+}
+
+// add registers key to be reloaded every interval, replacing any previous
+// registration. The first reload happens right away.
+func (w *warmer) add(key string, interval time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys == nil {
+		w.keys = make(map[string]*warmKey)
+	}
+	if k, ok := w.keys[key]; ok {
+		k.timer.Stop()
+	}
+	k := &warmKey{interval: interval}
+	k.timer = time.AfterFunc(0, func() { w.fire(key, k) })
+	w.keys[key] = k
+}
+
+// remove stops keeping key warm.
+func (w *warmer) remove(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if k, ok := w.keys[key]; ok {
+		k.timer.Stop()
+		delete(w.keys, key)
+	}
+}
+
+// registered reports whether key is kept warm by this node.
+func (w *warmer) registered(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.keys[key]
+	return ok
+}
+
+// current reports whether k is still the live registration for key.
+func (w *warmer) current(key string, k *warmKey) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.keys[key] == k
+}
+
+func (w *warmer) reschedule(key string, k *warmKey) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys[key] == k {
+		k.timer.Reset(jitter(k.interval))
+	}
+}
+
+func (w *warmer) fire(key string, k *warmKey) {
+	if !w.current(key, k) {
+		return
+	}
+	if peer, ok := w.g.pickPeer(key); ok {
+		w.handoff(key, k, peer)
+		return
+	}
+	if _, err := w.g.reload(context.Background(), key); err != nil {
+		log.Println("[GeeCache] Failed to keep warm", key, err)
+	}
+	w.reschedule(key, k)
+}
+
+// handoff registers key with its new owner and forgets it locally. If the
+// owner can't be reached the key stays here and is retried on the next tick.
+func (w *warmer) handoff(key string, k *warmKey, peer PeerGetter) {
+	pw, ok := peer.(PeerWarmer)
+	if !ok {
+		log.Println("[GeeCache] Peer can't keep", key, "warm")
+		w.reschedule(key, k)
+		return
+	}
+	if err := pw.KeepWarm(w.g.name, key, k.interval); err != nil {
+		log.Println("[GeeCache] Failed to hand off", key, err)
+		w.reschedule(key, k)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys[key] == k {
+		k.timer.Stop()
+		delete(w.keys, key)
+	}
+}
+
+// rebalance hands off every key this node no longer owns. It is called
+// when the ring membership changes.
+func (w *warmer) rebalance() {
+	w.mu.Lock()
+	moved := make(map[string]*warmKey)
+	for key, k := range w.keys {
+		if _, ok := w.g.pickPeer(key); ok {
+			moved[key] = k
+		}
+	}
+	w.mu.Unlock()
+
+	for key, k := range moved {
+		if peer, ok := w.g.pickPeer(key); ok {
+			w.handoff(key, k, peer)
+		}
+	}
+}
+
+// jitter returns a delay of up to 20% less than interval, so that keys are
+// reloaded before they go cold and don't all reload at the same moment.
+func jitter(interval time.Duration) time.Duration {
+	return interval - time.Duration(rand.Int63n(int64(interval)/5+1))
+}
@@ -0,0 +1,152 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakePeer struct {
+	mu          sync.Mutex
+	warmed      map[string]time.Duration
+	generations map[string]uint64
+	invalidated []string
+}
+
+func (p *fakePeer) Get(in *pb.Request, out *pb.Response) error {
+	out.Value = []byte("peer:" + in.GetKey())
+	return nil
+}
+
+func (p *fakePeer) KeepWarm(group, key string, interval time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.warmed == nil {
+		p.warmed = make(map[string]time.Duration)
+	}
+	p.warmed[key] = interval
+	return nil
+}
+
+func (p *fakePeer) InvalidateAll(group string, generation uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.generations == nil {
+		p.generations = make(map[string]uint64)
+	}
+	p.generations[group] = generation
+	return nil
+}
+
+func (p *fakePeer) InvalidateTag(group, tag string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.invalidated = append(p.invalidated, "tag:"+tag)
+	return nil
+}
+
+func (p *fakePeer) InvalidatePrefix(group, prefix string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.invalidated = append(p.invalidated, "prefix:"+prefix)
+	return nil
+}
+
+// fakePicker sends every key to peer while remote is set.
+type fakePicker struct {
+	peer     *fakePeer
+	remote   atomic.Bool
+	watchers []func()
+}
+
+func (p *fakePicker) PickPeer(key string) (PeerGetter, bool) {
+	if p.remote.Load() {
+		return p.peer, true
+	}
+	return nil, false
+}
+
+func (p *fakePicker) AllPeers() []PeerGetter {
+	return []PeerGetter{p.peer}
+}
+
+func (p *fakePicker) Watch(fn func()) {
+	p.watchers = append(p.watchers, fn)
+}
+
+func (p *fakePicker) setRemote(remote bool) {
+	p.remote.Store(remote)
+	for _, fn := range p.watchers {
+		fn()
+	}
+}
+
+func TestKeepWarm(t *testing.T) {
+	var loads int32
+	g := NewGroup("keepwarm", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			atomic.AddInt32(&loads, 1)
+			return []byte(key), nil
+		}))
+
+	if err := g.KeepWarm("hot", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(55 * time.Millisecond)
+	if n := atomic.LoadInt32(&loads); n < 4 {
+		t.Fatalf("expected hot to be reloaded repeatedly, got %d loads", n)
+	}
+
+	if err := g.KeepWarm("hot", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(15 * time.Millisecond)
+	n := atomic.LoadInt32(&loads)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&loads) != n {
+		t.Fatal("hot still reloaded after KeepWarm(hot, 0)")
+	}
+}
+
+func TestKeepWarmHandoff(t *testing.T) {
+	var loads int32
+	g := NewGroup("keepwarm-handoff", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			atomic.AddInt32(&loads, 1)
+			return []byte(key), nil
+		}))
+	picker := &fakePicker{peer: &fakePeer{}}
+	g.RegisterPeers(picker)
+
+	if err := g.KeepWarm("hot", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !g.warm.registered("hot") {
+		t.Fatal("hot should be kept warm by its owner")
+	}
+
+	picker.setRemote(true)
+	if g.warm.registered("hot") {
+		t.Fatal("hot should have been handed off to the new owner")
+	}
+	picker.peer.mu.Lock()
+	defer picker.peer.mu.Unlock()
+	if picker.peer.warmed["hot"] != time.Hour {
+		t.Fatalf("new owner got %v, expected %v", picker.peer.warmed["hot"], time.Hour)
+	}
+}
+
+func TestKeepWarmOverHTTP(t *testing.T) {
+	c := newTestCluster(t, 3, "keepwarm-http", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	key, owner := oddKey(c)
+
+	if err := c.nodes[0].group.KeepWarm(key, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !owner.group.warm.registered(key) {
+		t.Fatalf("expected %q to be kept warm by its owner", key)
+	}
+}
@@ -0,0 +1,236 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/logstore"
+	"log"
+)
+
+// maxSpills caps the evicted entries waiting to be written to L2. Entries
+// evicted while the queue is full are dropped rather than held in memory;
+// deletes are always queued.
+const maxSpills = 1024
+
+// SetL2 adds a second tier on disk to the group's main cache. Entries
+// evicted from memory are written to store, and moved back into memory
+// the next time they are hit, before a peer or the Getter is asked. The
+// store's own options bound the disk it takes.
+//
+// Whatever store already holds is removed: while this node was down, its
+// entries may have been changed or invalidated elsewhere, or come to be
+// owned by other nodes, and deletes aren't synced, so a crash can bring
+// deleted entries back.
+//
+// Entries are written and deleted in the background, so that the cache
+// never waits on the disk while it is locked. SetL2(nil) removes the tier
+// once the writes already queued are made. SetL2 should be called before
+// the group is used; the caller closes store once it is done with it.
+func (g *Group) SetL2(store *logstore.Store) error {
+	c := &g.mainCache
+	c.mu.Lock()
+	stop, done := c.spillStop, c.spillDone
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	if store != nil {
+		if err := store.Clear(); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	c.l2, c.spills, c.onL2 = store, nil, nil
+	c.spillWake, c.spillStop, c.spillDone = nil, nil, nil
+	if store != nil {
+		c.spillWake = make(chan struct{}, 1)
+		c.spillStop, c.spillDone = make(chan struct{}), make(chan struct{})
+		go c.writeSpills(store, c.spillWake, c.spillStop, c.spillDone)
+	}
+	return nil
+}
+
+// spill is a write to l2 waiting to be made: an entry evicted from store,
+// or the delete of a key.
+type spill struct {
+	key     string
+	entry   logstore.Entry
+	deleted bool
+}
+
+// l2Key is a key written to l2, with its tags. Every write makes a new
+// one, so that a reader can tell whether the key was written meanwhile.
+type l2Key struct {
+	tags []string
+}
+
+// spill queues an entry evicted from store for writeSpills, so that it is
+// written to l2 without holding c.mu. Until then it is found in c.spills.
+func (c *cache) spill(key string, e logstore.Entry) {
+	if _, ok := c.spills[key]; !ok && len(c.spills) >= maxSpills {
+		return
+	}
+	c.queue(&spill{key: key, entry: e})
+}
+
+// queue makes s the next write of its key, replacing any still queued.
+func (c *cache) queue(s *spill) {
+	if c.spills == nil {
+		c.spills = make(map[string]*spill)
+	}
+	c.spills[s.key] = s
+	select {
+	case c.spillWake <- struct{}{}:
+	default:
+	}
+}
+
+// writeSpills makes the queued writes whenever woken, until stop is
+// closed.
+func (c *cache) writeSpills(l2 *logstore.Store, wake, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-wake:
+			c.writeQueued(l2)
+		case <-stop:
+			c.writeQueued(l2)
+			return
+		}
+	}
+}
+
+// writeQueued makes the writes queued so far. They stay in c.spills, and
+// so visible to readers, until they are made. A write queued for a key
+// meanwhile replaces the one being made, and is made next time.
+func (c *cache) writeQueued(l2 *logstore.Store) {
+	c.mu.Lock()
+	queued := make([]*spill, 0, len(c.spills))
+	for _, s := range c.spills {
+		queued = append(queued, s)
+	}
+	c.mu.Unlock()
+
+	written := make([]bool, len(queued))
+	for i, s := range queued {
+		if !s.deleted {
+			err := l2.Put(s.key, s.entry)
+			if written[i] = err == nil; written[i] {
+				continue
+			}
+			// the spill may have replaced a delete: don't leave an older
+			// entry behind
+			log.Println("[GeeCache] l2:", err)
+		}
+		if err := l2.Delete(s.key); err != nil {
+			log.Println("[GeeCache] l2:", err)
+		}
+	}
+	st := l2.Stats()
+
+	c.mu.Lock()
+	for i, s := range queued {
+		if written[i] {
+			if c.onL2 == nil {
+				c.onL2 = make(map[string]*l2Key)
+			}
+			c.onL2[s.key] = &l2Key{tags: s.entry.Tags}
+		} else {
+			delete(c.onL2, s.key)
+		}
+		if c.spills[s.key] == s {
+			delete(c.spills, s.key)
+		}
+	}
+	// l2 also drops entries of its own, as they expire or it runs out of
+	// room; forget them once they are most of what is known
+	stale := int64(len(c.onL2)) > 2*st.Items
+	c.mu.Unlock()
+	if stale {
+		c.forgetDropped(l2)
+	}
+}
+
+// forgetDropped removes the keys that l2 dropped from c.onL2. It is only
+// called by the writer, so no key is written to l2 meanwhile.
+func (c *cache) forgetDropped(l2 *logstore.Store) {
+	live := make(map[string]bool)
+	for _, key := range l2.Keys() {
+		live[key] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.onL2 {
+		if !live[key] {
+			delete(c.onL2, key)
+		}
+	}
+}
+
+// l2Get returns the entry of key in l2, or waiting to be written to it.
+// It is called with c.mu held, and releases it while it reads from disk:
+// if the key is written meanwhile, it reports a miss.
+func (c *cache) l2Get(key string) (logstore.Entry, bool) {
+	if s, ok := c.spills[key]; ok {
+		return s.entry, !s.deleted
+	}
+	k, ok := c.onL2[key]
+	if !ok {
+		return logstore.Entry{}, false
+	}
+	l2 := c.l2
+	c.mu.Unlock()
+	e, ok, err := l2.Get(key)
+	c.mu.Lock()
+	if err != nil {
+		log.Println("[GeeCache] l2:", err)
+	}
+	if c.l2 != l2 || c.spills[key] != nil || c.onL2[key] != k {
+		return logstore.Entry{}, false
+	}
+	if !ok {
+		// l2 dropped it
+		delete(c.onL2, key)
+	}
+	return e, ok
+}
+
+// l2Delete queues the delete of key from l2, if it is there or waiting
+// to be written.
+func (c *cache) l2Delete(key string) {
+	if c.l2 == nil {
+		return
+	}
+	if s, ok := c.spills[key]; ok && s.deleted {
+		return
+	}
+	_, queued := c.spills[key]
+	if _, ok := c.onL2[key]; ok || queued {
+		c.queue(&spill{key: key, deleted: true})
+	}
+}
+
+// l2DeleteFunc queues the delete of the entries of l2 that match accepts,
+// whether they are written yet or not.
+func (c *cache) l2DeleteFunc(match func(key string, tags []string) bool) {
+	if c.l2 == nil {
+		return
+	}
+	var keys []string
+	for key, s := range c.spills {
+		if !s.deleted && match(key, s.entry.Tags) {
+			keys = append(keys, key)
+		}
+	}
+	for key, k := range c.onL2 {
+		// a write queued for key replaces what is on disk
+		if _, queued := c.spills[key]; !queued && match(key, k.tags) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		c.l2Delete(key)
+	}
+}
@@ -0,0 +1,157 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/logstore"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestL2(t *testing.T) {
+	loads := make(map[string]int)
+	getter := TaggedGetterFunc(func(key string) ([]byte, []string, error) {
+		loads[key]++
+		return []byte(strings.Repeat(key, 10)), []string{"tag-" + key}, nil
+	})
+	dir := t.TempDir()
+	store, err := logstore.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for two entries in memory
+	g := newGroup("l2", 30, getter)
+	if err := g.SetL2(store); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		g.Get(key)
+	}
+	if !waitFor(time.Second, func() bool { return g.Stats().L2.Items == 2 }) {
+		t.Fatalf("expected a and b to spill to L2, got %+v", g.Stats())
+	}
+	if v, err := g.Get("a"); err != nil || v.String() != strings.Repeat("a", 10) || loads["a"] != 1 {
+		t.Fatalf("expected a from L2, got %q %v after %d loads", v, err, loads["a"])
+	}
+	if st := g.Stats(); st.L2Hits != 1 || st.CacheHits != 1 {
+		t.Fatalf("expected one L2 hit, got %+v", st)
+	}
+
+	// a is back in memory and c spilled; removing either must reach both
+	// tiers
+	g.Remove("a")
+	g.InvalidateTag("tag-c")
+	g.Get("a")
+	g.Get("c")
+	if loads["a"] != 2 || loads["c"] != 2 {
+		t.Fatalf("expected a and c to be loaded again, got %v", loads)
+	}
+
+	g.SetExpire("e", []byte("eee"), time.Now().Add(50*time.Millisecond))
+	time.Sleep(60 * time.Millisecond)
+	g.Get("f")
+	g.Get("g")
+	g.SetL2(nil)
+	if _, ok, _ := store.Get(g.cacheKey("e")); ok {
+		t.Fatal("expected the expired e not to spill")
+	}
+
+	// what was on disk may have changed elsewhere meanwhile, and is
+	// dropped on a restart
+	if spilled := store.Stats().Items; spilled == 0 {
+		t.Fatal("expected entries in L2 before the restart")
+	}
+	store.Close()
+	store, err = logstore.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	restarted := newGroup("l2", 30, getter)
+	if err := restarted.SetL2(store); err != nil {
+		t.Fatal(err)
+	}
+	if st := restarted.Stats(); st.L2.Items != 0 {
+		t.Fatalf("expected L2 to be empty after a restart, got %+v", st)
+	}
+	if _, err := restarted.Get("b"); err != nil || loads["b"] != 2 {
+		t.Fatalf("expected b to be loaded again after a restart, got %v after %d loads", err, loads["b"])
+	}
+}
+
+func TestL2SpillDoesNotOutliveRemove(t *testing.T) {
+	store, err := logstore.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	g := newGroup("l2-remove", 30, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(strings.Repeat(key, 10)), nil
+	}))
+	if err := g.SetL2(store); err != nil {
+		t.Fatal(err)
+	}
+
+	// don't wake the writer, so that spills stay queued until SetL2(nil)
+	g.mainCache.mu.Lock()
+	g.mainCache.spillWake = nil
+	g.mainCache.mu.Unlock()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		g.Get(key)
+	}
+	g.mainCache.mu.Lock()
+	_, queued := g.mainCache.spills[g.cacheKey("a")]
+	g.mainCache.mu.Unlock()
+	if !queued {
+		t.Fatal("expected a to be queued for L2")
+	}
+	g.Remove("a")
+	g.SetL2(nil)
+	if _, ok, _ := store.Get(g.cacheKey("a")); ok {
+		t.Fatal("expected the removed a not to be written to L2")
+	}
+	if _, ok, _ := store.Get(g.cacheKey("b")); !ok {
+		t.Fatal("expected b to be written to L2")
+	}
+}
+
+func TestL2DeletesAreQueued(t *testing.T) {
+	store, err := logstore.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	g := newGroup("l2-deletes", 30, TaggedGetterFunc(func(key string) ([]byte, []string, error) {
+		return []byte(strings.Repeat(key, 10)), []string{"tag-" + key}, nil
+	}))
+	if err := g.SetL2(store); err != nil {
+		t.Fatal(err)
+	}
+	c := &g.mainCache
+	c.mu.Lock()
+	c.spillWake = nil
+	c.mu.Unlock()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		g.Get(key)
+	}
+	c.writeQueued(store)
+	if st := store.Stats(); st.Items != 2 {
+		t.Fatalf("expected a and b on disk, got %+v", st)
+	}
+
+	// the deletes wait for the writer, but count as made straight away
+	g.Remove("a")
+	g.InvalidateTag("tag-b")
+	for _, key := range []string{"a", "b"} {
+		if _, ok, _ := store.Get(g.cacheKey(key)); !ok {
+			t.Fatalf("expected %s to be left on disk until the writer runs", key)
+		}
+		if _, ok := g.lookupCache(key); ok {
+			t.Fatalf("expected %s to be gone from both tiers", key)
+		}
+	}
+	c.writeQueued(store)
+	if st := store.Stats(); st.Items != 0 {
+		t.Fatalf("expected a and b to be deleted from disk, got %+v", st)
+	}
+}
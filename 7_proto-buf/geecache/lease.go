@@ -0,0 +1,260 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultLeaseTTL = 10 * time.Second
+
+// ErrLeaseInvalid is returned by LeaseSet when the lease token has been
+// revoked by a Remove, has expired or was never handed out.
+var ErrLeaseInvalid = errors.New("geecache: lease is no longer valid")
+
+// A Lease is the owner's answer to LeaseGet.
+type Lease struct {
+	// Value is the cached value, or a stale one if Stale is set.
+	Value ByteView
+	// Token is non-zero when the key is missing and the caller now holds
+	// the lease: it should load the value itself and call LeaseSet.
+	Token uint64
+	// Wait is set when another client holds the lease. The caller should
+	// retry shortly, or make do with Value if Stale is set.
+	Wait  bool
+	Stale bool
+}
+
+// leaseTable hands out memcache-style leases for keys missing from the
+// cache. Only the holder of a key's lease may populate it, and removing
+// the key revokes the lease, so a load that raced with a delete can't put
+// a stale value back. Values removed recently are kept as stale values
+// that waiting clients may choose to use.
+type leaseTable struct {
+	ttl time.Duration
+
+	mu     sync.Mutex // guards everything below
+	next   uint64
+	leases map[string]*lease
+	stale  map[string]staleValue
+}
+
+type lease struct {
+	token   uint64
+	expires time.Time
+	done    chan struct{} // closed when the lease ends
+}
+
+type staleValue struct {
+	value   ByteView
+	expires time.Time
+}
+
+func (t *leaseTable) init() {
+	if t.leases == nil {
+		t.leases = make(map[string]*lease)
+		t.stale = make(map[string]staleValue)
+	}
+	if t.ttl == 0 {
+		t.ttl = defaultLeaseTTL
+	}
+}
+
+// acquire grants a lease on key. If another lease is active it returns
+// that lease instead, along with a stale value if there is one.
+func (t *leaseTable) acquire(key string) (token uint64, held *lease, stale ByteView, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	now := time.Now()
+	if l, exists := t.leases[key]; exists {
+		if now.Before(l.expires) {
+			s, ok := t.stale[key]
+			if ok && now.After(s.expires) {
+				delete(t.stale, key)
+				ok = false
+			}
+			return 0, l, s.value, ok
+		}
+		t.end(key, l)
+	}
+	t.next++
+	t.leases[key] = &lease{
+		token:   t.next,
+		expires: now.Add(t.ttl),
+		done:    make(chan struct{}),
+	}
+	return t.next, nil, ByteView{}, false
+}
+
+// release ends the lease identified by token and reports whether it was
+// still valid, i.e. whether the holder may populate the cache.
+func (t *leaseTable) release(key string, token uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.leases[key]
+	if !ok || l.token != token {
+		return false
+	}
+	t.end(key, l)
+	delete(t.stale, key)
+	return time.Now().Before(l.expires)
+}
+
+// revoke invalidates any outstanding lease on key. value, if ok, is the
+// entry that was just removed and is remembered as stale for a while;
+// otherwise any stale value for key is forgotten.
+func (t *leaseTable) revoke(key string, value ByteView, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if l, exists := t.leases[key]; exists {
+		t.end(key, l)
+	}
+	now := time.Now()
+	for k, s := range t.stale {
+		if now.After(s.expires) {
+			delete(t.stale, k)
+		}
+	}
+	if ok {
+		t.stale[key] = staleValue{value: value, expires: now.Add(t.ttl)}
+	} else {
+		delete(t.stale, key)
+	}
+}
+
+// revokeAll invalidates every outstanding lease and forgets every stale
+// value.
+func (t *leaseTable) revokeAll() {
+	t.revokeFunc(func(string) bool { return true })
+}
+
+// revokeFunc invalidates the outstanding leases and forgets the stale
+// values of every key for which match returns true.
+func (t *leaseTable) revokeFunc(match func(key string) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, l := range t.leases {
+		if match(key) {
+			t.end(key, l)
+		}
+	}
+	for key := range t.stale {
+		if match(key) {
+			delete(t.stale, key)
+		}
+	}
+}
+
+func (t *leaseTable) end(key string, l *lease) {
+	delete(t.leases, key)
+	close(l.done)
+}
+
+// wait blocks until l ends or expires.
+func (l *lease) wait() {
+	timer := time.NewTimer(time.Until(l.expires))
+	defer timer.Stop()
+	select {
+	case <-l.done:
+	case <-timer.C:
+	}
+}
+
+// LeaseGet looks key up on its owner without loading it. On a miss the
+// caller is handed a lease and is expected to load the value itself and
+// store it with LeaseSet; while that lease is active, other callers are
+// told to wait and are offered a stale value if one is known.
+func (g *Group) LeaseGet(key string) (Lease, error) {
+	if key == "" {
+		return Lease{}, fmt.Errorf("key is required")
+	}
+	var lease Lease
+	if peer, ok := g.pickPeer(key); ok {
+		var err error
+		if lease, err = g.leaseGetFromPeer(peer, key); err != nil {
+			return Lease{}, err
+		}
+	} else {
+		lease = g.leaseGetLocally(key)
+	}
+	value, err := lease.Value.open()
+	if err != nil {
+		return Lease{}, err
+	}
+	lease.Value = value
+	return lease, nil
+}
+
+// LeaseSet populates key with value on its owner, provided token is still
+// the key's active lease, and broadcasts the write like Set. It returns
+// ErrLeaseInvalid otherwise.
+func (g *Group) LeaseSet(key string, token uint64, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if peer, ok := g.pickPeer(key); ok {
+		pl, ok := peer.(PeerLeaser)
+		if !ok {
+			return fmt.Errorf("peer can't fill %s with a lease", key)
+		}
+		e, err := g.peerEntry(key, ByteView{b: value}, nil)
+		if err != nil {
+			return err
+		}
+		if err := pl.LeaseSet(g.name, token, e); err != nil {
+			return err
+		}
+		g.hotCache.remove(g.cacheKey(key))
+		return nil
+	}
+	return g.leaseSetLocally(key, token, ByteView{b: cloneBytes(value)})
+}
+
+func (g *Group) leaseGetLocally(key string) Lease {
+	if v, ok := g.lookupCache(key); ok {
+		return Lease{Value: v}
+	}
+	token, _, stale, ok := g.leases.acquire(key)
+	if token != 0 {
+		return Lease{Token: token}
+	}
+	return Lease{Value: stale, Wait: true, Stale: ok}
+}
+
+func (g *Group) leaseSetLocally(key string, token uint64, value ByteView) error {
+	if !g.leases.release(key, token) {
+		return ErrLeaseInvalid
+	}
+	g.changes.key(key)
+	g.populateCache(key, value)
+	g.broadcast(key)
+	return nil
+}
+
+func (g *Group) leaseGetFromPeer(peer PeerGetter, key string) (Lease, error) {
+	req := &pb.Request{
+		Group:      g.name,
+		Key:        key,
+		Lease:      true,
+		Generation: g.generation.Load(),
+	}
+	res := &pb.Response{}
+	if err := peer.Get(req, res); err != nil {
+		return Lease{}, err
+	}
+	g.setGeneration(res.Generation)
+	value, err := g.peerView(key, res.Value, res.Expire, res.Compression, res.KeyId)
+	if err != nil {
+		return Lease{}, err
+	}
+	return Lease{
+		Value: value,
+		Token: res.Lease,
+		Wait:  res.Wait,
+		Stale: res.Stale,
+	}, nil
+}
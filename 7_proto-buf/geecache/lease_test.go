@@ -0,0 +1,113 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLease(t *testing.T) {
+	g := NewGroup("lease", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+
+	first, err := g.LeaseGet("k")
+	if err != nil || first.Token == 0 {
+		t.Fatalf("expected a lease on a miss, got %+v, %v", first, err)
+	}
+	if second, _ := g.LeaseGet("k"); second.Token != 0 || !second.Wait {
+		t.Fatalf("expected to wait on an active lease, got %+v", second)
+	}
+
+	if err := g.LeaseSet("k", first.Token, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if hit, _ := g.LeaseGet("k"); hit.Value.String() != "v1" {
+		t.Fatalf("expected v1 after LeaseSet, got %+v", hit)
+	}
+	if err := g.LeaseSet("k", first.Token, []byte("v1")); err != ErrLeaseInvalid {
+		t.Fatalf("a lease can be used only once, got %v", err)
+	}
+}
+
+func TestLeaseRevokedByRemove(t *testing.T) {
+	g := NewGroup("lease-remove", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	g.populateCache("k", ByteView{b: []byte("old")})
+
+	if removed, err := g.Remove("k"); err != nil || !removed {
+		t.Fatalf("expected k to be removed, got %v, %v", removed, err)
+	}
+	holder, _ := g.LeaseGet("k")
+	if holder.Token == 0 {
+		t.Fatalf("expected a lease after Remove, got %+v", holder)
+	}
+	waiter, _ := g.LeaseGet("k")
+	if !waiter.Wait || !waiter.Stale || waiter.Value.String() != "old" {
+		t.Fatalf("expected to be offered the stale value, got %+v", waiter)
+	}
+
+	// the key changes again while the holder is loading it
+	if _, err := g.Remove("k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.LeaseSet("k", holder.Token, []byte("stale")); err != ErrLeaseInvalid {
+		t.Fatalf("expected the lease to be revoked, got %v", err)
+	}
+	if v, err := g.Get("k"); err != nil || v.String() != "k" {
+		t.Fatalf("expected a fresh load, got %v, %v", v, err)
+	}
+}
+
+func TestLeaseOverHTTP(t *testing.T) {
+	g := NewGroup("lease-http", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	srv := httptest.NewServer(NewHTTPPool("http://owner"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+
+	holder, err := g.leaseGetFromPeer(peer, "k")
+	if err != nil || holder.Token == 0 {
+		t.Fatalf("expected a lease on a miss, got %+v, %v", holder, err)
+	}
+	if waiter, _ := g.leaseGetFromPeer(peer, "k"); !waiter.Wait {
+		t.Fatalf("expected to wait on an active lease, got %+v", waiter)
+	}
+	if removed, err := peer.Remove(g.name, "k"); err != nil || removed {
+		t.Fatalf("expected nothing to be removed, got %v, %v", removed, err)
+	}
+	if err := peer.LeaseSet(g.name, holder.Token, &pb.Entry{Key: "k", Value: []byte("v")}); err != ErrLeaseInvalid {
+		t.Fatalf("expected the lease to be revoked, got %v", err)
+	}
+
+	holder, _ = g.leaseGetFromPeer(peer, "k")
+	if err := peer.LeaseSet(g.name, holder.Token, &pb.Entry{Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if hit, _ := g.leaseGetFromPeer(peer, "k"); hit.Value.String() != "v" || hit.Token != 0 {
+		t.Fatalf("expected a hit, got %+v", hit)
+	}
+}
+
+func TestLeaseOddKeyOverHTTP(t *testing.T) {
+	c := newTestCluster(t, 3, "lease-odd", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	key, owner := oddKey(c)
+	g := c.nodes[0].group
+
+	lease, err := g.LeaseGet(key)
+	if err != nil || lease.Token == 0 {
+		t.Fatalf("expected a lease on %q, got %+v, %v", key, lease, err)
+	}
+	if err := g.LeaseSet(key, lease.Token, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := owner.group.lookupCache(key); !ok || v.String() != "v" {
+		t.Fatalf("expected the owner to cache %q, got %q, %v", key, v, ok)
+	}
+	if removed, err := g.Remove(key); err != nil || !removed {
+		t.Fatalf("expected %q to be removed, got %v, %v", key, removed, err)
+	}
+	if _, ok := owner.group.lookupCache(key); ok {
+		t.Fatalf("expected %q to be gone from its owner", key)
+	}
+}
@@ -0,0 +1,88 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// shedInterval is how long a group sheds queued loads after one of them
+// waited longer than its QueueTarget.
+const shedInterval = 100 * time.Millisecond
+
+// ErrOverloaded is returned for a load that was rejected because too many
+// loads are running or waiting. Peers pass it on rather than loading the
+// key themselves, so that the Getter's backend gets a break.
+var ErrOverloaded = errors.New("too many loads")
+
+// A LoadLimit caps the loads a group runs through its Getter at once.
+type LoadLimit struct {
+	// MaxConcurrent is the number of loads that may run at once. If
+	// blank, loads aren't limited.
+	MaxConcurrent int
+
+	// MaxQueue is the number of loads that may wait for one of the others
+	// to finish; more are rejected with ErrOverloaded. If blank, any
+	// number may wait; if negative, none may.
+	MaxQueue int
+
+	// QueueTarget turns on adaptive load shedding: once a load has
+	// waited longer than QueueTarget, loads that would have to wait are
+	// rejected for a while, until the queue drains.
+	QueueTarget time.Duration
+}
+
+// loadLimiter enforces a LoadLimit.
+type loadLimiter struct {
+	LoadLimit
+	slots     chan struct{}
+	waiting   atomic.Int64
+	shedUntil atomic.Int64 // unix nanoseconds
+}
+
+// SetLoadLimit limits the group's loads through its Getter. It should be
+// called before the group is used.
+func (g *Group) SetLoadLimit(limit LoadLimit) {
+	if limit.MaxConcurrent <= 0 {
+		g.limiter.Store(nil)
+		return
+	}
+	g.limiter.Store(&loadLimiter{
+		LoadLimit: limit,
+		slots:     make(chan struct{}, limit.MaxConcurrent),
+	})
+}
+
+// acquire waits for a load slot, unless the queue is full or being shed,
+// or until ctx is done.
+func (l *loadLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.MaxQueue < 0 || time.Now().UnixNano() < l.shedUntil.Load() {
+		return ErrOverloaded
+	}
+	if n := l.waiting.Add(1); l.MaxQueue > 0 && n > int64(l.MaxQueue) {
+		l.waiting.Add(-1)
+		return ErrOverloaded
+	}
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		l.waiting.Add(-1)
+		return ctx.Err()
+	}
+	l.waiting.Add(-1)
+	if l.QueueTarget > 0 && time.Since(start) > l.QueueTarget {
+		l.shedUntil.Store(time.Now().Add(shedInterval).UnixNano())
+	}
+	return nil
+}
+
+func (l *loadLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,155 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// blockingGetter loads keys once they are let through on its channel.
+type blockingGetter struct {
+	started chan string
+	unblock chan struct{}
+}
+
+func newBlockingGetter() *blockingGetter {
+	return &blockingGetter{started: make(chan string, 16), unblock: make(chan struct{})}
+}
+
+func (b *blockingGetter) Get(key string) ([]byte, error) {
+	b.started <- key
+	<-b.unblock
+	return []byte("v-" + key), nil
+}
+
+func TestLoadLimit(t *testing.T) {
+	getter := newBlockingGetter()
+	g := newGroup("load-limit", 2<<10, getter)
+	g.SetLoadLimit(LoadLimit{MaxConcurrent: 1, MaxQueue: 1})
+
+	errs := make(chan error, 2)
+	get := func(key string) {
+		_, err := g.Get(key)
+		errs <- err
+	}
+	go get("a")
+	<-getter.started
+	go get("b")
+	if !waitFor(time.Second, func() bool { return g.limiter.Load().waiting.Load() == 1 }) {
+		t.Fatal("expected b to wait for a slot")
+	}
+	if _, err := g.Get("c"); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected c to be rejected, got %v", err)
+	}
+
+	close(getter.unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := g.Get("c"); err != nil || v.String() != "v-c" {
+		t.Fatalf("expected c to load once the queue drained, got %q, %v", v, err)
+	}
+	if st := g.Stats(); st.LoadsRejected != 1 || st.LocalLoads != 3 {
+		t.Fatalf("expected 1 rejected and 3 loads, got %+v", st)
+	}
+}
+
+func TestLoadLimitCanceled(t *testing.T) {
+	getter := newBlockingGetter()
+	g := newGroup("load-limit-canceled", 2<<10, getter)
+	g.SetLoadLimit(LoadLimit{MaxConcurrent: 1})
+
+	done := make(chan error)
+	go func() {
+		_, err := g.Get("a")
+		done <- err
+	}()
+	<-getter.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.GetContext(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the queued load to end with its context, got %v", err)
+	}
+	if n := g.limiter.Load().waiting.Load(); n != 0 {
+		t.Fatalf("expected no load left waiting, got %d", n)
+	}
+	close(getter.unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if st := g.Stats(); st.LoadsRejected != 0 {
+		t.Fatalf("expected a canceled load not to count as rejected, got %+v", st)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	getter := newBlockingGetter()
+	g := newGroup("load-shedding", 2<<10, getter)
+	g.SetLoadLimit(LoadLimit{MaxConcurrent: 1, QueueTarget: 10 * time.Millisecond})
+
+	errs := make(chan error, 2)
+	get := func(key string) {
+		_, err := g.Get(key)
+		errs <- err
+	}
+	go get("a")
+	<-getter.started
+	go get("b")
+	// b waits past the target before a finishes
+	time.Sleep(30 * time.Millisecond)
+	getter.unblock <- struct{}{}
+	<-getter.started
+
+	// b holds the slot now, and the queue is being shed
+	if _, err := g.Get("c"); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected c to be shed, got %v", err)
+	}
+	getter.unblock <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(shedInterval)
+	close(getter.unblock)
+	if _, err := g.Get("c"); err != nil {
+		t.Fatalf("expected shedding to stop, got %v", err)
+	}
+}
+
+func TestLoadLimitAcrossPeers(t *testing.T) {
+	getter := newBlockingGetter()
+	c := newTestCluster(t, 2, "load-limit-peers", getter)
+	for _, node := range c.nodes {
+		node.group.SetLoadLimit(LoadLimit{MaxConcurrent: 1, MaxQueue: -1})
+	}
+	key, owner := remoteKey(c)
+
+	// fill the owner's only slot
+	done := make(chan error)
+	go func() {
+		_, err := owner.group.reload(context.Background(), "busy")
+		done <- err
+	}()
+	<-getter.started
+
+	// the owner's 429 is passed on, not loaded around
+	if _, err := c.nodes[0].group.Get(key); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected the owner's overload to be passed on, got %v", err)
+	}
+	if st := c.nodes[0].group.Stats(); st.LocalLoads != 0 {
+		t.Fatalf("expected no local load, got %+v", st)
+	}
+	close(getter.unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != fmt.Sprintf("v-%s", key) {
+		t.Fatalf("expected %s to load, got %q, %v", key, v, err)
+	}
+}
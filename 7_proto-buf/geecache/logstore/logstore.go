@@ -0,0 +1,574 @@
+// Package logstore is a log-structured key/value store on disk, for
+// entries that don't fit in memory.
+//
+// Entries are appended to segment files, with an index of where each key's
+// latest record is kept in memory. Segments are reclaimed oldest first:
+// over budget, the oldest segment is dropped with the entries still in it;
+// otherwise, once at least half of it is dead, its live records are copied
+// to the head of the log and it is removed. Because a segment is only ever
+// removed when it is the oldest, a delete record never outlives the
+// records it shadows, and a crash at any point leaves a log that replays
+// to the same index.
+package logstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxBytes = 1 << 30
+	minSegmentBytes = 1 << 20
+
+	// crc | kind | expire | key length | tags length | value length
+	headerSize = 4 + 1 + 8 + 4 + 4 + 4
+
+	kindPut    = 0
+	kindDelete = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrTooLarge is returned by Put for an entry that can't fit in a segment.
+var ErrTooLarge = errors.New("entry too large")
+
+// ErrClosed is returned for writes to a store that was closed.
+var ErrClosed = errors.New("store closed")
+
+// Options configure a Store.
+type Options struct {
+	// MaxBytes is the most disk space the store's segments take. If
+	// blank, it defaults to 1GB.
+	MaxBytes int64
+
+	// SegmentBytes is the size at which a new segment is started, and
+	// the largest entry that can be stored. If blank, it defaults to an
+	// eighth of MaxBytes, but at least 1MB. It is at most MaxBytes.
+	SegmentBytes int64
+}
+
+// An Entry is a value and what is kept with it.
+type Entry struct {
+	Value  []byte
+	Expire time.Time // zero if the value doesn't expire
+	Tags   []string
+}
+
+// Stats are the size of a store.
+type Stats struct {
+	Bytes     int64 // disk space taken by the segments
+	LiveBytes int64 // of which by the latest record of each key
+	Items     int64
+	Segments  int64
+}
+
+// Store is a log-structured store. It is safe for concurrent access.
+type Store struct {
+	dir  string
+	opts Options
+
+	mu    sync.Mutex
+	segs  []*segment // oldest first; the last is appended to
+	index map[string]*item
+	bytes int64
+	live  int64
+}
+
+type segment struct {
+	id   uint64
+	f    *os.File
+	size int64
+	live int64 // bytes of the records still in the index
+}
+
+type item struct {
+	seg    *segment
+	off    int64
+	size   int64
+	expire int64 // unix nanoseconds, 0 for none
+	tags   []string
+}
+
+// Open opens the store in dir, creating it if needed, and replays its
+// segments to rebuild the index. A segment that ends in a torn or corrupt
+// record, as left by a crash, is truncated before it.
+func Open(dir string, opts *Options) (*Store, error) {
+	s := &Store{dir: dir, index: make(map[string]*item)}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MaxBytes <= 0 {
+		s.opts.MaxBytes = defaultMaxBytes
+	}
+	if s.opts.SegmentBytes <= 0 {
+		s.opts.SegmentBytes = max(s.opts.MaxBytes/8, minSegmentBytes)
+	}
+	s.opts.SegmentBytes = min(s.opts.SegmentBytes, s.opts.MaxBytes)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, name := range names {
+		var id uint64
+		if _, err := fmt.Sscanf(filepath.Base(name), "%016x.seg", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.segs = append(s.segs, seg)
+		if err := s.replay(seg); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if len(s.segs) == 0 {
+		if err := s.roll(); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s, s.reclaim()
+}
+
+func (s *Store) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x.seg", id))
+}
+
+func (s *Store) openSegment(id uint64) (*segment, error) {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, f: f}, nil
+}
+
+// replay adds the records of seg to the index, and truncates seg after
+// the last record that is intact.
+func (s *Store) replay(seg *segment) error {
+	r := bufio.NewReader(io.NewSectionReader(seg.f, 0, 1<<62))
+	now := time.Now().UnixNano()
+	var off int64
+	for {
+		rec, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		size := int64(len(rec.raw))
+		s.bytes += size
+		if rec.kind == kindPut && (rec.expire == 0 || rec.expire > now) {
+			s.link(rec.key, &item{seg: seg, off: off, size: size, expire: rec.expire, tags: rec.tags})
+		} else {
+			s.unlink(rec.key)
+		}
+		off += size
+	}
+	seg.size = off
+	return seg.f.Truncate(off)
+}
+
+// roll starts a new segment.
+func (s *Store) roll() error {
+	var id uint64 = 1
+	if len(s.segs) > 0 {
+		id = s.segs[len(s.segs)-1].id + 1
+	}
+	seg, err := s.openSegment(id)
+	if err != nil {
+		return err
+	}
+	if err := seg.f.Truncate(0); err != nil {
+		seg.f.Close()
+		return err
+	}
+	s.segs = append(s.segs, seg)
+	return nil
+}
+
+// Put stores e under key, replacing any earlier entry.
+func (s *Store) Put(key string, e Entry) error {
+	raw := encodeRecord(kindPut, key, unixNano(e.Expire), e.Tags, e.Value)
+	if int64(len(raw)) > s.opts.SegmentBytes {
+		return ErrTooLarge
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, err := s.append(raw)
+	if err != nil {
+		return err
+	}
+	it.expire = unixNano(e.Expire)
+	it.tags = e.Tags
+	s.link(key, it)
+	return s.reclaim()
+}
+
+// Get returns the entry stored under key. An entry that has expired is
+// dropped and not returned.
+func (s *Store) Get(key string) (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.index[key]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	if it.expire != 0 && it.expire <= time.Now().UnixNano() {
+		s.unlink(key)
+		return Entry{}, false, nil
+	}
+	rec, err := s.read(it)
+	if err != nil {
+		// the record is lost, don't keep running into it
+		s.unlink(key)
+		return Entry{}, false, err
+	}
+	return Entry{Value: rec.value, Expire: fromUnixNano(rec.expire), Tags: rec.tags}, true, nil
+}
+
+// Delete removes the entry stored under key, if any.
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delete(key)
+}
+
+// DeleteFunc removes every entry that match accepts.
+func (s *Store) DeleteFunc(match func(key string, tags []string) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key, it := range s.index {
+		if match(key, it.tags) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if err := s.delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix removes every entry whose key starts with prefix.
+func (s *Store) DeletePrefix(prefix string) error {
+	return s.DeleteFunc(func(key string, _ []string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+func (s *Store) delete(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	s.unlink(key)
+	if _, err := s.append(encodeRecord(kindDelete, key, 0, nil, nil)); err != nil {
+		return err
+	}
+	return s.reclaim()
+}
+
+// Clear removes every entry. Rather than logging a delete for each, it
+// removes the segments and starts an empty one.
+func (s *Store) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segs) == 0 {
+		return ErrClosed
+	}
+	for len(s.segs) > 0 {
+		s.removeOldest()
+	}
+	s.index = make(map[string]*item)
+	s.live = 0
+	return s.roll()
+}
+
+// Keys returns the keys of the entries stored, in no particular order.
+func (s *Store) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Stats returns the size of the store.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Bytes:     s.bytes,
+		LiveBytes: s.live,
+		Items:     int64(len(s.index)),
+		Segments:  int64(len(s.segs)),
+	}
+}
+
+// Sync flushes the segment being appended to to disk.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segs) == 0 {
+		return ErrClosed
+	}
+	return s.head().f.Sync()
+}
+
+// Close syncs and closes the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	if len(s.segs) > 0 {
+		errs = append(errs, s.head().f.Sync())
+	}
+	for _, seg := range s.segs {
+		errs = append(errs, seg.f.Close())
+	}
+	s.segs = nil
+	return errors.Join(errs...)
+}
+
+func (s *Store) head() *segment {
+	return s.segs[len(s.segs)-1]
+}
+
+// append writes a record at the head of the log and returns where it is.
+func (s *Store) append(raw []byte) (*item, error) {
+	if len(s.segs) == 0 {
+		return nil, ErrClosed
+	}
+	size := int64(len(raw))
+	if seg := s.head(); seg.size > 0 && seg.size+size > s.opts.SegmentBytes {
+		if err := s.roll(); err != nil {
+			return nil, err
+		}
+	}
+	seg := s.head()
+	if _, err := seg.f.WriteAt(raw, seg.size); err != nil {
+		return nil, err
+	}
+	it := &item{seg: seg, off: seg.size, size: size}
+	seg.size += size
+	s.bytes += size
+	return it, nil
+}
+
+// link makes it the latest record of key.
+func (s *Store) link(key string, it *item) {
+	s.unlink(key)
+	s.index[key] = it
+	it.seg.live += it.size
+	s.live += it.size
+}
+
+func (s *Store) unlink(key string) {
+	if old, ok := s.index[key]; ok {
+		old.seg.live -= old.size
+		s.live -= old.size
+		delete(s.index, key)
+	}
+}
+
+func (s *Store) read(it *item) (*record, error) {
+	raw := make([]byte, it.size)
+	if _, err := it.seg.f.ReadAt(raw, it.off); err != nil {
+		return nil, err
+	}
+	return decodeRecord(raw)
+}
+
+// reclaim drops the oldest segment while the store is over budget, and
+// compacts it while it is mostly dead.
+func (s *Store) reclaim() error {
+	for len(s.segs) > 1 {
+		oldest := s.segs[0]
+		switch {
+		case s.bytes > s.opts.MaxBytes:
+			s.dropOldest()
+		case oldest.live*2 <= oldest.size:
+			if err := s.compactOldest(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// dropOldest removes the oldest segment with the entries still in it.
+func (s *Store) dropOldest() {
+	oldest := s.segs[0]
+	for key, it := range s.index {
+		if it.seg == oldest {
+			s.unlink(key)
+		}
+	}
+	s.removeOldest()
+}
+
+// compactOldest copies the live records of the oldest segment to the head
+// of the log and removes it. The copies are synced first, so that a crash
+// can't lose them.
+func (s *Store) compactOldest() error {
+	oldest := s.segs[0]
+	now := time.Now().UnixNano()
+	for key, it := range s.index {
+		if it.seg != oldest {
+			continue
+		}
+		if it.expire != 0 && it.expire <= now {
+			s.unlink(key)
+			continue
+		}
+		raw := make([]byte, it.size)
+		if _, err := oldest.f.ReadAt(raw, it.off); err != nil {
+			return err
+		}
+		moved, err := s.append(raw)
+		if err != nil {
+			return err
+		}
+		moved.expire, moved.tags = it.expire, it.tags
+		s.link(key, moved)
+	}
+	if err := s.head().f.Sync(); err != nil {
+		return err
+	}
+	s.removeOldest()
+	return nil
+}
+
+func (s *Store) removeOldest() {
+	oldest := s.segs[0]
+	s.segs = s.segs[1:]
+	s.bytes -= oldest.size
+	oldest.f.Close()
+	os.Remove(oldest.f.Name())
+}
+
+// record is a decoded record.
+type record struct {
+	raw    []byte
+	kind   byte
+	expire int64
+	key    string
+	tags   []string
+	value  []byte
+}
+
+var errCorrupt = errors.New("corrupt record")
+
+func encodeRecord(kind byte, key string, expire int64, tags []string, value []byte) []byte {
+	var tagBytes []byte
+	for _, tag := range tags {
+		tagBytes = binary.AppendUvarint(tagBytes, uint64(len(tag)))
+		tagBytes = append(tagBytes, tag...)
+	}
+	raw := make([]byte, headerSize, headerSize+len(key)+len(tagBytes)+len(value))
+	raw[4] = kind
+	binary.BigEndian.PutUint64(raw[5:], uint64(expire))
+	binary.BigEndian.PutUint32(raw[13:], uint32(len(key)))
+	binary.BigEndian.PutUint32(raw[17:], uint32(len(tagBytes)))
+	binary.BigEndian.PutUint32(raw[21:], uint32(len(value)))
+	raw = append(raw, key...)
+	raw = append(raw, tagBytes...)
+	raw = append(raw, value...)
+	binary.BigEndian.PutUint32(raw, crc32.Checksum(raw[4:], crcTable))
+	return raw
+}
+
+// readRecord reads the next record from r.
+func readRecord(r io.Reader) (*record, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[13:])) +
+		int64(binary.BigEndian.Uint32(header[17:])) +
+		int64(binary.BigEndian.Uint32(header[21:]))
+	raw := make([]byte, headerSize, headerSize+min(n, 1<<20))
+	copy(raw, header)
+	// grow as the data arrives, rather than trust a length that may be torn
+	body := &byteWriter{b: raw}
+	if _, err := io.CopyN(body, r, n); err != nil {
+		return nil, err
+	}
+	return decodeRecord(body.b)
+}
+
+type byteWriter struct{ b []byte }
+
+func (w *byteWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func decodeRecord(raw []byte) (*record, error) {
+	if len(raw) < headerSize || binary.BigEndian.Uint32(raw) != crc32.Checksum(raw[4:], crcTable) {
+		return nil, errCorrupt
+	}
+	keyLen := int(binary.BigEndian.Uint32(raw[13:]))
+	tagsLen := int(binary.BigEndian.Uint32(raw[17:]))
+	valueLen := int(binary.BigEndian.Uint32(raw[21:]))
+	if headerSize+keyLen+tagsLen+valueLen != len(raw) {
+		return nil, errCorrupt
+	}
+	rec := &record{
+		raw:    raw,
+		kind:   raw[4],
+		expire: int64(binary.BigEndian.Uint64(raw[5:])),
+	}
+	b := raw[headerSize:]
+	rec.key, b = string(b[:keyLen]), b[keyLen:]
+	tagBytes, b := b[:tagsLen], b[tagsLen:]
+	rec.value = b
+	for len(tagBytes) > 0 {
+		n, k := binary.Uvarint(tagBytes)
+		if k <= 0 || n > uint64(len(tagBytes)-k) {
+			return nil, errCorrupt
+		}
+		rec.tags = append(rec.tags, string(tagBytes[k:k+int(n)]))
+		tagBytes = tagBytes[k+int(n):]
+	}
+	return rec, nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
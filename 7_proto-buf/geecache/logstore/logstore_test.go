@@ -0,0 +1,182 @@
+package logstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, dir string, opts *Options) *Store {
+	t.Helper()
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func get(t *testing.T, s *Store, key string) (string, bool) {
+	t.Helper()
+	e, ok, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(e.Value), ok
+}
+
+func TestPutGetDelete(t *testing.T) {
+	s := open(t, t.TempDir(), nil)
+	expire := time.Now().Add(time.Hour).Round(0)
+	s.Put("a", Entry{Value: []byte("1")})
+	s.Put("b", Entry{Value: []byte("2"), Expire: expire, Tags: []string{"x", "y"}})
+	s.Put("a", Entry{Value: []byte("3")})
+	s.Put("gone", Entry{Value: []byte("4"), Expire: time.Now().Add(-time.Second)})
+
+	if v, ok := get(t, s, "a"); !ok || v != "3" {
+		t.Fatalf("expected a=3, got %q %v", v, ok)
+	}
+	e, ok, err := s.Get("b")
+	if err != nil || !ok || !e.Expire.Equal(expire) || !reflect.DeepEqual(e.Tags, []string{"x", "y"}) {
+		t.Fatalf("expected b with its expiry and tags, got %+v %v %v", e, ok, err)
+	}
+	if _, ok := get(t, s, "gone"); ok {
+		t.Fatal("expected an expired entry to be missed")
+	}
+
+	s.Delete("a")
+	if _, ok := get(t, s, "a"); ok {
+		t.Fatal("expected a to be deleted")
+	}
+	s.Put("c", Entry{Value: []byte("5"), Tags: []string{"y"}})
+	s.Put("d", Entry{Value: []byte("6")})
+	s.DeleteFunc(func(key string, tags []string) bool {
+		return len(tags) > 0 && tags[len(tags)-1] == "y"
+	})
+	if st := s.Stats(); st.Items != 1 {
+		t.Fatalf("expected only d left, got %+v", st)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "d" {
+		t.Fatalf("expected the keys to be d, got %v", keys)
+	}
+	if _, ok := get(t, s, "d"); !ok {
+		t.Fatal("expected d to be kept")
+	}
+}
+
+func TestClear(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir, &Options{MaxBytes: 4 << 20, SegmentBytes: 1 << 20})
+	value := make([]byte, 100<<10)
+	for i := 0; i < 30; i++ {
+		s.Put(fmt.Sprintf("key%d", i), Entry{Value: value})
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); st.Items != 0 || st.Bytes != 0 || st.Segments != 1 {
+		t.Fatalf("expected an empty store, got %+v", st)
+	}
+	s.Put("after", Entry{Value: []byte("1")})
+	s.Close()
+
+	s = open(t, dir, nil)
+	if st := s.Stats(); st.Items != 1 {
+		t.Fatalf("expected only the entry put after Clear, got %+v", st)
+	}
+	if _, ok := get(t, s, "key0"); ok {
+		t.Fatal("expected key0 to stay cleared after a reopen")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", Entry{Value: []byte("1")})
+	s.Put("b", Entry{Value: []byte("2")})
+	s.Delete("a")
+	s.Put("c", Entry{Value: []byte("3")})
+	s.Close()
+
+	// tear the last record, as a crash in the middle of a write would
+	path := filepath.Join(dir, fmt.Sprintf("%016x.seg", 1))
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, dir, nil)
+	if _, ok := get(t, s, "a"); ok {
+		t.Fatal("expected a to stay deleted")
+	}
+	if v, ok := get(t, s, "b"); !ok || v != "2" {
+		t.Fatalf("expected b=2, got %q %v", v, ok)
+	}
+	if _, ok := get(t, s, "c"); ok {
+		t.Fatal("expected the torn c to be dropped")
+	}
+	// the torn tail was cut off, so new records are readable after a reopen
+	s.Put("d", Entry{Value: []byte("4")})
+	s.Close()
+	s = open(t, dir, nil)
+	if v, ok := get(t, s, "d"); !ok || v != "4" {
+		t.Fatalf("expected d=4 after a reopen, got %q %v", v, ok)
+	}
+}
+
+func TestBudgetAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	value := []byte(strings.Repeat("v", 100))
+	// room for about four records a segment, and four segments
+	s := open(t, dir, &Options{MaxBytes: 2000, SegmentBytes: 500})
+
+	for i := 0; i < 40; i++ {
+		s.Put(fmt.Sprintf("key%d", i), Entry{Value: value})
+		if st := s.Stats(); st.Bytes > 2000 {
+			t.Fatalf("over budget after %d puts: %+v", i, st)
+		}
+	}
+	if _, ok := get(t, s, "key0"); ok {
+		t.Fatal("expected the oldest keys to be dropped")
+	}
+	if _, ok := get(t, s, "key39"); !ok {
+		t.Fatal("expected the newest key to be kept")
+	}
+
+	// overwriting one key over and over leaves dead records that
+	// compaction reclaims, without losing the other keys
+	s.Put("keep", Entry{Value: []byte("kept")})
+	for i := 0; i < 100; i++ {
+		s.Put("hot", Entry{Value: value})
+	}
+	if v, ok := get(t, s, "keep"); !ok || v != "kept" {
+		t.Fatalf("expected keep to survive compaction, got %q %v", v, ok)
+	}
+	st := s.Stats()
+	if st.LiveBytes*2 < st.Bytes-500 {
+		t.Fatalf("expected dead records to be reclaimed, got %+v", st)
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if int64(len(names)) != st.Segments {
+		t.Fatalf("expected %d segment files, found %d", st.Segments, len(names))
+	}
+	s.Close()
+	s = open(t, dir, &Options{MaxBytes: 2000, SegmentBytes: 500})
+	if v, ok := get(t, s, "keep"); !ok || v != "kept" {
+		t.Fatalf("expected keep after a reopen, got %q %v", v, ok)
+	}
+	if _, ok := get(t, s, "key0"); ok {
+		t.Fatal("expected dropped keys to stay dropped after a reopen")
+	}
+	if got := s.Stats(); got.Items != st.Items {
+		t.Fatalf("expected %d items after a reopen, got %+v", st.Items, got)
+	}
+}
@@ -59,21 +59,54 @@ func (c *Cache) Get(key string) (value Value, ok bool) {
 	return
 }
 
+// Peek looks up a key's value without marking it as recently used.
+func (c *Cache) Peek(key string) (value Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		return ele.Value.(*entry).value, true
+	}
+	return
+}
+
+// Remove removes the provided key from the cache.
+func (c *Cache) Remove(key string) {
+	if ele, ok := c.cache[key]; ok {
+		c.removeElement(ele)
+	}
+}
+
 // RemoveOldest removes the oldest item
 func (c *Cache) RemoveOldest() {
 	ele := c.ll.Back()
 	if ele != nil {
-		c.ll.Remove(ele)
-		kv := ele.Value.(*entry)
-		delete(c.cache, kv.key)
-		c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
-		}
+		c.removeElement(ele)
 	}
 }
 
+func (c *Cache) removeElement(ele *list.Element) {
+	c.ll.Remove(ele)
+	kv := ele.Value.(*entry)
+	delete(c.cache, kv.key)
+	c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
+	}
+}
+
+// Keys returns the keys in the cache from most to least recently used.
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, c.ll.Len())
+	for ele := c.ll.Front(); ele != nil; ele = ele.Next() {
+		keys = append(keys, ele.Value.(*entry).key)
+	}
+	return keys
+}
+
 // Len the number of cache entries
 func (c *Cache) Len() int {
 	return c.ll.Len()
 }
+
+// Bytes returns the bytes taken by the cache's keys and values.
+func (c *Cache) Bytes() int64 {
+	return c.nbytes
+}
@@ -63,3 +63,38 @@ func TestAdd(t *testing.T) {
 		t.Fatal("expected 6 but got", lru.nbytes)
 	}
 }
+
+func TestRemove(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key1", String("1234"))
+	lru.Add("key2", String("5678"))
+	lru.Remove("key1")
+
+	if _, ok := lru.Get("key1"); ok || lru.Len() != 1 {
+		t.Fatalf("Remove key1 failed")
+	}
+	if lru.nbytes != int64(len("key2")+len("5678")) {
+		t.Fatal("expected 8 but got", lru.nbytes)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key1", String("1"))
+	lru.Add("key2", String("2"))
+	lru.Add("key3", String("3"))
+	lru.Get("key1")
+
+	expect := []string{"key1", "key3", "key2"}
+	if keys := lru.Keys(); !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("expected keys %s, got %s", expect, keys)
+	}
+
+	// Peek doesn't change the order
+	if v, ok := lru.Peek("key2"); !ok || string(v.(String)) != "2" {
+		t.Fatalf("cache hit key2=2 failed")
+	}
+	if keys := lru.Keys(); !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("expected keys %s after Peek, got %s", expect, keys)
+	}
+}
@@ -0,0 +1,531 @@
+// Package memcache serves geecache groups to memcached clients over the
+// memcached text protocol, including its meta commands.
+package memcache
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"Dcache/7_proto-buf/geecache/internal/server"
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxKeyLen = 250
+	// exptimes up to 30 days are relative, as in memcached; larger ones
+	// are Unix times
+	maxRelativeExptime = 60 * 60 * 24 * 30
+	maxValueLen        = 1 << 20
+)
+
+// Server maps memcached commands onto geecache groups: get, gets, set,
+// delete and touch, and the meta commands mg, ms, md and mn. Reads go
+// through Group.Get, so a key missing from the cache is loaded by the
+// group's Getter; exptimes become the expiry of the value set.
+//
+// geecache keeps no client flags with its values. Every item is returned
+// with Flags, and storing an item with other flags is refused rather than
+// losing them.
+//
+// Clients aren't authenticated, so a Server should only be reachable by
+// clients that may read and write every group it serves.
+type Server struct {
+	// Group is the name of the group keys belong to.
+	Group string
+
+	// Separator, if not empty, lets a key name its group: with ":", the
+	// key "scores:Tom" is Tom in the group scores. A key whose prefix
+	// isn't a group belongs to Group.
+	Separator string
+
+	// Flags are the client flags of every item.
+	Flags uint32
+}
+
+// ListenAndServe listens on the TCP address addr and serves memcached
+// clients.
+func (s *Server) ListenAndServe(addr string) error {
+	return server.ListenAndServe(addr, s.Serve)
+}
+
+// Serve serves memcached clients on connections accepted from l. It
+// returns when l fails, e.g. because it was closed.
+func (s *Server) Serve(l net.Listener) error {
+	return server.Serve(l, s.serveConn)
+}
+
+// clientError and serverError are answered with CLIENT_ERROR and
+// SERVER_ERROR. Any other error closes the connection.
+type (
+	clientError string
+	serverError string
+)
+
+func (e clientError) Error() string { return string(e) }
+func (e serverError) Error() string { return string(e) }
+
+type conn struct {
+	s *Server
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{s: s, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else if quit, err := c.do(fields); err != nil {
+			var ce clientError
+			var se serverError
+			switch {
+			case errors.As(err, &ce):
+				c.w.WriteString("CLIENT_ERROR " + ce.Error() + "\r\n")
+			case errors.As(err, &se):
+				c.w.WriteString("SERVER_ERROR " + se.Error() + "\r\n")
+			default:
+				return
+			}
+		} else if quit {
+			return
+		}
+		// let a pipelined batch of commands be answered in one write
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// do runs a command and writes its reply. It reports whether the client
+// asked to close the connection.
+func (c *conn) do(fields []string) (quit bool, err error) {
+	args := fields[1:]
+	switch fields[0] {
+	case "get", "gets":
+		if len(args) == 0 {
+			break
+		}
+		for _, key := range args {
+			if err := checkKey(key); err != nil {
+				return false, err
+			}
+		}
+		for _, key := range args {
+			if v, ok := c.get(key); ok {
+				c.value(key, v, fields[0] == "gets")
+			}
+		}
+		c.w.WriteString("END\r\n")
+		return false, nil
+	case "set":
+		return false, c.set(args)
+	case "delete":
+		return false, c.delete(args)
+	case "touch":
+		return false, c.touch(args)
+	case "mg":
+		return false, c.metaGet(args)
+	case "ms":
+		return false, c.metaSet(args)
+	case "md":
+		return false, c.metaDelete(args)
+	case "mn":
+		c.w.WriteString("MN\r\n")
+		return false, nil
+	case "version":
+		c.w.WriteString("VERSION geecache\r\n")
+		return false, nil
+	case "quit":
+		return true, nil
+	}
+	c.w.WriteString("ERROR\r\n")
+	return false, nil
+}
+
+// group returns the group key belongs to and the key within it.
+func (c *conn) group(key string) (*geecache.Group, string, error) {
+	if g, key, ok := server.Group(key, c.s.Separator, c.s.Group); ok {
+		return g, key, nil
+	}
+	return nil, "", errors.New("no group for key " + key)
+}
+
+// get loads key through its group. A key that can't be loaded is treated
+// as missing.
+func (c *conn) get(key string) (geecache.ByteView, bool) {
+	g, key, err := c.group(key)
+	if err != nil {
+		return geecache.ByteView{}, false
+	}
+	v, err := g.Get(key)
+	if err != nil {
+		log.Println("[GeeCache] memcache: get", key, err)
+		return geecache.ByteView{}, false
+	}
+	return v, true
+}
+
+// value writes a VALUE line and the data block for v.
+func (c *conn) value(key string, v geecache.ByteView, withCas bool) {
+	b := v.ByteSlice()
+	fmt.Fprintf(c.w, "VALUE %s %d %d", key, c.s.Flags, len(b))
+	if withCas {
+		fmt.Fprintf(c.w, " %d", cas(v))
+	}
+	c.w.WriteString("\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+// cas is the item's "unique" value for gets. geecache has no versions, so
+// it is a hash of the value: it changes whenever the value does.
+func cas(v geecache.ByteView) uint64 {
+	h := fnv.New64a()
+	h.Write(v.ByteSlice())
+	return h.Sum64()
+}
+
+// set handles set <key> <flags> <exptime> <bytes> [noreply].
+func (c *conn) set(args []string) error {
+	if len(args) != 4 && (len(args) != 5 || args[4] != "noreply") {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	n, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || n < 0 {
+		return clientError("bad command line format")
+	}
+	data, err := c.data(n)
+	if err != nil {
+		return err
+	}
+	if err := checkKey(args[0]); err != nil {
+		return err
+	}
+	if err := c.store(args[0], uint32(flags), expireAt(exptime), data); err != nil {
+		return err
+	}
+	if len(args) == 4 {
+		c.w.WriteString("STORED\r\n")
+	}
+	return nil
+}
+
+// data reads a data block of n bytes and its CRLF.
+func (c *conn) data(n int) ([]byte, error) {
+	if n > maxValueLen {
+		// swallow the block so the connection stays in sync
+		if _, err := c.r.Discard(n + 2); err != nil {
+			return nil, err
+		}
+		return nil, clientError("object too large for cache")
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[n:]) != "\r\n" {
+		// drop the rest of the oversized block's line, as memcached does
+		if buf[n+1] != '\n' {
+			if _, err := c.r.ReadString('\n'); err != nil {
+				return nil, err
+			}
+		}
+		return nil, clientError("bad data chunk")
+	}
+	return buf[:n], nil
+}
+
+// store sets key to data until expire.
+func (c *conn) store(key string, flags uint32, expire time.Time, data []byte) error {
+	if flags != c.s.Flags {
+		return clientError(fmt.Sprintf("flags must be %d", c.s.Flags))
+	}
+	g, key, err := c.group(key)
+	if err != nil {
+		return clientError(err.Error())
+	}
+	if !expire.IsZero() && !expire.After(time.Now()) {
+		// already expired, as with a negative exptime
+		_, err = g.Remove(key)
+	} else {
+		err = g.SetExpire(key, data, expire)
+	}
+	if err != nil {
+		return serverError(err.Error())
+	}
+	return nil
+}
+
+// delete handles delete <key> [noreply].
+func (c *conn) delete(args []string) error {
+	if len(args) != 1 && (len(args) != 2 || args[1] != "noreply") {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	if err := checkKey(args[0]); err != nil {
+		return err
+	}
+	reply := "DELETED"
+	if !c.remove(args[0]) {
+		reply = "NOT_FOUND"
+	}
+	if len(args) == 1 {
+		c.w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// remove removes key from its group and reports whether it was cached.
+func (c *conn) remove(key string) bool {
+	g, key, err := c.group(key)
+	if err != nil {
+		return false
+	}
+	removed, err := g.Remove(key)
+	if err != nil {
+		log.Println("[GeeCache] memcache: delete", key, err)
+		return false
+	}
+	return removed
+}
+
+// touch handles touch <key> <exptime> [noreply].
+func (c *conn) touch(args []string) error {
+	if len(args) != 2 && (len(args) != 3 || args[2] != "noreply") {
+		c.w.WriteString("ERROR\r\n")
+		return nil
+	}
+	if err := checkKey(args[0]); err != nil {
+		return err
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return clientError("invalid exptime argument")
+	}
+	touched, err := c.retouch(args[0], expireAt(exptime))
+	if err != nil {
+		return err
+	}
+	reply := "NOT_FOUND"
+	if touched {
+		reply = "TOUCHED"
+	}
+	if len(args) == 2 {
+		c.w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// retouch changes the expiry of key where it is cached, and reports
+// whether it was. A key that isn't cached isn't loaded.
+func (c *conn) retouch(key string, expire time.Time) (bool, error) {
+	g, key, err := c.group(key)
+	if err != nil {
+		return false, nil
+	}
+	touched, err := g.Touch(key, expire)
+	if err != nil {
+		log.Println("[GeeCache] memcache: touch", key, err)
+		return false, serverError(err.Error())
+	}
+	return touched, nil
+}
+
+// metaFlags are the flags of a meta command. Flags that take a token,
+// such as T30, map to the token; the others map to "".
+type metaFlags map[byte]string
+
+func parseMetaFlags(args []string) (metaFlags, error) {
+	flags := make(metaFlags, len(args))
+	for _, arg := range args {
+		if arg == "" || arg[0] < 'A' || arg[0] > 'z' {
+			return nil, clientError("invalid flag")
+		}
+		flags[arg[0]] = arg[1:]
+	}
+	return flags, nil
+}
+
+func (f metaFlags) has(flag byte) bool {
+	_, ok := f[flag]
+	return ok
+}
+
+// echo writes the flags that are returned as they were sent: the opaque
+// token and, with k, the key.
+func (f metaFlags) echo(w *bufio.Writer, key string) {
+	if f.has('O') {
+		w.WriteString(" O" + f['O'])
+	}
+	if f.has('k') {
+		w.WriteString(" k" + key)
+	}
+}
+
+// metaGet handles mg <key> <flags>*.
+func (c *conn) metaGet(args []string) error {
+	if len(args) == 0 {
+		return clientError("bad command line format")
+	}
+	key := args[0]
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	flags, err := parseMetaFlags(args[1:])
+	if err != nil {
+		return err
+	}
+	v, ok := c.get(key)
+	if !ok {
+		if !flags.has('q') {
+			c.w.WriteString("EN\r\n")
+		}
+		return nil
+	}
+	b := v.ByteSlice()
+	if flags.has('v') {
+		fmt.Fprintf(c.w, "VA %d", len(b))
+	} else {
+		c.w.WriteString("HD")
+	}
+	if flags.has('f') {
+		fmt.Fprintf(c.w, " f%d", c.s.Flags)
+	}
+	if flags.has('s') {
+		fmt.Fprintf(c.w, " s%d", len(b))
+	}
+	if flags.has('c') {
+		fmt.Fprintf(c.w, " c%d", cas(v))
+	}
+	if flags.has('t') {
+		ttl := int64(-1)
+		if e := v.Expire(); !e.IsZero() {
+			ttl = int64((time.Until(e) + time.Second/2) / time.Second)
+		}
+		fmt.Fprintf(c.w, " t%d", ttl)
+	}
+	flags.echo(c.w, key)
+	c.w.WriteString("\r\n")
+	if flags.has('v') {
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	return nil
+}
+
+// metaSet handles ms <key> <datalen> <flags>*.
+func (c *conn) metaSet(args []string) error {
+	if len(args) < 2 {
+		return clientError("bad command line format")
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		return clientError("bad data chunk")
+	}
+	data, err := c.data(n)
+	if err != nil {
+		return err
+	}
+	key := args[0]
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	flags, err := parseMetaFlags(args[2:])
+	if err != nil {
+		return err
+	}
+	if mode, ok := flags['M']; ok && mode != "S" && mode != "s" {
+		return clientError("only set mode is supported")
+	}
+	var clientFlags uint64
+	if flags.has('F') {
+		if clientFlags, err = strconv.ParseUint(flags['F'], 10, 32); err != nil {
+			return clientError("bad token in command line format")
+		}
+	}
+	var exptime int64
+	if flags.has('T') {
+		if exptime, err = strconv.ParseInt(flags['T'], 10, 64); err != nil {
+			return clientError("bad token in command line format")
+		}
+	}
+	if err := c.store(key, uint32(clientFlags), expireAt(exptime), data); err != nil {
+		return err
+	}
+	if !flags.has('q') {
+		c.w.WriteString("HD")
+		flags.echo(c.w, key)
+		c.w.WriteString("\r\n")
+	}
+	return nil
+}
+
+// metaDelete handles md <key> <flags>*.
+func (c *conn) metaDelete(args []string) error {
+	if len(args) == 0 {
+		return clientError("bad command line format")
+	}
+	key := args[0]
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	flags, err := parseMetaFlags(args[1:])
+	if err != nil {
+		return err
+	}
+	reply := "HD"
+	if !c.remove(key) {
+		reply = "NF"
+	}
+	if flags.has('q') {
+		return nil
+	}
+	c.w.WriteString(reply)
+	flags.echo(c.w, key)
+	c.w.WriteString("\r\n")
+	return nil
+}
+
+// expireAt converts a memcached exptime to an expiry: 0 never expires,
+// up to 30 days is relative to now, anything else is a Unix time.
+func expireAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Unix(1, 0)
+	case exptime <= maxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+func checkKey(key string) error {
+	if len(key) > maxKeyLen {
+		return clientError("bad command line format")
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return clientError("bad command line format")
+		}
+	}
+	return nil
+}
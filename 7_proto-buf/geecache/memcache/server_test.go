@@ -0,0 +1,143 @@
+package memcache
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var db = map[string]string{
+	"Tom":  "630",
+	"Jack": "589",
+	"Sam":  "567",
+}
+
+func newServer(t *testing.T) string {
+	t.Helper()
+	for _, name := range []string{"mc-scores", "mc-names"} {
+		name := name
+		geecache.NewGroup(name, 2<<10, geecache.GetterFunc(
+			func(key string) ([]byte, error) {
+				if v, ok := db[key]; ok {
+					return []byte(name + "/" + v), nil
+				}
+				return nil, fmt.Errorf("%s not exist", key)
+			}))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &Server{Group: "mc-scores", Separator: ":"}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// session sends raw protocol text and checks the raw replies.
+type session struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *session {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &session{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// expect sends req and checks that the reply is exactly want.
+func (s *session) expect(req, want string) {
+	s.t.Helper()
+	if _, err := io.WriteString(s.conn, req); err != nil {
+		s.t.Fatal(err)
+	}
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(s.r, got); err != nil {
+		s.t.Fatalf("%q: expected %q, got %q, %v", req, want, got, err)
+	}
+	if string(got) != want {
+		s.t.Fatalf("%q: expected %q, got %q", req, want, got)
+	}
+}
+
+func TestText(t *testing.T) {
+	s := dial(t, newServer(t))
+
+	s.expect("version\r\n", "VERSION geecache\r\n")
+	s.expect("get Tom\r\n", "VALUE Tom 0 13\r\nmc-scores/630\r\nEND\r\n")
+	s.expect("get mc-names:Sam nobody Jack\r\n",
+		"VALUE mc-names:Sam 0 12\r\nmc-names/567\r\nVALUE Jack 0 13\r\nmc-scores/589\r\nEND\r\n")
+	s.expect("get nobody\r\n", "END\r\n")
+	s.expect(fmt.Sprintf("gets Tom\r\n"), fmt.Sprintf("VALUE Tom 0 13 %d\r\nmc-scores/630\r\nEND\r\n",
+		cas(mustGet(t, "mc-scores", "Tom"))))
+
+	s.expect("set Kim 0 0 5\r\nhello\r\n", "STORED\r\n")
+	s.expect("get Kim\r\n", "VALUE Kim 0 5\r\nhello\r\nEND\r\n")
+	s.expect("set Kim 0 0 2 noreply\r\nhi\r\nget Kim\r\n", "VALUE Kim 0 2\r\nhi\r\nEND\r\n")
+	s.expect("delete Kim\r\n", "DELETED\r\n")
+	s.expect("get Kim\r\n", "END\r\n")
+	s.expect("delete Kim\r\n", "NOT_FOUND\r\n")
+
+	s.expect("set Ann 0 100 1\r\nx\r\n", "STORED\r\n")
+	s.expect("touch Ann 1\r\n", "TOUCHED\r\n")
+	s.expect("touch nobody 1\r\n", "NOT_FOUND\r\n")
+	// a key the Getter could load isn't loaded just to be touched
+	s.expect("touch mc-names:Tom 100\r\n", "NOT_FOUND\r\n")
+	time.Sleep(time.Second)
+	s.expect("get Ann\r\n", "END\r\n")
+	s.expect("set Ann 0 -1 1\r\nx\r\nget Ann\r\n", "STORED\r\nEND\r\n")
+
+	s.expect("set Kim 3 0 1\r\nx\r\n", "CLIENT_ERROR flags must be 0\r\n")
+	s.expect("set Kim 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	s.expect("set Kim 0 0\r\n", "ERROR\r\n")
+	s.expect("get "+strings.Repeat("k", 251)+"\r\n", "CLIENT_ERROR bad command line format\r\n")
+	s.expect("flush_all\r\n", "ERROR\r\n")
+}
+
+func TestMeta(t *testing.T) {
+	s := dial(t, newServer(t))
+
+	s.expect("mg Tom v\r\n", "VA 13\r\nmc-scores/630\r\n")
+	s.expect("mg Tom s f t k Oabc\r\n", "HD f0 s13 t-1 Oabc kTom\r\n")
+	s.expect("mg nobody v\r\n", "EN\r\n")
+	s.expect("mg nobody v q\r\nmn\r\n", "MN\r\n")
+
+	s.expect("ms Kim 5 T100\r\nhello\r\n", "HD\r\n")
+	s.expect("mg Kim v t\r\n", "VA 5 t100\r\nhello\r\n")
+	s.expect("ms Kim 2 q\r\nhi\r\nmg Kim v\r\n", "VA 2\r\nhi\r\n")
+	s.expect("ms Kim 1 F7\r\nx\r\n", "CLIENT_ERROR flags must be 0\r\n")
+	s.expect("ms Kim 1 MA\r\nx\r\n", "CLIENT_ERROR only set mode is supported\r\n")
+	s.expect("md Kim O1\r\n", "HD O1\r\n")
+	s.expect("md Kim q\r\nmn\r\n", "MN\r\n")
+	s.expect("mg Kim v\r\n", "EN\r\n")
+}
+
+func TestQuit(t *testing.T) {
+	s := dial(t, newServer(t))
+	s.expect("quit\r\n", "")
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := s.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+}
+
+func mustGet(t *testing.T, group, key string) geecache.ByteView {
+	t.Helper()
+	v, err := geecache.GetGroup(group).Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -1,6 +1,10 @@
 package geecache
 
-import pb "Dcache/7_proto-buf/geecache/geecachepb"
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"context"
+	"time"
+)
 
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
@@ -8,7 +12,70 @@ type PeerPicker interface {
 	PickPeer(key string) (peer PeerGetter, ok bool)
 }
 
+// PeerLister is implemented by a PeerPicker that can list every remote
+// peer, for requests that must reach all of them.
+type PeerLister interface {
+	AllPeers() []PeerGetter
+}
+
+// PeerBroadcaster is implemented by a PeerPicker that can tell every node
+// to drop its copy of a key.
+type PeerBroadcaster interface {
+	Broadcast(group, key string)
+}
+
 // PeerGetter is the interface that must be implemented by a peer.
 type PeerGetter interface {
 	Get(in *pb.Request, out *pb.Response) error
 }
+
+// PeerContextGetter is implemented by a PeerGetter whose fetches can be
+// cancelled.
+type PeerContextGetter interface {
+	GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error
+}
+
+// PeerWatcher is implemented by a PeerPicker whose set of peers can
+// change at runtime. Watch registers fn to be called after every change.
+type PeerWatcher interface {
+	Watch(fn func())
+}
+
+// PeerWarmer is implemented by a PeerGetter that can ask the remote peer
+// to keep a key warm on our behalf.
+type PeerWarmer interface {
+	KeepWarm(group, key string, interval time.Duration) error
+}
+
+// PeerSetter is implemented by a PeerGetter that can store a value in the
+// remote peer's cache. The entry's value is compressed and encrypted as
+// its Compression and KeyId say.
+type PeerSetter interface {
+	Set(group string, e *pb.Entry) error
+}
+
+// PeerToucher is implemented by a PeerGetter that can change the expiry
+// of a key cached by the remote peer.
+type PeerToucher interface {
+	Touch(group, key string, expire time.Time) (bool, error)
+}
+
+// PeerRemover is implemented by a PeerGetter that can remove a key from
+// the remote peer's cache. It reports whether the key was cached.
+type PeerRemover interface {
+	Remove(group, key string) (bool, error)
+}
+
+// PeerLeaser is implemented by a PeerGetter that can fill a key on the
+// remote peer under a lease handed out by a lease Get.
+type PeerLeaser interface {
+	LeaseSet(group string, token uint64, e *pb.Entry) error
+}
+
+// PeerInvalidator is implemented by a PeerGetter that can invalidate
+// entries in bulk on the remote peer.
+type PeerInvalidator interface {
+	InvalidateAll(group string, generation uint64) error
+	InvalidateTag(group, tag string) error
+	InvalidatePrefix(group, prefix string) error
+}
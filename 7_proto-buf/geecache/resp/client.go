@@ -0,0 +1,49 @@
+package resp
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+)
+
+// Client is a minimal RESP2 client, enough to talk to a Server.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Dial connects to the server at the TCP address addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, nil for a nil reply, an int64 or a []interface{}. An error
+// reply is returned as an Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		c.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	v, err := readValue(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(Error); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
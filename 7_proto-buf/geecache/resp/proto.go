@@ -0,0 +1,202 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBulkLen caps the size of a bulk string, as Redis does by default.
+	maxBulkLen = 512 << 20
+	// maxArrayLen caps the number of elements in an array.
+	maxArrayLen = 1 << 20
+	// maxDepth caps how deeply arrays in a reply may nest.
+	maxDepth = 32
+	// maxLineLen caps a line, and so an inline command, as Redis does.
+	maxLineLen = 64 << 10
+)
+
+var (
+	errProtocol = errors.New("resp: protocol error")
+	errTooLong  = errors.New("resp: protocol error: line too long")
+)
+
+// Error is an error reply.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// readLine reads a line terminated by CRLF, without the terminator. It
+// fails on lines longer than maxLineLen rather than buffering them.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(line)+len(b) > maxLineLen {
+			return "", errTooLong
+		}
+		line = append(line, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// readValue reads one value: a string for simple and bulk strings, nil
+// for a nil bulk string or array, an int64, an Error or a []interface{}.
+func readValue(r *bufio.Reader) (interface{}, error) {
+	return readNested(r, 0)
+}
+
+// readNested reads a value nested in depth arrays.
+func readNested(r *bufio.Reader, depth int) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errProtocol
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		return readBulk(r, line)
+	case '*':
+		n, err := arrayLen(line)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		if depth >= maxDepth {
+			return nil, errProtocol
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readNested(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errProtocol
+}
+
+// readBulk reads the body of a bulk string whose header line is line.
+func readBulk(r *bufio.Reader, line string) (interface{}, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 || n > maxBulkLen {
+		return nil, errProtocol
+	}
+	if n == -1 {
+		return nil, nil
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[n:]) != "\r\n" {
+		return nil, errProtocol
+	}
+	return string(buf[:n]), nil
+}
+
+// arrayLen parses the header line of an array.
+func arrayLen(line string) (int, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 || n > maxArrayLen {
+		return 0, errProtocol
+	}
+	return n, nil
+}
+
+// readCommand reads a command sent as an array of bulk strings, or as an
+// inline command separated by spaces.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := arrayLen(line)
+	if err != nil {
+		return nil, err
+	}
+	// a command is flat: every element must be a bulk string, so nothing
+	// nested is read before it is refused
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || line[0] != '$' {
+			return nil, errProtocol
+		}
+		v, err := readBulk(r, line)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, errProtocol
+		}
+		args = append(args, s)
+	}
+	return args, nil
+}
+
+// writer writes replies.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(format string, v ...interface{}) {
+	w.WriteString("-" + fmt.Sprintf(format, v...) + "\r\n")
+}
+
+func (w writer) int(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) nil() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,254 @@
+// Package resp serves geecache groups to Redis clients over RESP2, the
+// Redis serialization protocol.
+package resp
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"Dcache/7_proto-buf/geecache/internal/server"
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server maps a subset of Redis commands onto geecache groups: GET, MGET,
+// SET, DEL, EXISTS, TTL, PING and SELECT. Reads go through Group.Get, so
+// a key missing from the cache is loaded by the group's Getter.
+//
+// Clients aren't authenticated, so a Server should only be reachable by
+// clients that may read and write every group it serves.
+type Server struct {
+	// DBs maps the database numbers clients SELECT to group names.
+	// Connections start on database 0.
+	DBs map[int]string
+
+	// Separator, if not empty, lets a key name its group: with ":", the
+	// key "scores:Tom" is Tom in the group scores. A key whose prefix
+	// isn't a group belongs to the selected database's group.
+	Separator string
+}
+
+// ListenAndServe listens on the TCP address addr and serves Redis
+// clients.
+func (s *Server) ListenAndServe(addr string) error {
+	return server.ListenAndServe(addr, s.Serve)
+}
+
+// Serve serves Redis clients on connections accepted from l. It returns
+// when l fails, e.g. because it was closed.
+func (s *Server) Serve(l net.Listener) error {
+	return server.Serve(l, s.serveConn)
+}
+
+// conn is the state of one client connection.
+type conn struct {
+	s  *Server
+	db int
+	w  writer
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	c := &conn{s: s, w: writer{bufio.NewWriter(nc)}}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				c.w.error("ERR %v", err)
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.do(args)
+		// let a pipelined batch of commands be answered in one write
+		if r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// do runs a command and writes its reply. It reports whether the client
+// asked to close the connection.
+func (c *conn) do(args []string) (quit bool) {
+	cmd := strings.ToUpper(args[0])
+	arity, ok := arities[cmd]
+	if !ok {
+		c.w.error("ERR unknown command '%s'", args[0])
+		return false
+	}
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		c.w.error("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+		return false
+	}
+	args = args[1:]
+
+	switch cmd {
+	case "PING":
+		switch len(args) {
+		case 0:
+			c.w.simple("PONG")
+		case 1:
+			c.w.bulk([]byte(args[0]))
+		default:
+			c.w.error("ERR wrong number of arguments for 'ping' command")
+		}
+	case "QUIT":
+		c.w.simple("OK")
+		return true
+	case "COMMAND":
+		// clients such as redis-cli ask for the command table on
+		// connect; an empty one makes them fall back to defaults
+		c.w.array(0)
+	case "SELECT":
+		db, err := strconv.Atoi(args[0])
+		if err != nil {
+			c.w.error("ERR value is not an integer or out of range")
+		} else if _, ok := c.s.DBs[db]; !ok {
+			c.w.error("ERR DB index is out of range")
+		} else {
+			c.db = db
+			c.w.simple("OK")
+		}
+	case "GET":
+		c.get(args[0])
+	case "MGET":
+		c.w.array(len(args))
+		for _, key := range args {
+			c.get(key)
+		}
+	case "SET":
+		c.set(args)
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			g, key, err := c.group(key)
+			if err != nil {
+				continue
+			}
+			// only the keys that were cached count
+			if removed, err := g.Remove(key); err == nil && removed {
+				n++
+			}
+		}
+		c.w.int(int64(n))
+	case "EXISTS":
+		n := 0
+		for _, key := range args {
+			if _, ok := c.view(key); ok {
+				n++
+			}
+		}
+		c.w.int(int64(n))
+	case "TTL":
+		c.ttl(args[0])
+	}
+	return false
+}
+
+// arities are the numbers of arguments of each command, counting its
+// name. A negative arity is a minimum, as in Redis' command table.
+var arities = map[string]int{
+	"PING":    -1,
+	"QUIT":    1,
+	"COMMAND": -1,
+	"SELECT":  2,
+	"GET":     2,
+	"MGET":    -2,
+	"SET":     -3,
+	"DEL":     -2,
+	"EXISTS":  -2,
+	"TTL":     2,
+}
+
+// group returns the group key belongs to and the key within it.
+func (c *conn) group(key string) (*geecache.Group, string, error) {
+	if g, key, ok := server.Group(key, c.s.Separator, c.s.DBs[c.db]); ok {
+		return g, key, nil
+	}
+	return nil, "", Error("ERR no group for key " + key)
+}
+
+// view gets key through its group. A key that can't be loaded is treated
+// as missing, as Redis clients expect.
+func (c *conn) view(key string) (geecache.ByteView, bool) {
+	g, key, err := c.group(key)
+	if err != nil {
+		return geecache.ByteView{}, false
+	}
+	v, err := g.Get(key)
+	if err != nil {
+		log.Println("[GeeCache] resp: get", key, err)
+		return geecache.ByteView{}, false
+	}
+	return v, true
+}
+
+func (c *conn) get(key string) {
+	if v, ok := c.view(key); ok {
+		c.w.bulk(v.ByteSlice())
+	} else {
+		c.w.nil()
+	}
+}
+
+// set handles SET key value [EX seconds | PX milliseconds].
+func (c *conn) set(args []string) {
+	g, key, err := c.group(args[0])
+	if err != nil {
+		c.w.error("%v", err)
+		return
+	}
+	var expire time.Time
+	opts := args[2:]
+	for len(opts) > 0 {
+		unit := time.Duration(0)
+		switch strings.ToUpper(opts[0]) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		}
+		if unit == 0 || len(opts) < 2 || !expire.IsZero() {
+			c.w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(opts[1], 10, 64)
+		if err != nil || n <= 0 {
+			c.w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		expire = time.Now().Add(time.Duration(n) * unit)
+		opts = opts[2:]
+	}
+	if err := g.SetExpire(key, []byte(args[1]), expire); err != nil {
+		c.w.error("ERR %v", err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+// ttl replies with the seconds key has left, -1 if it doesn't expire and
+// -2 if it doesn't exist.
+func (c *conn) ttl(key string) {
+	v, ok := c.view(key)
+	switch {
+	case !ok:
+		c.w.int(-2)
+	case v.Expire().IsZero():
+		c.w.int(-1)
+	default:
+		c.w.int(int64((time.Until(v.Expire()) + time.Second/2) / time.Second))
+	}
+}
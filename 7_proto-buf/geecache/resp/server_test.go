@@ -0,0 +1,150 @@
+package resp
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var db = map[string]string{
+	"Tom":  "630",
+	"Jack": "589",
+	"Sam":  "567",
+}
+
+func newServer(t *testing.T) string {
+	t.Helper()
+	for _, name := range []string{"resp-scores", "resp-names"} {
+		name := name
+		geecache.NewGroup(name, 2<<10, geecache.GetterFunc(
+			func(key string) ([]byte, error) {
+				if v, ok := db[key]; ok {
+					return []byte(name + "/" + v), nil
+				}
+				return nil, fmt.Errorf("%s not exist", key)
+			}))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &Server{DBs: map[int]string{0: "resp-scores", 1: "resp-names"}, Separator: ":"}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *Client {
+	t.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServer(t *testing.T) {
+	c := dial(t, newServer(t))
+
+	tests := []struct {
+		args []string
+		want interface{}
+		err  string
+	}{
+		{[]string{"PING"}, "PONG", ""},
+		{[]string{"ping", "hi"}, "hi", ""},
+		{[]string{"GET", "Tom"}, "resp-scores/630", ""},
+		{[]string{"GET", "resp-names:Tom"}, "resp-names/630", ""},
+		{[]string{"GET", "nobody"}, nil, ""},
+		{[]string{"MGET", "Tom", "nobody", "Sam"}, []interface{}{"resp-scores/630", nil, "resp-scores/567"}, ""},
+		{[]string{"EXISTS", "Tom", "Jack", "nobody"}, int64(2), ""},
+		{[]string{"TTL", "Tom"}, int64(-1), ""},
+		{[]string{"TTL", "nobody"}, int64(-2), ""},
+		{[]string{"SET", "Kim", "1"}, "OK", ""},
+		{[]string{"GET", "Kim"}, "1", ""},
+		{[]string{"SET", "Ann", "2", "EX", "100"}, "OK", ""},
+		{[]string{"TTL", "Ann"}, int64(100), ""},
+		{[]string{"DEL", "Kim", "Ann"}, int64(2), ""},
+		{[]string{"GET", "Kim"}, nil, ""},
+		{[]string{"DEL", "Kim", "nobody"}, int64(0), ""},
+		{[]string{"SELECT", "1"}, "OK", ""},
+		{[]string{"GET", "Jack"}, "resp-names/589", ""},
+		{[]string{"SELECT", "7"}, nil, "ERR DB index is out of range"},
+		{[]string{"SET", "k", "v", "NX"}, nil, "ERR syntax error"},
+		{[]string{"SET", "k", "v", "PX", "0"}, nil, "ERR invalid expire time in 'set' command"},
+		{[]string{"GET"}, nil, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, nil, "ERR unknown command 'FLUSHALL'"},
+	}
+	for _, tt := range tests {
+		got, err := c.Do(tt.args...)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%v: expected error %q, got %v, %v", tt.args, tt.err, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %#v, got %#v, %v", tt.args, tt.want, got, err)
+		}
+	}
+}
+
+func TestServerExpiry(t *testing.T) {
+	c := dial(t, newServer(t))
+	if _, err := c.Do("SET", "Tom", "temp", "PX", "50"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Do("GET", "Tom"); err != nil || v != "temp" {
+		t.Fatalf("expected temp, got %v, %v", v, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if v, err := c.Do("GET", "Tom"); err != nil || v != "resp-scores/630" {
+		t.Fatalf("expected the value to be loaded again, got %v, %v", v, err)
+	}
+}
+
+func TestServerPipelineAndInline(t *testing.T) {
+	addr := newServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// two commands in one write, the second inline as telnet would send it
+	fmt.Fprint(conn, "*2\r\n$3\r\nGET\r\n$3\r\nSam\r\nPING\r\nQUIT\r\n")
+	r := bufio.NewReader(conn)
+	for _, want := range []interface{}{"resp-scores/567", "PONG", "OK"} {
+		if v, err := readValue(r); err != nil || v != want {
+			t.Fatalf("expected %v, got %v, %v", want, v, err)
+		}
+	}
+	if _, err := readValue(r); err == nil {
+		t.Fatal("expected the server to close the connection after QUIT")
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	for name, in := range map[string]string{
+		"huge array":   "*2000000\r\n",
+		"nested array": "*2\r\n$3\r\nGET\r\n*1\r\n$3\r\nSam\r\n",
+		"long inline":  strings.Repeat("a", maxLineLen+1) + "\r\n",
+	} {
+		if _, err := readCommand(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	deep := strings.Repeat("*1\r\n", maxDepth+1) + ":1\r\n"
+	if _, err := readValue(bufio.NewReader(strings.NewReader(deep))); err == nil {
+		t.Error("expected a reply nested too deeply to be refused")
+	}
+	args, err := readCommand(bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nSam\r\n")))
+	if err != nil || len(args) != 2 || args[1] != "Sam" {
+		t.Fatalf("expected GET Sam, got %v, %v", args, err)
+	}
+}
@@ -0,0 +1,151 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// An Op is a kind of operation on a group.
+type Op string
+
+const (
+	OpRead       Op = "read"       // get keys
+	OpWrite      Op = "write"      // set keys
+	OpInvalidate Op = "invalidate" // delete keys, invalidate tags and prefixes
+	OpAdmin      Op = "admin"      // everything, and the group's stats
+)
+
+// ACL maps API tokens to the groups they may use and the operations they
+// may run on them. It is loaded from a JSON file of the form
+//
+//	{"tokens": [
+//	  {"name": "team-a", "token": "...", "groups": {"scores": ["read", "write"]}},
+//	  {"name": "ops", "token": "...", "groups": {"*": ["admin"]}}
+//	]}
+//
+// where the group "*" stands for every group. Clients present their token
+// as "Authorization: Bearer <token>".
+type ACL struct {
+	path   string
+	mu     sync.RWMutex
+	grants map[[sha256.Size]byte]grant // by token hash
+}
+
+type grant struct {
+	name   string
+	groups map[string]map[Op]bool
+}
+
+// LoadACL reads the ACL in the file at path.
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the file again. On error the ACL loaded before is kept.
+func (a *ACL) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Tokens []struct {
+			Name   string          `json:"name"`
+			Token  string          `json:"token"`
+			Groups map[string][]Op `json:"groups"`
+		} `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing %s: %v", a.path, err)
+	}
+	grants := make(map[[sha256.Size]byte]grant, len(file.Tokens))
+	for _, t := range file.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("%s: token %q is empty", a.path, t.Name)
+		}
+		g := grant{name: t.Name, groups: make(map[string]map[Op]bool)}
+		for group, ops := range t.Groups {
+			g.groups[group] = make(map[Op]bool)
+			for _, op := range ops {
+				switch op {
+				case OpRead, OpWrite, OpInvalidate, OpAdmin:
+					g.groups[group][op] = true
+				default:
+					return fmt.Errorf("%s: unknown operation %q for %s", a.path, op, t.Name)
+				}
+			}
+		}
+		grants[sha256.Sum256([]byte(t.Token))] = g
+	}
+	a.mu.Lock()
+	a.grants = grants
+	a.mu.Unlock()
+	return nil
+}
+
+// lookup returns the grant of the token r presents.
+func (a *ACL) lookup(r *http.Request) (grant, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return grant{}, false
+	}
+	// looking the hash up keeps the comparison from leaking the token
+	sum := sha256.Sum256([]byte(token))
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	g, ok := a.grants[sum]
+	return g, ok
+}
+
+// allows reports whether g may run op on group.
+func (g grant) allows(group string, op Op) bool {
+	for _, name := range []string{group, "*"} {
+		if ops := g.groups[name]; ops[op] || ops[OpAdmin] {
+			return true
+		}
+	}
+	return false
+}
+
+// any reports whether g may run any operation on group.
+func (g grant) any(group string) bool {
+	return len(g.groups[group]) > 0 || len(g.groups["*"]) > 0
+}
+
+// authorize checks that the request may run op on group, and answers it
+// with an error if not. Without an ACL every request is allowed.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, group string, op Op) bool {
+	if s.ACL == nil {
+		return true
+	}
+	g, ok := s.ACL.lookup(r)
+	if !ok {
+		audit(r, "", group, op)
+		writeError(w, errorf(http.StatusUnauthorized, "unauthorized", "a valid API token is required"))
+		return false
+	}
+	if !g.allows(group, op) {
+		audit(r, g.name, group, op)
+		writeError(w, errorf(http.StatusForbidden, "forbidden", "%s may not %s group %s", g.name, op, group))
+		return false
+	}
+	return true
+}
+
+// audit logs a denied request.
+func audit(r *http.Request, name, group string, op Op) {
+	if name == "" {
+		name = "(no valid token)"
+	}
+	log.Printf("[GeeCache] audit: denied %s on group %q to %s from %s (%s %s)",
+		op, group, name, r.RemoteAddr, r.Method, r.URL.Path)
+}
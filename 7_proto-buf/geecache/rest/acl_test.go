@@ -0,0 +1,137 @@
+package rest
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testACL = `{"tokens": [
+	{"name": "team-a", "token": "a-secret", "groups": {"rest-scores": ["read", "write"]}},
+	{"name": "ops", "token": "ops-secret", "groups": {"*": ["admin"]}}
+]}`
+
+func writeACL(t *testing.T, path, acl string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(acl), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// doAs sends a request with token and returns the status code.
+func doAs(t *testing.T, token, method, url, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	writeACL(t, path, testACL)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newServer(t, &Server{ACL: acl})
+	geecache.NewGroup("rest-other", 2<<10, geecache.GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	scores := ts.URL + "/v1/groups/rest-scores"
+	other := ts.URL + "/v1/groups/rest-other"
+	tests := []struct {
+		token, method, url, body string
+		want                     int
+	}{
+		{"", "GET", scores + "/keys/Tom", "", 401},
+		{"wrong", "GET", scores + "/keys/Tom", "", 401},
+		{"a-secret", "GET", scores + "/keys/Tom", "", 200},
+		{"a-secret", "POST", scores + "/batch", `{"keys": ["Tom"]}`, 200},
+		{"a-secret", "PUT", scores + "/keys/Kim", `{"value": "aGk="}`, 204},
+		{"a-secret", "DELETE", scores + "/keys/Kim", "", 403},
+		{"a-secret", "POST", scores + "/invalidate", `{"all": true}`, 403},
+		{"a-secret", "GET", scores + "/stats", "", 403},
+		{"a-secret", "GET", other + "/keys/Tom", "", 403},
+		{"a-secret", "GET", ts.URL + "/v1/groups/nobody/keys/Tom", "", 403},
+		{"ops-secret", "GET", other + "/keys/Tom", "", 200},
+		{"ops-secret", "GET", scores + "/stats", "", 200},
+		{"ops-secret", "DELETE", scores + "/keys/Kim", "", 204},
+		{"ops-secret", "POST", scores + "/invalidate", `{"prefix": "K"}`, 204},
+		{"ops-secret", "POST", scores + "/invalidate", `{"tag": "t", "all": true}`, 400},
+	}
+	for _, tt := range tests {
+		if got := doAs(t, tt.token, tt.method, tt.url, tt.body); got != tt.want {
+			t.Errorf("%s %s as %q: expected %d, got %d", tt.method, tt.url, tt.token, tt.want, got)
+		}
+	}
+	if n := strings.Count(logs.String(), "audit: denied"); n != 7 {
+		t.Fatalf("expected 7 denials to be logged, got %d:\n%s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), `audit: denied invalidate on group "rest-scores" to team-a`) {
+		t.Fatalf("expected the denial to name the token, got:\n%s", logs.String())
+	}
+}
+
+func TestACLListAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	writeACL(t, path, testACL)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newServer(t, &Server{ACL: acl})
+
+	status, v := doList(t, ts.URL, "a-secret")
+	if groups := v["groups"].([]interface{}); status != 200 || len(groups) != 1 || groups[0] != "rest-scores" {
+		t.Fatalf("expected team-a to see rest-scores only, got %d %v", status, v)
+	}
+
+	// team-a loses write and gains invalidate; a broken file is ignored
+	writeACL(t, path, `{"tokens": [{"name": "team-a", "token": "a-secret", "groups": {"rest-scores": ["read", "invalidate"]}}]}`)
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	writeACL(t, path, `{"tokens": [{"name": "team-a", "token": "a-secret", "groups": {"rest-scores": ["delete"]}}]}`)
+	if err := acl.Reload(); err == nil {
+		t.Fatal("expected an unknown operation to be refused")
+	}
+	keys := ts.URL + "/v1/groups/rest-scores/keys/"
+	if got := doAs(t, "a-secret", "PUT", keys+"Kim", `{"value": "aGk="}`); got != 403 {
+		t.Fatalf("expected write to be revoked, got %d", got)
+	}
+	if got := doAs(t, "a-secret", "DELETE", keys+"Kim", ""); got != 204 {
+		t.Fatalf("expected invalidate to be granted, got %d", got)
+	}
+	if got := doAs(t, "ops-secret", "GET", keys+"Tom", ""); got != 401 {
+		t.Fatalf("expected the removed token to be refused, got %d", got)
+	}
+}
+
+func doList(t *testing.T, url, token string) (int, map[string]interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+"/v1/groups", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doRequest(t, req)
+}
@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Limit is a token bucket: Rate requests a second on average, in
+// bursts of up to Burst.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// limiter keeps a token bucket per identity.
+type limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens from the bucket of id. If there aren't enough, it
+// returns how long until there will be.
+func (l *limiter) take(lim Limit, id string, n int) (bool, time.Duration) {
+	if lim.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(max(lim.Burst, 1))
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[id] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+	l.prune(now, burst/lim.Rate)
+
+	// a request larger than the burst takes a full bucket
+	if need := math.Min(float64(n), burst); b.tokens < need {
+		return false, time.Duration((need - b.tokens) / lim.Rate * float64(time.Second))
+	}
+	b.tokens -= math.Min(float64(n), burst)
+	return true, 0
+}
+
+// prune drops the buckets that have refilled, about every refill
+// seconds, so that identities seen once don't pile up.
+func (l *limiter) prune(now time.Time, refill float64) {
+	period := time.Duration(refill * float64(time.Second))
+	if now.Sub(l.lastPrune) < period {
+		return
+	}
+	for id, b := range l.buckets {
+		if now.Sub(b.last) >= period {
+			delete(l.buckets, id)
+		}
+	}
+	l.lastPrune = now
+}
+
+// client returns the identity a request is rate limited under: the name
+// of its API token, or else its IP address.
+func (s *Server) client(r *http.Request) string {
+	if s.ACL != nil {
+		if g, ok := s.ACL.lookup(r); ok {
+			return "token:" + g.name
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// charge takes n requests' worth from the buckets of the client and, if
+// not empty, of group. If either is short, it answers the request with
+// 429 and returns false.
+func (s *Server) charge(w http.ResponseWriter, r *http.Request, group string, n int) bool {
+	ok, wait := s.clients.take(s.ClientLimit, s.client(r), n)
+	if ok && group != "" {
+		ok, wait = s.groups.take(s.GroupLimit, group, n)
+	}
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, errorf(http.StatusTooManyRequests, "rate_limited", "rate limit exceeded, retry in %v", wait.Round(time.Millisecond)))
+	return false
+}
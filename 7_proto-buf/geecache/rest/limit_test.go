@@ -0,0 +1,97 @@
+package rest
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	writeACL(t, path, testACL)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newServer(t, &Server{ACL: acl, ClientLimit: Limit{Rate: 10, Burst: 2}})
+	tom := ts.URL + "/v1/groups/rest-scores/keys/Tom"
+
+	for i, want := range []int{200, 200, 429} {
+		if got := doAs(t, "a-secret", "GET", tom, ""); got != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, got)
+		}
+	}
+	// each token has its own bucket
+	if got := doAs(t, "ops-secret", "GET", tom, ""); got != 200 {
+		t.Fatalf("expected another client to get through, got %d", got)
+	}
+
+	req, _ := http.NewRequest("GET", tom, nil)
+	req.Header.Set("Authorization", "Bearer a-secret")
+	status, v := doRequest(t, req)
+	if status != 429 || errorCode(v) != "rate_limited" {
+		t.Fatalf("expected 429, got %d %v", status, v)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := doAs(t, "a-secret", "GET", tom, ""); got != 200 {
+		t.Fatalf("expected the bucket to refill, got %d", got)
+	}
+}
+
+func TestGroupRateLimit(t *testing.T) {
+	ts := newServer(t, &Server{GroupLimit: Limit{Rate: 1, Burst: 3}})
+	group := ts.URL + "/v1/groups/rest-scores"
+
+	// a batch counts once per key
+	if status, v := do(t, "POST", group+"/batch", "application/json", `{"keys": ["Tom", "Sam"]}`); status != 200 {
+		t.Fatalf("expected 200, got %d %v", status, v)
+	}
+	if status, _ := do(t, "GET", group+"/keys/Tom", "", ""); status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	req, _ := http.NewRequest("GET", group+"/keys/Tom", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 429 || res.Header.Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	// other groups aren't limited by this one's bucket
+	if status, _ := do(t, "GET", ts.URL+"/v1/groups", "", ""); status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+}
+
+func TestOverloadedGroup(t *testing.T) {
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	g := geecache.NewGroup("rest-overloaded", 2<<10, geecache.GetterFunc(
+		func(key string) ([]byte, error) {
+			started <- struct{}{}
+			<-unblock
+			return []byte(key), nil
+		}))
+	g.SetLoadLimit(geecache.LoadLimit{MaxConcurrent: 1, MaxQueue: -1})
+	ts := newServer(t, &Server{})
+	keys := ts.URL + "/v1/groups/rest-overloaded/keys/"
+
+	done := make(chan int)
+	go func() {
+		status, _ := do(t, "GET", keys+"a", "", "")
+		done <- status
+	}()
+	<-started
+	req, _ := http.NewRequest("GET", keys+"b", nil)
+	status, v := doRequest(t, req)
+	if status != 503 || errorCode(v) != "overloaded" {
+		t.Fatalf("expected 503, got %d %v", status, v)
+	}
+	close(unblock)
+	if status := <-done; status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+}
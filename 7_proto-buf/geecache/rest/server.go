@@ -0,0 +1,490 @@
+// Package rest serves geecache groups over a JSON/REST API.
+//
+//	GET    /v1/groups                    names of the groups
+//	GET    /v1/groups/{group}/stats      the group's counters
+//	POST   /v1/groups/{group}/batch      get the keys of {"keys": [...]}
+//	GET    /v1/groups/{group}/keys/{key} get key
+//	PUT    /v1/groups/{group}/keys/{key} set key
+//	DELETE /v1/groups/{group}/keys/{key} remove key
+//	POST   /v1/groups/{group}/invalidate invalidate {"tag": ...},
+//	                                     {"prefix": ...} or {"all": true}
+//
+// Values travel in JSON envelopes, base64 encoded by default. With
+// ?encoding=raw they are JSON strings instead, if they are valid UTF-8.
+// Errors are {"error": {"code": ..., "message": ...}} with a matching
+// status code.
+//
+// With an ACL, requests need a token that allows them, see ACL.
+package rest
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxValueBytes = 1 << 20
+	defaultMaxBatchKeys  = 100
+)
+
+// Server is an http.Handler for the API.
+type Server struct {
+	// MaxValueBytes is the largest value PUT accepts, 1MB if zero.
+	MaxValueBytes int64
+
+	// MaxBatchKeys is the most keys a batch get accepts, 100 if zero.
+	MaxBatchKeys int
+
+	// Timeout, if not zero, bounds each request's fetches from peers.
+	Timeout time.Duration
+
+	// ACL, if set, restricts the groups and operations each API token
+	// may use. Without it every request is allowed.
+	ACL *ACL
+
+	// ClientLimit and GroupLimit rate limit requests per client, i.e. per
+	// API token or else per IP address, and per group. A batch get counts
+	// once per key. Requests over the limit get 429. A zero Limit doesn't
+	// limit.
+	ClientLimit Limit
+	GroupLimit  Limit
+
+	clients limiter
+	groups  limiter
+
+	once sync.Once
+	mux  *http.ServeMux
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.once.Do(func() {
+		s.mux = http.NewServeMux()
+		s.mux.HandleFunc("GET /v1/groups", s.listGroups)
+		s.mux.HandleFunc("GET /v1/groups/{group}/stats", s.stats)
+		s.mux.HandleFunc("POST /v1/groups/{group}/batch", s.batchGet)
+		s.mux.HandleFunc("GET /v1/groups/{group}/keys/{key...}", s.get)
+		s.mux.HandleFunc("PUT /v1/groups/{group}/keys/{key...}", s.set)
+		s.mux.HandleFunc("DELETE /v1/groups/{group}/keys/{key...}", s.remove)
+		s.mux.HandleFunc("POST /v1/groups/{group}/invalidate", s.invalidate)
+		s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, errorf(http.StatusNotFound, "not_found", "no route for %s %s", r.Method, r.URL.Path))
+		})
+	})
+	if s.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) maxValueBytes() int64 {
+	if s.MaxValueBytes > 0 {
+		return s.MaxValueBytes
+	}
+	return defaultMaxValueBytes
+}
+
+func (s *Server) maxBatchKeys() int {
+	if s.MaxBatchKeys > 0 {
+		return s.MaxBatchKeys
+	}
+	return defaultMaxBatchKeys
+}
+
+// Entry is the envelope of a value.
+type Entry struct {
+	Key      string     `json:"key"`
+	Value    string     `json:"value"`
+	Encoding string     `json:"encoding,omitempty"` // "base64" or "raw"
+	Expire   *time.Time `json:"expire,omitempty"`
+	Error    *Error     `json:"error,omitempty"` // for batch gets only
+}
+
+// Error is the body of an error response.
+type Error struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func errorf(status int, code, format string, a ...interface{}) *Error {
+	return &Error{status: status, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// getError converts an error from Group.Get into an Error.
+func getError(err error) *Error {
+	switch {
+	case errors.Is(err, geecache.ErrNotFound):
+		return errorf(http.StatusNotFound, "not_found", "%v", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorf(http.StatusGatewayTimeout, "timeout", "%v", err)
+	case errors.Is(err, geecache.ErrOverloaded):
+		return errorf(http.StatusServiceUnavailable, "overloaded", "%v", err)
+	}
+	log.Println("[GeeCache] rest:", err)
+	return errorf(http.StatusInternalServerError, "internal", "%v", err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, e *Error) {
+	if e.status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, e.status, struct {
+		Error *Error `json:"error"`
+	}{e})
+}
+
+// group checks that the request may run op on the group named in the
+// path, and returns the group. If it can't, it answers the request with an
+// error and returns nil.
+func (s *Server) group(w http.ResponseWriter, r *http.Request, op Op) *geecache.Group {
+	if !s.authorize(w, r, r.PathValue("group"), op) || !s.charge(w, r, r.PathValue("group"), 1) {
+		return nil
+	}
+	g, e := lookupGroup(r)
+	if e != nil {
+		writeError(w, e)
+	}
+	return g
+}
+
+// lookupGroup returns the group named in the path.
+func lookupGroup(r *http.Request) (*geecache.Group, *Error) {
+	name := r.PathValue("group")
+	if g := geecache.GetGroup(name); g != nil {
+		return g, nil
+	}
+	return nil, errorf(http.StatusNotFound, "group_not_found", "no such group: %s", name)
+}
+
+// pathKey returns the key named in the path.
+func pathKey(r *http.Request) (string, *Error) {
+	if key := r.PathValue("key"); key != "" {
+		return key, nil
+	}
+	return "", errorf(http.StatusBadRequest, "bad_request", "key is required")
+}
+
+// encoding returns the value encoding asked for by ?encoding=.
+func encoding(r *http.Request) (string, *Error) {
+	switch enc := r.URL.Query().Get("encoding"); enc {
+	case "", "base64":
+		return "base64", nil
+	case "raw":
+		return "raw", nil
+	default:
+		return "", errorf(http.StatusBadRequest, "bad_request", "unknown encoding %q", enc)
+	}
+}
+
+// newEntry wraps v. A raw value that isn't valid UTF-8 falls back to
+// base64, since JSON strings can't hold it.
+func newEntry(key string, v geecache.ByteView, enc string) Entry {
+	e := Entry{Key: key, Encoding: enc}
+	if b := v.ByteSlice(); enc == "raw" && utf8.Valid(b) {
+		e.Value = string(b)
+	} else {
+		e.Encoding = "base64"
+		e.Value = base64.StdEncoding.EncodeToString(b)
+	}
+	if t := v.Expire(); !t.IsZero() {
+		e.Expire = &t
+	}
+	return e
+}
+
+// listGroups lists the groups the request's token may use.
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request) {
+	if !s.charge(w, r, "", 1) {
+		return
+	}
+	names := geecache.GroupNames()
+	if s.ACL != nil {
+		g, ok := s.ACL.lookup(r)
+		if !ok {
+			audit(r, "", "*", OpRead)
+			writeError(w, errorf(http.StatusUnauthorized, "unauthorized", "a valid API token is required"))
+			return
+		}
+		var allowed []string
+		for _, name := range names {
+			if g.any(name) {
+				allowed = append(allowed, name)
+			}
+		}
+		names = allowed
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Groups []string `json:"groups"`
+	}{names})
+}
+
+type cacheStats struct {
+	Bytes int64 `json:"bytes"`
+	Items int64 `json:"items"`
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r, OpAdmin)
+	if g == nil {
+		return
+	}
+	st := g.Stats()
+	writeJSON(w, http.StatusOK, struct {
+		Group         string     `json:"group"`
+		Gets          int64      `json:"gets"`
+		CacheHits     int64      `json:"cache_hits"`
+		L2Hits        int64      `json:"l2_hits"`
+		Loads         int64      `json:"loads"`
+		PeerLoads     int64      `json:"peer_loads"`
+		PeerErrors    int64      `json:"peer_errors"`
+		LocalLoads    int64      `json:"local_loads"`
+		LocalLoadErrs int64      `json:"local_load_errs"`
+		LoadsRejected int64      `json:"loads_rejected"`
+		HedgedLoads   int64      `json:"hedged_loads"`
+		MainCache     cacheStats `json:"main_cache"`
+		HotCache      cacheStats `json:"hot_cache"`
+		L2            cacheStats `json:"l2"`
+	}{
+		g.Name(), st.Gets, st.CacheHits, st.L2Hits, st.Loads, st.PeerLoads, st.PeerErrors,
+		st.LocalLoads, st.LocalLoadErrs, st.LoadsRejected, st.HedgedLoads,
+		cacheStats(st.MainCache), cacheStats(st.HotCache), cacheStats(st.L2),
+	})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r, OpRead)
+	if g == nil {
+		return
+	}
+	enc, e := encoding(r)
+	if e != nil {
+		writeError(w, e)
+		return
+	}
+	key, e := pathKey(r)
+	if e != nil {
+		writeError(w, e)
+		return
+	}
+	v, err := g.GetContext(r.Context(), key)
+	if err != nil {
+		writeError(w, getError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newEntry(key, v, enc))
+}
+
+func (s *Server) batchGet(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r, OpRead)
+	if g == nil {
+		return
+	}
+	enc, e := encoding(r)
+	if e != nil {
+		writeError(w, e)
+		return
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if e := s.decode(w, r, &req); e != nil {
+		writeError(w, e)
+		return
+	}
+	if len(req.Keys) > s.maxBatchKeys() {
+		writeError(w, errorf(http.StatusRequestEntityTooLarge, "too_large",
+			"%d keys, at most %d are allowed", len(req.Keys), s.maxBatchKeys()))
+		return
+	}
+	// the request itself was charged for one key
+	if len(req.Keys) > 1 && !s.charge(w, r, g.Name(), len(req.Keys)-1) {
+		return
+	}
+
+	// fetch the keys concurrently, each may have to be loaded
+	entries := make([]Entry, len(req.Keys))
+	var wg sync.WaitGroup
+	for i, key := range req.Keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.GetContext(r.Context(), key)
+			if err != nil {
+				entries[i] = Entry{Key: key, Error: getError(err)}
+				return
+			}
+			entries[i] = newEntry(key, v, enc)
+		}()
+	}
+	wg.Wait()
+	writeJSON(w, http.StatusOK, struct {
+		Entries []Entry `json:"entries"`
+	}{entries})
+}
+
+// decode reads the JSON body of r into v, within the size limit.
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, v interface{}) *Error {
+	// room for the value, base64 encoded, and the rest of the envelope
+	body := http.MaxBytesReader(w, r.Body, s.maxValueBytes()*4/3+64<<10)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return errorf(http.StatusRequestEntityTooLarge, "too_large", "request body too large")
+		}
+		return errorf(http.StatusBadRequest, "bad_request", "bad JSON body: %v", err)
+	}
+	return nil
+}
+
+// set stores the request body as the value of key. A JSON body is an
+// envelope:
+//
+//	{"value": "...", "encoding": "base64", "ttl": "30s", "tags": ["t"]}
+//
+// Any other body is the value itself, with ?ttl= and ?tag= as options.
+func (s *Server) set(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r, OpWrite)
+	if g == nil {
+		return
+	}
+	key, e := pathKey(r)
+	if e != nil {
+		writeError(w, e)
+		return
+	}
+	var req struct {
+		Value    string   `json:"value"`
+		Encoding string   `json:"encoding"`
+		TTL      string   `json:"ttl"`
+		Tags     []string `json:"tags"`
+	}
+	var value []byte
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if e := s.decode(w, r, &req); e != nil {
+			writeError(w, e)
+			return
+		}
+		switch req.Encoding {
+		case "", "base64":
+			b, err := base64.StdEncoding.DecodeString(req.Value)
+			if err != nil {
+				writeError(w, errorf(http.StatusBadRequest, "bad_request", "bad base64 value: %v", err))
+				return
+			}
+			value = b
+		case "raw":
+			value = []byte(req.Value)
+		default:
+			writeError(w, errorf(http.StatusBadRequest, "bad_request", "unknown encoding %q", req.Encoding))
+			return
+		}
+	} else {
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxValueBytes()))
+		if err != nil {
+			writeError(w, errorf(http.StatusRequestEntityTooLarge, "too_large", "request body too large"))
+			return
+		}
+		value = b
+		req.TTL = r.URL.Query().Get("ttl")
+		req.Tags = r.URL.Query()["tag"]
+	}
+	if int64(len(value)) > s.maxValueBytes() {
+		writeError(w, errorf(http.StatusRequestEntityTooLarge, "too_large",
+			"value of %d bytes, at most %d are allowed", len(value), s.maxValueBytes()))
+		return
+	}
+
+	var expire time.Time
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			writeError(w, errorf(http.StatusBadRequest, "bad_request", "bad ttl %q", req.TTL))
+			return
+		}
+		expire = time.Now().Add(ttl)
+	}
+	if err := g.SetExpire(key, value, expire, req.Tags...); err != nil {
+		log.Println("[GeeCache] rest:", err)
+		writeError(w, errorf(http.StatusBadGateway, "set_failed", "%v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r, OpInvalidate)
+	if g == nil {
+		return
+	}
+	key, e := pathKey(r)
+	if e != nil {
+		writeError(w, e)
+		return
+	}
+	if _, err := g.Remove(key); err != nil {
+		log.Println("[GeeCache] rest:", err)
+		writeError(w, errorf(http.StatusBadGateway, "remove_failed", "%v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invalidate drops the entries of a tag or a prefix, or of the whole
+// group, on every peer.
+func (s *Server) invalidate(w http.ResponseWriter, r *http.Request) {
+	g := s.group(w, r, OpInvalidate)
+	if g == nil {
+		return
+	}
+	var req struct {
+		Tag    string `json:"tag"`
+		Prefix string `json:"prefix"`
+		All    bool   `json:"all"`
+	}
+	if e := s.decode(w, r, &req); e != nil {
+		writeError(w, e)
+		return
+	}
+	var err error
+	switch {
+	case req.Tag != "" && req.Prefix == "" && !req.All:
+		err = g.InvalidateTag(req.Tag)
+	case req.Prefix != "" && req.Tag == "" && !req.All:
+		err = g.InvalidatePrefix(req.Prefix)
+	case req.All && req.Tag == "" && req.Prefix == "":
+		err = g.InvalidateAll()
+	default:
+		writeError(w, errorf(http.StatusBadRequest, "bad_request", "one of tag, prefix or all is required"))
+		return
+	}
+	if err != nil {
+		log.Println("[GeeCache] rest:", err)
+		writeError(w, errorf(http.StatusBadGateway, "invalidate_failed", "%v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
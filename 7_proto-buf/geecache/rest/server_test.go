@@ -0,0 +1,175 @@
+package rest
+
+import (
+	"Dcache/7_proto-buf/geecache"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var db = map[string]string{
+	"Tom":  "630",
+	"Jack": "589",
+	"Sam":  "567",
+}
+
+func newServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	geecache.NewGroup("rest-scores", 2<<10, geecache.GetterFunc(
+		func(key string) ([]byte, error) {
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			if key == "broken" {
+				return nil, fmt.Errorf("db is down")
+			}
+			return nil, fmt.Errorf("%s %w", key, geecache.ErrNotFound)
+		}))
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends a request and decodes the JSON reply, if any, into a map.
+func do(t *testing.T, method, url, contentType, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return doRequest(t, req)
+}
+
+// doRequest sends req and decodes the JSON reply, if any, into a map.
+func doRequest(t *testing.T, req *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var v map[string]interface{}
+	if res.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+			t.Fatalf("%s %s: bad JSON reply: %v", req.Method, req.URL, err)
+		}
+	}
+	return res.StatusCode, v
+}
+
+// errorCode returns the code of an error reply.
+func errorCode(v map[string]interface{}) interface{} {
+	e, _ := v["error"].(map[string]interface{})
+	return e["code"]
+}
+
+func TestKeys(t *testing.T) {
+	ts := newServer(t, &Server{})
+	keys := ts.URL + "/v1/groups/rest-scores/keys/"
+
+	if status, v := do(t, "GET", keys+"Tom", "", ""); status != 200 ||
+		v["key"] != "Tom" || v["value"] != "NjMw" || v["encoding"] != "base64" {
+		t.Fatalf("expected Tom in base64, got %d %v", status, v)
+	}
+	if status, v := do(t, "GET", keys+"Tom?encoding=raw", "", ""); status != 200 ||
+		v["value"] != "630" || v["encoding"] != "raw" {
+		t.Fatalf("expected Tom raw, got %d %v", status, v)
+	}
+
+	if status, _ := do(t, "PUT", keys+"a/b?ttl=1m&tag=t", "text/plain", "\xff\x00"); status != 204 {
+		t.Fatalf("expected 204 from PUT, got %d", status)
+	}
+	if status, v := do(t, "GET", keys+"a/b?encoding=raw", "", ""); status != 200 ||
+		v["value"] != "/wA=" || v["encoding"] != "base64" || v["expire"] == nil {
+		t.Fatalf("expected a/b to fall back to base64 with an expiry, got %d %v", status, v)
+	}
+	if status, _ := do(t, "PUT", keys+"Kim", "application/json",
+		`{"value": "hello", "encoding": "raw"}`); status != 204 {
+		t.Fatalf("expected 204 from PUT, got %d", status)
+	}
+	if status, v := do(t, "GET", keys+"Kim?encoding=raw", "", ""); status != 200 || v["value"] != "hello" {
+		t.Fatalf("expected hello, got %d %v", status, v)
+	}
+	if status, _ := do(t, "DELETE", keys+"Kim", "", ""); status != 204 {
+		t.Fatalf("expected 204 from DELETE, got %d", status)
+	}
+
+	tests := []struct {
+		method, path, contentType, body string
+		status                          int
+		code                            string
+	}{
+		{"GET", "/v1/groups/rest-scores/keys/Kim", "", "", 404, "not_found"},
+		{"GET", "/v1/groups/rest-scores/keys/broken", "", "", 500, "internal"},
+		{"GET", "/v1/groups/nobody/keys/Tom", "", "", 404, "group_not_found"},
+		{"GET", "/v1/groups/rest-scores/keys/", "", "", 400, "bad_request"},
+		{"GET", "/v1/groups/rest-scores/keys/Tom?encoding=hex", "", "", 400, "bad_request"},
+		{"PUT", "/v1/groups/rest-scores/keys/Kim?ttl=-1s", "text/plain", "x", 400, "bad_request"},
+		{"PUT", "/v1/groups/rest-scores/keys/Kim", "application/json", `{"value": "!"}`, 400, "bad_request"},
+		{"PUT", "/v1/groups/rest-scores/keys/Kim", "application/json", `{"value"`, 400, "bad_request"},
+		{"GET", "/v2/groups", "", "", 404, "not_found"},
+	}
+	for _, tt := range tests {
+		status, v := do(t, tt.method, ts.URL+tt.path, tt.contentType, tt.body)
+		if status != tt.status || errorCode(v) != tt.code {
+			t.Errorf("%s %s: expected %d %s, got %d %v", tt.method, tt.path, tt.status, tt.code, status, v)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ts := newServer(t, &Server{MaxValueBytes: 8, MaxBatchKeys: 2})
+	group := ts.URL + "/v1/groups/rest-scores"
+
+	if status, v := do(t, "PUT", group+"/keys/Kim", "text/plain", "123456789"); status != 413 {
+		t.Fatalf("expected 413, got %d %v", status, v)
+	}
+	if status, v := do(t, "PUT", group+"/keys/Kim", "application/json",
+		`{"value": "MTIzNDU2Nzg5"}`); status != 413 || errorCode(v) != "too_large" {
+		t.Fatalf("expected 413, got %d %v", status, v)
+	}
+	if status, v := do(t, "POST", group+"/batch", "application/json",
+		`{"keys": ["Tom", "Sam", "Jack"]}`); status != 413 || errorCode(v) != "too_large" {
+		t.Fatalf("expected 413, got %d %v", status, v)
+	}
+}
+
+func TestBatchGroupsAndStats(t *testing.T) {
+	ts := newServer(t, &Server{})
+	group := ts.URL + "/v1/groups/rest-scores"
+
+	status, v := do(t, "POST", group+"/batch?encoding=raw", "application/json", `{"keys": ["Tom", "nobody"]}`)
+	entries, _ := v["entries"].([]interface{})
+	if status != 200 || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d %v", status, v)
+	}
+	if e := entries[0].(map[string]interface{}); e["key"] != "Tom" || e["value"] != "630" || e["error"] != nil {
+		t.Fatalf("expected Tom, got %v", e)
+	}
+	if e := entries[1].(map[string]interface{}); e["key"] != "nobody" || errorCode(e) != "not_found" {
+		t.Fatalf("expected nobody not to be found, got %v", e)
+	}
+
+	status, v = do(t, "GET", ts.URL+"/v1/groups", "", "")
+	found := false
+	for _, name := range v["groups"].([]interface{}) {
+		found = found || name == "rest-scores"
+	}
+	if status != 200 || !found {
+		t.Fatalf("expected rest-scores to be listed, got %d %v", status, v)
+	}
+
+	status, v = do(t, "GET", group+"/stats", "", "")
+	if status != 200 || v["group"] != "rest-scores" || v["gets"].(float64) < 2 {
+		t.Fatalf("expected the group's stats, got %d %v", status, v)
+	}
+	if _, ok := v["main_cache"].(map[string]interface{})["bytes"]; !ok {
+		t.Fatalf("expected the main cache's size, got %v", v)
+	}
+}
@@ -0,0 +1,264 @@
+package geecache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSignatureWindow = time.Minute
+
+	headerKeyID     = "X-Geecache-Key"
+	headerTimestamp = "X-Geecache-Timestamp"
+	headerNonce     = "X-Geecache-Nonce"
+	headerSignature = "X-Geecache-Signature"
+)
+
+// PeerKeys are shared secrets that peers sign their requests with: an
+// HMAC-SHA256 over the method, path, query, timestamp, a nonce and the
+// body. A request is accepted if it is signed with any of the keys, its
+// timestamp is within Window of the local clock and its signature hasn't
+// been seen before.
+//
+// To rotate a secret without downtime, add the new key to every node,
+// then sign with it everywhere, then remove the old one.
+type PeerKeys struct {
+	// Keys maps key IDs to secrets.
+	Keys map[string][]byte
+
+	// SignWith is the ID of the key outgoing requests are signed with.
+	SignWith string
+
+	// Enforce rejects unsigned requests. Without it they are accepted,
+	// so that signing can be rolled out node by node; requests with a
+	// bad signature are always rejected.
+	Enforce bool
+
+	// Window is how far a request's timestamp may be from the local
+	// clock. If blank, it defaults to 1m.
+	Window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // signatures until they leave the window
+	lastPrune time.Time
+}
+
+// SetKeys replaces the keys and the key signed with, e.g. after the file
+// they come from changed.
+func (k *PeerKeys) SetKeys(keys map[string][]byte, signWith string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.Keys, k.SignWith = keys, signWith
+}
+
+func (k *PeerKeys) window() time.Duration {
+	if k.Window > 0 {
+		return k.Window
+	}
+	return defaultSignatureWindow
+}
+
+// signature returns the signature of a request, in hex.
+func signature(secret []byte, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, uri, timestamp, nonce, sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signed is what a signature is sent with.
+type signed struct {
+	id, timestamp, nonce, sig string
+}
+
+// newSignature signs a request for uri, whose body is body.
+func (k *PeerKeys) newSignature(method, uri string, body []byte) (signed, error) {
+	k.mu.Lock()
+	id := k.SignWith
+	secret, ok := k.Keys[id]
+	k.mu.Unlock()
+	if !ok {
+		return signed{}, fmt.Errorf("no peer key %q to sign with", id)
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return signed{}, err
+	}
+	s := signed{id: id, timestamp: strconv.FormatInt(time.Now().UnixNano(), 10), nonce: hex.EncodeToString(b[:])}
+	s.sig = signature(secret, method, uri, s.timestamp, s.nonce, body)
+	return s, nil
+}
+
+// sign adds the signature headers to req, whose body is body.
+func (k *PeerKeys) sign(req *http.Request, body []byte) error {
+	s, err := k.newSignature(req.Method, req.URL.RequestURI(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerKeyID, s.id)
+	req.Header.Set(headerTimestamp, s.timestamp)
+	req.Header.Set(headerNonce, s.nonce)
+	req.Header.Set(headerSignature, s.sig)
+	return nil
+}
+
+var errUnsigned = errors.New("request is not signed")
+
+// verify checks the signature of r, whose body is body.
+func (k *PeerKeys) verify(r *http.Request, body []byte) error {
+	s := signed{
+		id:        r.Header.Get(headerKeyID),
+		timestamp: r.Header.Get(headerTimestamp),
+		nonce:     r.Header.Get(headerNonce),
+		sig:       r.Header.Get(headerSignature),
+	}
+	if s.sig == "" {
+		if k.Enforce {
+			return errUnsigned
+		}
+		return nil
+	}
+	return k.check(s, r.Method, r.RequestURI, body)
+}
+
+// check checks a signature of a request for uri, whose body is body, and
+// that it hasn't been seen before.
+func (k *PeerKeys) check(s signed, method, uri string, body []byte) error {
+	k.mu.Lock()
+	secret, ok := k.Keys[s.id]
+	k.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown peer key %q", s.id)
+	}
+
+	ns, err := strconv.ParseInt(s.timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q", s.timestamp)
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(0, ns)); d > k.window() || d < -k.window() {
+		return fmt.Errorf("timestamp is %v off", d.Round(time.Millisecond))
+	}
+	want := signature(secret, method, uri, s.timestamp, s.nonce, body)
+	if !hmac.Equal([]byte(s.sig), []byte(want)) {
+		return errors.New("bad signature")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.seen[s.sig]; ok {
+		return errors.New("replayed request")
+	}
+	if k.seen == nil {
+		k.seen = make(map[string]time.Time)
+	}
+	// a signature can't be replayed once its timestamp leaves the window
+	k.seen[s.sig] = time.Unix(0, ns).Add(k.window())
+	if now.Sub(k.lastPrune) > k.window() {
+		for sig, until := range k.seen {
+			if now.After(until) {
+				delete(k.seen, sig)
+			}
+		}
+		k.lastPrune = now
+	}
+	return nil
+}
+
+// messageMethod stands in for the method of requests in the signatures
+// of messages, so that neither can be replayed as the other.
+const messageMethod = "MESSAGE"
+
+// SignMessage signs msg, e.g. a gossip message or the address a TCP peer
+// connection is opened to, prefixing it with a line of the key ID,
+// timestamp, nonce and signature. It lets them share the keys the peers
+// sign their requests with.
+func (k *PeerKeys) SignMessage(msg []byte) ([]byte, error) {
+	s, err := k.newSignature(messageMethod, "", msg)
+	if err != nil {
+		return nil, err
+	}
+	b := fmt.Appendf(nil, "%s %s %s %s\n", s.id, s.timestamp, s.nonce, s.sig)
+	return append(b, msg...), nil
+}
+
+// VerifyMessage checks a message signed by SignMessage and returns it
+// without its signature. Like requests, messages are accepted unsigned
+// unless Enforce is set; they are told apart by their first byte, which
+// is '{' for the JSON of an unsigned gossip message.
+func (k *PeerKeys) VerifyMessage(b []byte) ([]byte, error) {
+	if len(b) > 0 && b[0] == '{' {
+		if k.Enforce {
+			return nil, errors.New("message is not signed")
+		}
+		return b, nil
+	}
+	line, msg, ok := bytes.Cut(b, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if !ok || len(fields) != 4 {
+		return nil, errors.New("malformed signature")
+	}
+	s := signed{id: fields[0], timestamp: fields[1], nonce: fields[2], sig: fields[3]}
+	if err := k.check(s, messageMethod, "", msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// signingTransport signs every request it sends with keys.
+type signingTransport struct {
+	keys *PeerKeys
+	base http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a RoundTripper mustn't modify the request it is given
+	req = req.Clone(req.Context())
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err := t.keys.sign(req, body); err != nil {
+		return nil, err
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// verifySignature checks the signature of r if the pool has PeerKeys,
+// leaving r's body to be read again. ServeHTTP caps the body at
+// MaxBodyBytes before it is read whole here.
+func (p *HTTPPool) verifySignature(r *http.Request) error {
+	if p.opts.Keys == nil {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return p.opts.Keys.verify(r, body)
+}
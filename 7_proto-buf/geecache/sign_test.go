@@ -0,0 +1,157 @@
+package geecache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSignedCluster(t *testing.T, name string, keys ...*PeerKeys) *testCluster {
+	t.Helper()
+	c := newTestCluster(t, 0, name, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("v-" + key), nil
+	}))
+	for _, k := range keys {
+		node := c.addNode()
+		node.pool.opts.Keys = k
+		node.pool.opts.HealthInterval = -1
+	}
+	c.setPeers()
+	return c
+}
+
+// signedGet sends a GET for key to node, signed by k, and returns the
+// status code.
+func signedGet(t *testing.T, node *testNode, k *PeerKeys, key string, tweak func(*http.Request)) int {
+	t.Helper()
+	req, err := http.NewRequest("GET", node.addr+defaultBasePath+node.group.name+"/"+key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != nil {
+		if err := k.sign(req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tweak != nil {
+		tweak(req)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestSignedRequests(t *testing.T) {
+	secret := map[string][]byte{"k1": []byte("secret-1")}
+	keys := func() *PeerKeys { return &PeerKeys{Keys: secret, SignWith: "k1", Enforce: true} }
+	c := newSignedCluster(t, "signed", keys(), keys())
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if v, err := c.nodes[0].group.Get(key); err != nil || v.String() != "v-"+key {
+			t.Fatalf("expected v-%s, got %q, %v", key, v, err)
+		}
+	}
+	if st := c.nodes[0].group.Stats(); st.PeerErrors != 0 || st.PeerLoads == 0 {
+		t.Fatalf("expected signed fetches from node 1, got %+v", st)
+	}
+
+	node := c.nodes[0]
+	client := keys()
+	other := &PeerKeys{Keys: map[string][]byte{"k1": []byte("guess")}, SignWith: "k1"}
+	stale := strconv.FormatInt(time.Now().Add(-2*time.Minute).UnixNano(), 10)
+	tests := []struct {
+		name  string
+		keys  *PeerKeys
+		tweak func(*http.Request)
+		want  int
+	}{
+		{"signed", client, nil, http.StatusOK},
+		{"unsigned", nil, nil, http.StatusUnauthorized},
+		{"wrong secret", other, nil, http.StatusUnauthorized},
+		{"unknown key", client, func(r *http.Request) { r.Header.Set(headerKeyID, "k9") }, http.StatusUnauthorized},
+		{"stale", client, func(r *http.Request) { r.Header.Set(headerTimestamp, stale) }, http.StatusUnauthorized},
+		{"other path", client, func(r *http.Request) { r.URL.Path += "x" }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := signedGet(t, node, tt.keys, "Tom", tt.tweak); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, got)
+		}
+	}
+
+	// the same signed request can't be sent twice
+	var sent *http.Request
+	if got := signedGet(t, node, client, "Tom", func(r *http.Request) { sent = r }); got != http.StatusOK {
+		t.Fatalf("expected 200, got %d", got)
+	}
+	if got := signedGet(t, node, nil, "Tom", func(r *http.Request) { r.Header = sent.Header }); got != http.StatusUnauthorized {
+		t.Fatalf("expected a replay to be refused, got %d", got)
+	}
+}
+
+func TestSignedRequestsNotEnforced(t *testing.T) {
+	k := &PeerKeys{Keys: map[string][]byte{"k1": []byte("secret-1")}, SignWith: "k1"}
+	c := newSignedCluster(t, "signed-lax", k)
+	if got := signedGet(t, c.nodes[0], nil, "Tom", nil); got != http.StatusOK {
+		t.Fatalf("expected an unsigned request to be let in, got %d", got)
+	}
+	bad := &PeerKeys{Keys: map[string][]byte{"k1": []byte("guess")}, SignWith: "k1"}
+	if got := signedGet(t, c.nodes[0], bad, "Tom", nil); got != http.StatusUnauthorized {
+		t.Fatalf("expected a bad signature to be refused, got %d", got)
+	}
+}
+
+func TestSignedBodyTooLarge(t *testing.T) {
+	k := &PeerKeys{Keys: map[string][]byte{"k1": []byte("secret-1")}, SignWith: "k1", Enforce: true}
+	c := newSignedCluster(t, "signed-large", k)
+	node := c.nodes[0]
+	node.pool.opts.MaxBodyBytes = 1 << 10
+
+	for size, want := range map[int]int{1 << 10: http.StatusOK, 1<<10 + 1: http.StatusRequestEntityTooLarge} {
+		body := bytes.Repeat([]byte("x"), size)
+		req, err := http.NewRequest("PUT", node.addr+defaultBasePath+node.group.name+"/Tom", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := k.sign(req, body); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Fatalf("expected a body of %d bytes to get %d, got %d", size, want, res.StatusCode)
+		}
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	old, next := []byte("old"), []byte("next")
+	// node 0 already signs with the new key, node 1 only knows the old one
+	k0 := &PeerKeys{Keys: map[string][]byte{"old": old, "next": next}, SignWith: "next", Enforce: true}
+	k1 := &PeerKeys{Keys: map[string][]byte{"old": old}, SignWith: "old", Enforce: true}
+	c := newSignedCluster(t, "rotation", k0, k1)
+
+	if got := signedGet(t, c.nodes[0], k1, "Tom", nil); got != http.StatusOK {
+		t.Fatalf("expected node 0 to accept the old key, got %d", got)
+	}
+	if got := signedGet(t, c.nodes[1], k0, "Tom", nil); got != http.StatusUnauthorized {
+		t.Fatalf("expected node 1 to refuse the new key, got %d", got)
+	}
+	k1.SetKeys(map[string][]byte{"old": old, "next": next}, "next")
+	if got := signedGet(t, c.nodes[1], k0, "Tom", nil); got != http.StatusOK {
+		t.Fatalf("expected node 1 to accept the new key, got %d", got)
+	}
+	k0.SetKeys(map[string][]byte{"next": next}, "next")
+	if got := signedGet(t, c.nodes[0], k1, "Tom", nil); got != http.StatusOK {
+		t.Fatalf("expected node 0 to accept node 1's new signatures, got %d", got)
+	}
+}
@@ -0,0 +1,288 @@
+package geecache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A snapshot is laid out as:
+//
+//	magic "GEESNAP" | version byte | group | uvarint generation
+//	entries, least recently used first:
+//	    key | value | varint expiry (unix nanoseconds, 0 for none)
+//	    uvarint number of tags | tags
+//	    codec name, empty if the value isn't compressed (since version 2)
+//	    key ID, empty if the value isn't encrypted (since version 3)
+//	an empty key marking the end
+//	big-endian CRC-32C of everything before it
+//
+// where strings and values are a uvarint length followed by the bytes.
+// Encrypted values are authenticated with their group and key since
+// version 4; those of older snapshots are skipped.
+const (
+	snapshotMagic   = "GEESNAP"
+	snapshotVersion = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBadSnapshot is returned by Restore for a snapshot that is corrupt or
+// was written by an unknown version.
+var ErrBadSnapshot = errors.New("bad snapshot")
+
+// Snapshot writes the group's own entries to w, so that a restarted node
+// can start warm with Restore. Values cached from other peers aren't
+// included.
+func (g *Group) Snapshot(w io.Writer) error {
+	gen := g.Generation()
+	prefix := fmt.Sprintf("%d/", gen)
+	entries := g.mainCache.entries(func(cacheKey string) bool {
+		return strings.HasPrefix(cacheKey, prefix)
+	})
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	sw := &snapshotWriter{w: io.MultiWriter(bw, crc)}
+	sw.write([]byte(snapshotMagic))
+	sw.write([]byte{snapshotVersion})
+	sw.string(g.name)
+	sw.uvarint(gen)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		sw.string(strings.TrimPrefix(e.key, prefix))
+		sw.bytes(e.value.raw())
+		sw.varint(unixNano(e.value.Expire()))
+		sw.uvarint(uint64(len(e.tags)))
+		for _, tag := range e.tags {
+			sw.string(tag)
+		}
+		sw.string(e.value.codecName())
+		sw.string(e.value.kid)
+	}
+	sw.string("")
+	if sw.err != nil {
+		return sw.err
+	}
+	if err := binary.Write(bw, binary.BigEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore caches the entries of a snapshot written by Snapshot, in their
+// original LRU order. Entries that have expired, that another peer owns
+// under the current ring, that are already cached or that are encrypted
+// with a key the group no longer has are skipped, as is the whole
+// snapshot if the group has since moved to a newer generation.
+// Nothing is restored unless the snapshot is intact.
+func (g *Group) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+1+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	}
+	version := data[len(snapshotMagic)]
+	if version < 1 || version > snapshotVersion {
+		return fmt.Errorf("%w: unknown version %d", ErrBadSnapshot, version)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+
+	sr := &snapshotReader{b: body[len(snapshotMagic)+1:]}
+	name := sr.string()
+	gen := sr.uvarint()
+	var entries []cacheEntry
+	for sr.err == nil {
+		key := sr.string()
+		if key == "" {
+			break
+		}
+		e := cacheEntry{key: key}
+		e.value.b = sr.bytes()
+		e.value.e = fromUnixNano(sr.varint())
+		for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+			e.tags = append(e.tags, sr.string())
+		}
+		if version >= 2 {
+			name := sr.string()
+			codec, ok := codecNamed(name)
+			if !ok && sr.err == nil {
+				sr.err = fmt.Errorf("unknown codec %q", name)
+			}
+			e.value.c = codec
+		}
+		if version >= 3 {
+			e.value.kid = sr.string()
+		}
+		entries = append(entries, e)
+	}
+	if sr.err == nil && len(sr.b) != 0 {
+		sr.err = errors.New("trailing data")
+	}
+	if sr.err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, sr.err)
+	}
+	if name != g.name {
+		return fmt.Errorf("snapshot is of group %s, not %s", name, g.name)
+	}
+
+	g.setGeneration(gen)
+	if g.Generation() != gen {
+		log.Printf("[GeeCache] snapshot of %s is from generation %d, skipped", g.name, gen)
+		return nil
+	}
+	restored := 0
+	now := time.Now()
+	for _, e := range entries {
+		if e.value.expired(now) {
+			continue
+		}
+		if _, ok := g.pickPeer(e.key); ok {
+			continue
+		}
+		if _, ok := g.mainCache.get(g.cacheKey(e.key)); ok {
+			continue
+		}
+		if e.value.kid != "" {
+			if version < 4 || g.keys.canOpen(e.value.kid) != nil {
+				continue
+			}
+			e.value.k, e.value.key = &g.keys, e.key
+		}
+		g.populateCache(e.key, e.value, e.tags...)
+		restored++
+	}
+	log.Printf("[GeeCache] restored %d of %d entries of %s", restored, len(entries), g.name)
+	return nil
+}
+
+// SaveSnapshot writes a snapshot of the group to path. The file is
+// replaced atomically, so a crash leaves the previous snapshot in place.
+func (g *Group) SaveSnapshot(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := g.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores the group from the snapshot at path, written by
+// SaveSnapshot.
+func (g *Group) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.Restore(f)
+}
+
+// snapshotWriter encodes the fields of a snapshot, keeping the first
+// error.
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) uvarint(x uint64) {
+	sw.write(sw.buf[:binary.PutUvarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) varint(x int64) {
+	sw.write(sw.buf[:binary.PutVarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) bytes(b []byte) {
+	sw.uvarint(uint64(len(b)))
+	sw.write(b)
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.bytes([]byte(s))
+}
+
+// snapshotReader decodes the fields of a snapshot, keeping the first
+// error.
+type snapshotReader struct {
+	b   []byte
+	err error
+}
+
+var errTruncated = errors.New("truncated")
+
+func (sr *snapshotReader) uvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(sr.b)
+	if n <= 0 {
+		sr.err = errTruncated
+		return 0
+	}
+	sr.b = sr.b[n:]
+	return x
+}
+
+func (sr *snapshotReader) varint() int64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(sr.b)
+	if n <= 0 {
+		sr.err = errTruncated
+		return 0
+	}
+	sr.b = sr.b[n:]
+	return x
+}
+
+func (sr *snapshotReader) bytes() []byte {
+	n := sr.uvarint()
+	if sr.err != nil {
+		return nil
+	}
+	if n > uint64(len(sr.b)) {
+		sr.err = errTruncated
+		return nil
+	}
+	b := bytes.Clone(sr.b[:n])
+	sr.b = sr.b[n:]
+	return b
+}
+
+func (sr *snapshotReader) string() string {
+	return string(sr.bytes())
+}
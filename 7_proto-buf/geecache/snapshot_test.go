@@ -0,0 +1,120 @@
+package geecache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte("v-" + key), nil
+	})
+	g := newGroup("snapshot", 2<<10, getter)
+	g.Get("a")
+	g.Set("b", []byte("bee"), "insects")
+	g.SetExpire("c", []byte("sea"), time.Now().Add(time.Hour))
+	g.SetExpire("gone", []byte("x"), time.Now().Add(-time.Second))
+	g.Get("a") // a is now the most recently used
+
+	var buf bytes.Buffer
+	if err := g.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := newGroup("snapshot", 2<<10, getter)
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, e := range restored.mainCache.entries(func(string) bool { return true }) {
+		keys = append(keys, e.key)
+	}
+	if want := []string{"0/a", "0/c", "0/b"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("expected %v in LRU order, got %v", want, keys)
+	}
+	if v, ok := restored.lookupCache("c"); !ok || v.String() != "sea" || v.Expire().IsZero() {
+		t.Fatalf("expected c with its expiry, got %v %v", v, ok)
+	}
+	if err := restored.InvalidateTag("insects"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.lookupCache("b"); ok {
+		t.Fatal("expected b's tags to be restored")
+	}
+
+	if err := newGroup("other", 2<<10, getter).Restore(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected a snapshot of another group to be refused")
+	}
+}
+
+func TestRestoreBadSnapshot(t *testing.T) {
+	g := newGroup("snapshot-bad", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	g.Set("a", []byte("1"))
+	var buf bytes.Buffer
+	if err := g.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	flipped := bytes.Clone(good)
+	flipped[len(flipped)-6] ^= 1
+	version := bytes.Clone(good)
+	version[len(snapshotMagic)] = 99
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": good[:len(good)-1],
+		"flipped":   flipped,
+		"version":   version,
+	} {
+		restored := newGroup("snapshot-bad", 2<<10, g.getter)
+		if err := restored.Restore(bytes.NewReader(data)); !errors.Is(err, ErrBadSnapshot) {
+			t.Errorf("%s: expected ErrBadSnapshot, got %v", name, err)
+		}
+		if _, ok := restored.lookupCache("a"); ok {
+			t.Errorf("%s: expected nothing to be restored", name)
+		}
+	}
+}
+
+func TestRestoreSkipsKeysOwnedElsewhere(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	})
+	var keys []string
+	for i := 0; i < 64; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	g := newGroup("snapshot-ring", 2<<10, getter)
+	for _, key := range keys {
+		g.Set(key, []byte(key))
+	}
+	path := filepath.Join(t.TempDir(), "snapshot-ring.snapshot")
+	if err := g.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCluster(t, 2, "snapshot-ring", getter)
+	node := c.nodes[0]
+	if err := node.group.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	mine := 0
+	for _, key := range keys {
+		_, cached := node.group.mainCache.get(node.group.cacheKey(key))
+		if owned := c.owner(key) == node; cached != owned {
+			t.Errorf("%s: owned %v but cached %v", key, owned, cached)
+		} else if owned {
+			mine++
+		}
+	}
+	if mine == 0 || mine == len(keys) {
+		t.Fatalf("expected the keys to be split between the nodes, node 0 owns %d", mine)
+	}
+}
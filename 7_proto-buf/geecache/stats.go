@@ -0,0 +1,84 @@
+package geecache
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrNotFound is returned by Getters, wrapped or as is, for keys that
+// don't exist, so that frontends can tell them apart from failed loads.
+var ErrNotFound = errors.New("not found")
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// GroupNames returns the names of the groups created with NewGroup, in
+// order.
+func GroupNames() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stats are counters of a group's activity since it was created.
+type Stats struct {
+	Gets          int64 // calls to Get
+	CacheHits     int64 // gets answered from the main or hot cache, or L2
+	L2Hits        int64 // of which from L2, see SetL2
+	Loads         int64 // misses, after concurrent misses were deduplicated
+	PeerLoads     int64 // loads answered by a peer
+	PeerErrors    int64 // loads a peer failed
+	LocalLoads    int64 // loads through the Getter
+	LocalLoadErrs int64 // loads the Getter failed
+	LoadsRejected int64 // loads rejected by the group's LoadLimit
+	HedgedLoads   int64 // loads through the Getter for hedged requests, not cached
+
+	MainCache CacheStats // keys this node owns
+	HotCache  CacheStats // copies of keys other nodes own
+	L2        CacheStats // keys this node owns, evicted to disk
+}
+
+// CacheStats are the size of one of a group's caches.
+type CacheStats struct {
+	Bytes int64
+	Items int64
+}
+
+type groupStats struct {
+	gets          atomic.Int64
+	cacheHits     atomic.Int64
+	loads         atomic.Int64
+	peerLoads     atomic.Int64
+	peerErrors    atomic.Int64
+	localLoads    atomic.Int64
+	localLoadErrs atomic.Int64
+	loadsRejected atomic.Int64
+	hedgedLoads   atomic.Int64
+}
+
+// Stats returns the group's counters.
+func (g *Group) Stats() Stats {
+	return Stats{
+		Gets:          g.stats.gets.Load(),
+		CacheHits:     g.stats.cacheHits.Load(),
+		L2Hits:        g.mainCache.l2Hits.Load(),
+		Loads:         g.stats.loads.Load(),
+		PeerLoads:     g.stats.peerLoads.Load(),
+		PeerErrors:    g.stats.peerErrors.Load(),
+		LocalLoads:    g.stats.localLoads.Load(),
+		LocalLoadErrs: g.stats.localLoadErrs.Load(),
+		LoadsRejected: g.stats.loadsRejected.Load(),
+		HedgedLoads:   g.stats.hedgedLoads.Load(),
+		MainCache:     g.mainCache.stats(),
+		HotCache:      g.hotCache.stats(),
+		L2:            g.mainCache.l2Stats(),
+	}
+}
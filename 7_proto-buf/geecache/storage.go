@@ -0,0 +1,106 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/arena"
+	"Dcache/7_proto-buf/geecache/lru"
+)
+
+// storage is where a cache keeps its entries. It passes the entries it
+// evicts to the cache's onEvicted; it may or may not pass those that are
+// removed.
+type storage interface {
+	// Add adds value, or returns false if it can't be stored at all.
+	Add(key string, value ByteView) bool
+	// Get looks up a value and marks it as recently used.
+	Get(key string) (ByteView, bool)
+	// Peek looks up a value without marking it as recently used.
+	Peek(key string) (ByteView, bool)
+	Remove(key string)
+	// Keys returns the keys, from most to least recently used as far as
+	// the storage keeps track.
+	Keys() []string
+	Len() int
+	Bytes() int64
+}
+
+// UseArena makes the group keep its caches in arenas of the given number
+// of shards rather than in LRU lists, which puts millions of small entries
+// out of the garbage collector's way at the cost of evicting the oldest
+// entries rather than the least recently used. It has no effect on caches
+// without a size limit. UseArena should be called before the group is
+// used; entries cached before are dropped.
+func (g *Group) UseArena(shards int) {
+	for _, c := range []*cache{&g.mainCache, &g.hotCache} {
+		c.mu.Lock()
+		c.arenaShards = shards
+		if c.store != nil {
+			c.store, c.tags, c.keyTags = nil, nil, nil
+			c.init()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// lruStorage keeps entries in an lru.Cache.
+type lruStorage struct {
+	*lru.Cache
+}
+
+func newLRUStorage(maxBytes int64, onEvicted func(string, ByteView)) storage {
+	return lruStorage{lru.New(maxBytes, func(key string, value lru.Value) {
+		onEvicted(key, value.(ByteView))
+	})}
+}
+
+func (s lruStorage) Add(key string, value ByteView) bool {
+	s.Cache.Add(key, value)
+	return true
+}
+
+func (s lruStorage) Get(key string) (ByteView, bool) {
+	v, ok := s.Cache.Get(key)
+	if !ok {
+		return ByteView{}, false
+	}
+	return v.(ByteView), true
+}
+
+func (s lruStorage) Peek(key string) (ByteView, bool) {
+	v, ok := s.Cache.Peek(key)
+	if !ok {
+		return ByteView{}, false
+	}
+	return v.(ByteView), true
+}
+
+// arenaStorage keeps entries in an arena.Cache, marshaled with
+// marshalView.
+type arenaStorage struct {
+	*arena.Cache
+	keys *keyring
+}
+
+func newArenaStorage(maxBytes int64, shards int, keys *keyring, onEvicted func(string, ByteView)) storage {
+	return arenaStorage{arena.New(maxBytes, shards, func(key string, value []byte) {
+		v, _ := unmarshalView(key, value, keys)
+		onEvicted(key, v)
+	}), keys}
+}
+
+func (s arenaStorage) Add(key string, value ByteView) bool {
+	return s.Cache.Add(key, marshalView(value))
+}
+
+func (s arenaStorage) Get(key string) (ByteView, bool) {
+	b, ok := s.Cache.Get(key)
+	if !ok {
+		return ByteView{}, false
+	}
+	v, err := unmarshalView(key, b, s.keys)
+	return v, err == nil
+}
+
+// Peek is Get: an arena doesn't track use.
+func (s arenaStorage) Peek(key string) (ByteView, bool) {
+	return s.Get(key)
+}
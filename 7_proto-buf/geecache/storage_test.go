@@ -0,0 +1,126 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/logstore"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestCache(arenaShards int, cacheBytes int64) *cache {
+	return &cache{cacheBytes: cacheBytes, arenaShards: arenaShards}
+}
+
+func TestStorage(t *testing.T) {
+	for _, shards := range []int{0, 4} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			c := newTestCache(shards, 64<<10)
+			c.add("a", ByteView{b: []byte("1")}, "odd")
+			c.add("b", ByteView{b: []byte("2"), e: time.Now().Add(time.Hour)})
+			c.add("c", ByteView{b: []byte("3")}, "odd")
+			c.add("gone", ByteView{b: []byte("4"), e: time.Now().Add(-time.Second)})
+
+			if v, ok := c.get("b"); !ok || v.String() != "2" || v.Expire().IsZero() {
+				t.Fatalf("expected b with its expiry, got %v %v", v, ok)
+			}
+			if _, ok := c.get("gone"); ok {
+				t.Fatal("expected gone to have expired")
+			}
+			if keys := c.removeTag("odd"); len(keys) != 2 {
+				t.Fatalf("expected a and c to be removed, got %v", keys)
+			}
+			if _, ok := c.get("a"); ok || len(c.tags) != 0 || len(c.keyTags) != 0 {
+				t.Fatalf("expected a and its tags to be removed, got %v %v", c.tags, c.keyTags)
+			}
+			if entries := c.entries(func(string) bool { return true }); len(entries) != 1 || entries[0].key != "b" {
+				t.Fatalf("expected only b to be left, got %v", entries)
+			}
+			// key and value, and in an arena the 10 bytes marshalView adds:
+			// the expiry and the lengths of the codec and key ID names
+			want := int64(2)
+			if shards > 0 {
+				want += 10
+			}
+			if st := c.stats(); st.Items != 1 || st.Bytes != want {
+				t.Fatalf("expected one entry of %d bytes, got %+v", want, st)
+			}
+
+			// a value too large for the cache replaces the old one all the
+			// same
+			c.add("b", ByteView{b: make([]byte, 64<<10)}, "big")
+			if v, ok := c.get("b"); ok || len(c.keyTags) != 0 {
+				t.Fatalf("expected b to be gone with its tags, got %q %v", v, c.keyTags)
+			}
+		})
+	}
+}
+
+func TestArenaEvictionSpillsToL2(t *testing.T) {
+	store, err := logstore.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	c := newTestCache(1, 4<<10)
+	c.l2 = store
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("key%d", i), ByteView{b: make([]byte, 100)}, "tag")
+	}
+	c.writeQueued(store)
+	if st := c.stats(); st.Items >= 100 || c.l2Stats().Items != 100-st.Items {
+		t.Fatalf("expected the oldest entries to spill, got %+v in memory and %+v on disk", st, c.l2Stats())
+	}
+	if len(c.keyTags) != int(c.stats().Items) {
+		t.Fatalf("expected tags of evicted entries to be dropped, got %d", len(c.keyTags))
+	}
+	if v, ok := c.get("key0"); !ok || v.Len() != 100 {
+		t.Fatal("expected key0 back from L2")
+	}
+}
+
+// benchmarkGC fills a cache with a million small entries and measures how
+// long a full garbage collection then takes.
+func benchmarkGC(b *testing.B, arenaShards int) {
+	const entries = 1 << 20
+	c := newTestCache(arenaShards, entries*64)
+	value := make([]byte, 16)
+	for i := 0; i < entries; i++ {
+		c.add(fmt.Sprintf("key%d", i), ByteView{b: value})
+	}
+	runtime.GC()
+	b.ResetTimer()
+	var pause time.Duration
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		runtime.GC()
+		pause += time.Since(start)
+	}
+	b.ReportMetric(float64(pause.Microseconds())/float64(b.N), "µs/gc")
+	runtime.KeepAlive(c)
+}
+
+func BenchmarkGCLRU(b *testing.B)   { benchmarkGC(b, 0) }
+func BenchmarkGCArena(b *testing.B) { benchmarkGC(b, 64) }
+
+func benchmarkGet(b *testing.B, arenaShards int) {
+	const entries = 1 << 16
+	c := newTestCache(arenaShards, entries*64)
+	value := make([]byte, 16)
+	keys := make([]string, entries)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		c.add(keys[i], ByteView{b: value})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.get(keys[i%entries])
+			i++
+		}
+	})
+}
+
+func BenchmarkGetLRU(b *testing.B)   { benchmarkGet(b, 0) }
+func BenchmarkGetArena(b *testing.B) { benchmarkGet(b, 64) }
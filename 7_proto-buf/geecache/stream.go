@@ -0,0 +1,98 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Values of at least HTTPPoolOptions.StreamBytes are streamed to the peers
+// that fetch them rather than sent inside a Response, as:
+//
+//	uvarint length | Response without its value | uvarint length | value
+//
+// The owner writes the value straight from its cache, with chunked
+// transfer encoding, and the peer reads it straight into its buffer; a
+// Response would be copied whole on both sides, and read into a growing
+// buffer first. Peers ask for streams in their Accept header, so that
+// nodes with and without streaming can share a ring.
+//
+// The buffer grows a chunk at a time as the value arrives, so that a
+// length that overstates the value can't make the peer allocate it.
+const (
+	streamContentType  = "application/x-geecache-stream"
+	defaultStreamBytes = 1 << 20
+
+	maxStreamHeader = 1 << 20
+	streamChunk     = 64 << 10
+)
+
+// streams reports whether res should be streamed in answer to r.
+func (p *HTTPPool) streams(r *http.Request, res *pb.Response) bool {
+	return p.opts.StreamBytes > 0 && len(res.Value) >= p.opts.StreamBytes &&
+		strings.Contains(r.Header.Get("Accept"), streamContentType)
+}
+
+// writeStream writes res to w as a stream.
+func writeStream(w io.Writer, res *pb.Response) error {
+	// marshal everything but the value, without copying it
+	value := res.Value
+	res.Value = nil
+	b, err := proto.Marshal(res)
+	res.Value = value
+	if err != nil {
+		return err
+	}
+	buf := binary.AppendUvarint(nil, uint64(len(b)))
+	buf = append(buf, b...)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err = w.Write(value)
+	return err
+}
+
+// readStream reads a stream written by writeStream into out, failing if
+// its value is over max bytes.
+func readStream(r io.Reader, out *pb.Response, max int64) error {
+	br := bufio.NewReader(r)
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if n > maxStreamHeader {
+		return fmt.Errorf("stream header of %d bytes", n)
+	}
+	head := make([]byte, n)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(head, out); err != nil {
+		return err
+	}
+	if n, err = binary.ReadUvarint(br); err != nil {
+		return err
+	}
+	if n > uint64(max) {
+		return fmt.Errorf("streamed value of %d bytes is over %d", n, max)
+	}
+	value := make([]byte, 0, min(n, streamChunk))
+	for uint64(len(value)) < n {
+		c := int(min(n-uint64(len(value)), streamChunk))
+		value = slices.Grow(value, c)
+		if _, err := io.ReadFull(br, value[len(value):len(value)+c]); err != nil {
+			return err
+		}
+		value = value[:len(value)+c]
+	}
+	out.Value = value
+	return nil
+}
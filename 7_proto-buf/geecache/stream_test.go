@@ -0,0 +1,76 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	value := bytes.Repeat([]byte("v"), 1<<10)
+	if err := writeStream(&buf, &pb.Response{Value: value, Expire: 7, Compression: "gzip"}); err != nil {
+		t.Fatal(err)
+	}
+	out := &pb.Response{}
+	if err := readStream(&buf, out, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Value, value) || out.Expire != 7 || out.Compression != "gzip" {
+		t.Fatalf("round trip failed: %d bytes, %+v", len(out.Value), out)
+	}
+	if err := readStream(bytes.NewReader([]byte{5, 1, 2}), out, 1<<20); err == nil {
+		t.Fatal("expected a truncated stream to fail")
+	}
+
+	writeStream(&buf, &pb.Response{Value: value})
+	if err := readStream(&buf, out, 100); err == nil {
+		t.Fatal("expected a value over the limit to fail")
+	}
+	// a stream claiming 1GB but cut short fails without allocating it
+	lying := binary.AppendUvarint([]byte{0}, 1<<30)
+	if err := readStream(bytes.NewReader(append(lying, value...)), out, 1<<31); err == nil {
+		t.Fatal("expected a truncated value to fail")
+	}
+}
+
+func TestStreamLargeValues(t *testing.T) {
+	value := bytes.Repeat([]byte("large"), 1<<20)
+	c := newTestCluster(t, 3, "stream", GetterFunc(func(key string) ([]byte, error) {
+		if key == "small" {
+			return []byte("small"), nil
+		}
+		return value, nil
+	}))
+	key, owner := remoteKey(c)
+	peer, _ := c.nodes[0].pool.PickPeer(key)
+	if _, err := c.nodes[0].group.getFromPeer(context.Background(), peer, key); err == nil {
+		t.Fatalf("expected %s to be refused, being larger than the cache", key)
+	}
+	for _, node := range c.nodes {
+		node.group.mainCache.cacheBytes = 8 << 20
+	}
+
+	v, err := c.nodes[0].group.Get(key)
+	if err != nil || !v.EqualBytes(value) {
+		t.Fatalf("expected %s from %s, got %d bytes, %v", key, owner.addr, v.Len(), err)
+	}
+
+	get := func(key string) string {
+		req, _ := http.NewRequest(http.MethodGet, owner.addr+defaultBasePath+"stream/"+key+"?local=1", nil)
+		req.Header.Set("Accept", streamContentType)
+		rec := httptest.NewRecorder()
+		owner.pool.ServeHTTP(rec, req)
+		return rec.Header().Get("Content-Type")
+	}
+	if ct := get(key); ct != streamContentType {
+		t.Fatalf("expected %s to be streamed, got %s", key, ct)
+	}
+	if ct := get("small"); ct == streamContentType {
+		t.Fatal("expected a small value not to be streamed")
+	}
+}
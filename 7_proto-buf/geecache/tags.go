@@ -0,0 +1,49 @@
+package geecache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvalidateTag removes every entry tagged with tag, on every peer. Tags
+// come from Set or from a TaggedGetter.
+func (g *Group) InvalidateTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tag is required")
+	}
+	g.invalidateTagLocally(tag)
+	return g.invalidatePeers(func(pi PeerInvalidator) error {
+		return pi.InvalidateTag(g.name, tag)
+	})
+}
+
+// InvalidatePrefix removes every entry whose key starts with prefix, on
+// every peer.
+func (g *Group) InvalidatePrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("prefix is required")
+	}
+	g.invalidatePrefixLocally(prefix)
+	return g.invalidatePeers(func(pi PeerInvalidator) error {
+		return pi.InvalidatePrefix(g.name, prefix)
+	})
+}
+
+func (g *Group) invalidateTagLocally(tag string) {
+	g.changes.all()
+	g.mainCache.removeTag(tag)
+	// Copies of remote values don't carry their tags, drop them all.
+	g.hotCache.removePrefix("")
+	// A load in flight may be about to cache a value with this tag, and
+	// its tags aren't known until it finishes: revoke every lease.
+	g.leases.revokeAll()
+}
+
+func (g *Group) invalidatePrefixLocally(prefix string) {
+	g.changes.all()
+	g.mainCache.removePrefix(g.cacheKey(prefix))
+	g.hotCache.removePrefix(g.cacheKey(prefix))
+	g.leases.revokeFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
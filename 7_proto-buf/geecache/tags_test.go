@@ -0,0 +1,109 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	loads := 0
+	g := NewGroup("tags", 2<<10, TaggedGetterFunc(
+		func(key string) ([]byte, []string, error) {
+			loads++
+			user, _, _ := strings.Cut(key, "/")
+			return []byte(key), []string{user}, nil
+		}))
+	picker := &fakePicker{peer: &fakePeer{}}
+	g.RegisterPeers(picker)
+
+	g.Get("user:42/profile")
+	g.Get("user:42/avatar")
+	g.Get("user:7/profile")
+	g.Set("feed", []byte("..."), "user:42", "user:7")
+
+	if err := g.InvalidateTag("user:42"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"user:42/profile", "user:42/avatar", "feed"} {
+		if _, ok := g.lookupCache(key); ok {
+			t.Fatalf("%s should have been invalidated", key)
+		}
+	}
+	if _, ok := g.lookupCache("user:7/profile"); !ok {
+		t.Fatal("user:7/profile should still be cached")
+	}
+	if len(g.mainCache.tags["user:42"]) != 0 || len(g.mainCache.tags["user:7"]) != 1 {
+		t.Fatalf("tag index not cleaned up: %v", g.mainCache.tags)
+	}
+
+	if err := g.InvalidatePrefix("user:7/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.lookupCache("user:7/profile"); ok {
+		t.Fatal("user:7/profile should have been invalidated")
+	}
+
+	expect := []string{"tag:user:42", "prefix:user:7/"}
+	if !reflect.DeepEqual(expect, picker.peer.invalidated) {
+		t.Fatalf("expected peers to see %v, got %v", expect, picker.peer.invalidated)
+	}
+}
+
+func TestTagsCleanedUpOnEviction(t *testing.T) {
+	g := NewGroup("tags-eviction", 64, GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	for i := 0; i < 10; i++ {
+		g.Set(strings.Repeat("k", i+1), []byte("0123456789"), "tag")
+	}
+	if n, m := len(g.mainCache.tags["tag"]), g.mainCache.store.Len(); n != m {
+		t.Fatalf("tag index holds %d keys, cache holds %d", n, m)
+	}
+}
+
+func TestSetOverHTTP(t *testing.T) {
+	g := NewGroup("tags-http", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	srv := httptest.NewServer(NewHTTPPool("http://owner"))
+	defer srv.Close()
+	peer := &httpGetter{baseURL: srv.URL + defaultBasePath}
+
+	if err := peer.Set(g.name, &pb.Entry{Key: "k", Value: []byte("v"), Tags: []string{"t"}}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := g.lookupCache("k"); !ok || v.String() != "v" {
+		t.Fatalf("expected k=v, got %v", v)
+	}
+	if err := peer.InvalidateTag(g.name, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.lookupCache("k"); ok {
+		t.Fatal("k should have been invalidated")
+	}
+}
+
+func TestSetOddKeyOverHTTP(t *testing.T) {
+	c := newTestCluster(t, 3, "tags-odd", GetterFunc(
+		func(key string) ([]byte, error) { return []byte(key), nil }))
+	key, owner := oddKey(c)
+	g := c.nodes[0].group
+
+	if err := g.Set(key, []byte("v"), "a tag+"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := owner.group.lookupCache(key); !ok || v.String() != "v" {
+		t.Fatalf("expected the owner to cache %q, got %q, %v", key, v, ok)
+	}
+	if touched, err := g.Touch(key, time.Now().Add(time.Hour)); err != nil || !touched {
+		t.Fatalf("expected %q to be touched, got %v, %v", key, touched, err)
+	}
+	if err := g.InvalidateTag("a tag+"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := owner.group.lookupCache(key); ok {
+		t.Fatalf("expected %q to be invalidated on its owner", key)
+	}
+}
@@ -0,0 +1,815 @@
+package geecache
+
+import (
+	"Dcache/7_proto-buf/geecache/consistenthash"
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// tcpVersion is the newest version of the TCP protocol this node
+	// speaks; tcpVersions are all of them. Version 2 added writes and
+	// invalidations, version 3 leases and keep-warm.
+	tcpVersion       = 3
+	defaultTCPConns  = 2
+	handshakeTimeout = 5 * time.Second
+	maxFrameSize     = 64 << 20
+	// maxConnRequests caps the requests served at once on a connection;
+	// the next frame isn't read until one of them is answered.
+	maxConnRequests = 256
+)
+
+var tcpVersions = []uint32{1, 2, tcpVersion}
+
+// the ops of frames that aren't Gets
+const (
+	opSet        = "set"
+	opRemove     = "remove"
+	opTouch      = "touch"
+	opGeneration = "generation"
+	opTag        = "tag"
+	opPrefix     = "prefix"
+	opBus        = "bus"
+	opLeaseSet   = "lease_set" // the lease is Response.Lease
+	opKeepWarm   = "keepwarm"  // the interval is Entry.Expire, in ns
+)
+
+// opVersion is the protocol version that added op.
+func opVersion(op string) uint32 {
+	switch op {
+	case opLeaseSet, opKeepWarm:
+		return 3
+	}
+	return 2
+}
+
+var errPoolClosed = errors.New("geecache: peer removed from the pool")
+
+// TCPPoolOptions are the configurations of a TCPPool.
+type TCPPoolOptions struct {
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If blank, it defaults to 50.
+	Replicas int
+
+	// HashFn specifies the hash function of the consistent hash.
+	// If blank, it defaults to crc32.ChecksumIEEE.
+	HashFn consistenthash.Hash
+
+	// Conns is the number of connections kept open to each peer. If
+	// blank, it defaults to 2.
+	Conns int
+
+	// Timeout limits each request to a peer, including dialing it. If
+	// blank, it defaults to 10s.
+	Timeout time.Duration
+
+	// TLS, if not nil, secures the connections between peers. With
+	// Mutual, clients must present a certificate naming the host of one
+	// of the pool's peers.
+	TLS *PeerTLS
+
+	// Keys, if not nil, sign the connections this node opens and verify
+	// those it accepts, as they do HTTP requests. A connection is signed
+	// once, when it is opened, so use TLS as well to keep it from being
+	// taken over.
+	Keys *PeerKeys
+}
+
+// TCPPool implements PeerPicker for a pool of peers that talk over raw
+// TCP rather than HTTP. Each message is a protobuf Frame preceded by its
+// length, and every request carries an id so that many can be in flight
+// on one connection. Peers are addressed as host:port.
+//
+// Peers can get, set, lease, touch, remove, keep warm and invalidate
+// keys, and broadcast invalidations, as over HTTP. The pool itself is
+// simpler than HTTPPool: a fetch is tried once, on the owner only, with
+// no retries, hedging or ejection of unhealthy peers, and entries aren't
+// handed off when the ring changes.
+type TCPPool struct {
+	// this peer's address, e.g. "10.0.0.2:8008"
+	self    string
+	opts    TCPPoolOptions
+	mu      sync.Mutex // guards peers, members and getters
+	peers   *consistenthash.Map
+	members []string
+	getters map[string]*tcpGetter
+	bus     *bus // invalidations for every peer
+	// groups served by this pool; nil means those created with
+	// NewGroup. Tests set it to run several nodes in one process.
+	groups map[string]*Group
+}
+
+// NewTCPPool initializes a TCP pool of peers.
+func NewTCPPool(self string) *TCPPool {
+	return NewTCPPoolOpts(self, nil)
+}
+
+// NewTCPPoolOpts initializes a TCP pool of peers with the given options.
+func NewTCPPoolOpts(self string, o *TCPPoolOptions) *TCPPool {
+	p := &TCPPool{self: self}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.Conns == 0 {
+		p.opts.Conns = defaultTCPConns
+	}
+	if p.opts.Timeout == 0 {
+		p.opts.Timeout = defaultTimeout
+	}
+	p.bus = newBus(self, p.applyInvalidation, p.purgeHotCaches)
+	return p
+}
+
+// Log info with server name
+func (p *TCPPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+// selfAddr returns this peer's address, which tells its generations
+// apart from the other peers'.
+func (p *TCPPool) selfAddr() string {
+	return p.self
+}
+
+// Set updates the pool's list of peers. Connections to peers that are no
+// longer in the list are closed.
+func (p *TCPPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
+	p.peers.Add(peers...)
+	p.members = slices.Clone(peers)
+	getters := make(map[string]*tcpGetter, len(peers))
+	senders := make(map[string]func(*pb.InvalidationBatch) (uint64, error))
+	for _, peer := range peers {
+		getter, ok := p.getters[peer]
+		if !ok {
+			getter = &tcpGetter{addr: peer, opts: &p.opts}
+		}
+		getters[peer] = getter
+		if peer != p.self {
+			senders[peer] = getter.sendInvalidations
+		}
+	}
+	for peer, getter := range p.getters {
+		if _, ok := getters[peer]; !ok {
+			getter.close()
+		}
+	}
+	p.getters = getters
+	p.bus.setPeers(senders)
+}
+
+// PickPeer picks a peer according to key
+func (p *TCPPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil, false
+	}
+	if peer := p.peers.Get(key); peer != "" && peer != p.self {
+		return p.getters[peer], true
+	}
+	return nil, false
+}
+
+// AllPeers returns a getter for every peer other than this one.
+func (p *TCPPool) AllPeers() []PeerGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	all := make([]PeerGetter, 0, len(p.getters))
+	for peer, getter := range p.getters {
+		if peer != p.self {
+			all = append(all, getter)
+		}
+	}
+	return all
+}
+
+// Broadcast tells every peer to drop its copy of key. It returns at once;
+// delivery is retried in the background until each peer acknowledges it.
+func (p *TCPPool) Broadcast(group, key string) {
+	p.bus.publish(group, key)
+}
+
+var _ PeerPicker = (*TCPPool)(nil)
+var _ PeerLister = (*TCPPool)(nil)
+var _ PeerBroadcaster = (*TCPPool)(nil)
+
+func (p *TCPPool) getGroup(name string) *Group {
+	if p.groups != nil {
+		return p.groups[name]
+	}
+	return GetGroup(name)
+}
+
+func (p *TCPPool) applyInvalidation(groupName, key string) {
+	if group := p.getGroup(groupName); group != nil {
+		group.dropCopy(key)
+	}
+}
+
+func (p *TCPPool) purgeHotCaches() {
+	for _, group := range poolGroups(p.groups) {
+		group.hotCache.removePrefix("")
+	}
+}
+
+// Serve answers peers' requests on connections accepted from l. It
+// returns when l fails, e.g. because it was closed.
+func (p *TCPPool) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveConn(conn)
+	}
+}
+
+func (p *TCPPool) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if p.opts.TLS != nil {
+		var err error
+		if conn, err = p.serveTLS(conn); err != nil {
+			p.Log("tls handshake with %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	r := bufio.NewReader(conn)
+
+	hello := &pb.Hello{}
+	if err := readFrame(r, hello); err != nil {
+		p.Log("handshake with %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if err := p.verifyHello(hello); err != nil {
+		p.Log("refused %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	version := negotiate(hello.Versions)
+	reply := &pb.Hello{}
+	if version != 0 {
+		reply.Versions = []uint32{version}
+	}
+	if err := writeFrame(conn, reply); err != nil || version == 0 {
+		p.Log("no common protocol version with %s, it speaks %v", conn.RemoteAddr(), hello.Versions)
+		return
+	}
+
+	// cancel requests still being served once the connection is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wmu sync.Mutex
+	slots := make(chan struct{}, maxConnRequests)
+	for {
+		req := &pb.Frame{}
+		if err := readFrame(r, req); err != nil {
+			if err != io.EOF {
+				p.Log("reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots }()
+			res := p.serveFrame(ctx, req)
+			wmu.Lock()
+			defer wmu.Unlock()
+			// a client that stops reading mustn't hold up the others
+			conn.SetWriteDeadline(time.Now().Add(p.opts.Timeout))
+			if err := writeFrame(conn, res); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// serveFrame answers a request frame.
+func (p *TCPPool) serveFrame(ctx context.Context, req *pb.Frame) *pb.Frame {
+	res := &pb.Frame{Id: req.Id}
+	if req.Op == opBus {
+		if req.Invalidations == nil {
+			res.Error = "no invalidations"
+		} else {
+			res.Ack = &pb.InvalidationAck{Seq: p.bus.receive(req.Invalidations)}
+		}
+		return res
+	}
+	group := p.getGroup(req.Request.GetGroup())
+	if group == nil {
+		res.Error = "no such group: " + req.Request.GetGroup()
+		return res
+	}
+	key := req.Request.GetKey()
+	switch req.Op {
+	case "":
+		out, err := group.answer(ctx, req.Request, false)
+		if errors.Is(err, ErrOverloaded) {
+			res.Error = ErrOverloaded.Error()
+		} else if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Response = out
+		}
+	case opSet:
+		e := req.GetEntry()
+		v, err := group.peerView(key, e.GetValue(), e.GetExpire(), e.GetCompression(), e.GetKeyId())
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		group.setLocally(key, v, e.GetTags())
+	case opRemove:
+		// a Response marks the key as removed
+		if group.removeLocally(key) {
+			res.Response = &pb.Response{}
+		}
+	case opTouch:
+		// a Response marks the key as touched
+		if group.touchLocally(key, fromUnixNano(req.Entry.GetExpire())) {
+			res.Response = &pb.Response{}
+		}
+	case opLeaseSet:
+		e := req.GetEntry()
+		v, err := group.peerView(key, e.GetValue(), e.GetExpire(), e.GetCompression(), e.GetKeyId())
+		if err == nil {
+			err = group.leaseSetLocally(key, req.Response.GetLease(), v)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+	case opKeepWarm:
+		interval := time.Duration(req.Entry.GetExpire())
+		if interval < 0 {
+			res.Error = "bad interval"
+			break
+		}
+		// registered even if our view of the ring disagrees, as over HTTP
+		group.keepWarmLocally(key, interval)
+	case opGeneration:
+		group.setGeneration(req.Request.GetGeneration())
+	case opTag:
+		group.invalidateTagLocally(key)
+	case opPrefix:
+		group.invalidatePrefixLocally(key)
+	default:
+		res.Error = "unknown operation: " + req.Op
+	}
+	return res
+}
+
+// serveTLS runs the server side of a TLS handshake on conn, and checks
+// the client's certificate if mutual TLS is on.
+func (p *TCPPool) serveTLS(conn net.Conn) (net.Conn, error) {
+	config, err := p.opts.TLS.ServerConfig()
+	if err != nil {
+		return conn, err
+	}
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return conn, err
+	}
+	if !p.authorized(tlsConn.ConnectionState()) {
+		return conn, errors.New("client certificate names no member")
+	}
+	return tlsConn, nil
+}
+
+// authorized reports whether the client certificate in cs, if mutual TLS
+// is on, names the host of one of the pool's peers.
+func (p *TCPPool) authorized(cs tls.ConnectionState) bool {
+	if !p.opts.TLS.Mutual {
+		return true
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	members := append([]string{p.self}, p.members...)
+	p.mu.Unlock()
+	for _, member := range members {
+		host, _, err := net.SplitHostPort(member)
+		if err == nil && cs.PeerCertificates[0].VerifyHostname(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyHello checks the signature of a client's Hello, if the pool has
+// PeerKeys. A client signs the address it dialed, so that its Hello
+// can't be replayed to another node.
+func (p *TCPPool) verifyHello(hello *pb.Hello) error {
+	keys := p.opts.Keys
+	if keys == nil {
+		return nil
+	}
+	if len(hello.Signature) == 0 {
+		if keys.Enforce {
+			return errors.New("connection is not signed")
+		}
+		return nil
+	}
+	msg, err := keys.VerifyMessage(hello.Signature)
+	if err != nil {
+		return err
+	}
+	if string(msg) != p.self {
+		return fmt.Errorf("connection signed for %s", msg)
+	}
+	return nil
+}
+
+// negotiate returns the newest version in offered that this node speaks,
+// or 0 if there is none.
+func negotiate(offered []uint32) uint32 {
+	for i := len(tcpVersions) - 1; i >= 0; i-- {
+		if slices.Contains(offered, tcpVersions[i]) {
+			return tcpVersions[i]
+		}
+	}
+	return 0
+}
+
+// tcpGetter fetches values from one peer over up to Conns connections,
+// dialed as they are needed and redialed when they fail.
+type tcpGetter struct {
+	addr   string
+	opts   *TCPPoolOptions
+	dialMu sync.Mutex // held while dialing
+	mu     sync.Mutex // guards the rest
+	conns  []*tcpConn
+	next   int
+	closed bool
+}
+
+func (g *tcpGetter) Get(in *pb.Request, out *pb.Response) error {
+	return g.GetContext(context.Background(), in, out)
+}
+
+func (g *tcpGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	ctx, cancel := context.WithTimeout(ctx, g.opts.Timeout)
+	defer cancel()
+	c, err := g.conn(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := c.roundTrip(ctx, &pb.Frame{Request: in})
+	if err != nil {
+		return err
+	}
+	if res.Error == ErrOverloaded.Error() {
+		return ErrOverloaded
+	}
+	if res.Error != "" {
+		return fmt.Errorf("server returned: %v", res.Error)
+	}
+	proto.Merge(out, res.Response)
+	return nil
+}
+
+func (g *tcpGetter) Set(group string, e *pb.Entry) error {
+	return g.command(&pb.Frame{
+		Op:      opSet,
+		Request: &pb.Request{Group: group, Key: e.GetKey()},
+		Entry:   e,
+	}, nil)
+}
+
+func (g *tcpGetter) LeaseSet(group string, token uint64, e *pb.Entry) error {
+	return g.command(&pb.Frame{
+		Op:       opLeaseSet,
+		Request:  &pb.Request{Group: group, Key: e.GetKey()},
+		Response: &pb.Response{Lease: token},
+		Entry:    e,
+	}, nil)
+}
+
+func (g *tcpGetter) KeepWarm(group, key string, interval time.Duration) error {
+	return g.command(&pb.Frame{
+		Op:      opKeepWarm,
+		Request: &pb.Request{Group: group, Key: key},
+		Entry:   &pb.Entry{Expire: int64(interval)},
+	}, nil)
+}
+
+func (g *tcpGetter) Remove(group, key string) (bool, error) {
+	var removed bool
+	err := g.command(&pb.Frame{Op: opRemove, Request: &pb.Request{Group: group, Key: key}}, func(res *pb.Frame) {
+		removed = res.Response != nil
+	})
+	return removed, err
+}
+
+func (g *tcpGetter) Touch(group, key string, expire time.Time) (bool, error) {
+	var touched bool
+	err := g.command(&pb.Frame{
+		Op:      opTouch,
+		Request: &pb.Request{Group: group, Key: key},
+		Entry:   &pb.Entry{Expire: unixNano(expire)},
+	}, func(res *pb.Frame) {
+		touched = res.Response != nil
+	})
+	return touched, err
+}
+
+func (g *tcpGetter) InvalidateAll(group string, generation uint64) error {
+	return g.command(&pb.Frame{Op: opGeneration, Request: &pb.Request{Group: group, Generation: generation}}, nil)
+}
+
+func (g *tcpGetter) InvalidateTag(group, tag string) error {
+	return g.command(&pb.Frame{Op: opTag, Request: &pb.Request{Group: group, Key: tag}}, nil)
+}
+
+func (g *tcpGetter) InvalidatePrefix(group, prefix string) error {
+	return g.command(&pb.Frame{Op: opPrefix, Request: &pb.Request{Group: group, Key: prefix}}, nil)
+}
+
+func (g *tcpGetter) sendInvalidations(batch *pb.InvalidationBatch) (uint64, error) {
+	var ack uint64
+	err := g.command(&pb.Frame{Op: opBus, Invalidations: batch}, func(res *pb.Frame) {
+		ack = res.Ack.GetSeq()
+	})
+	return ack, err
+}
+
+// command sends a write or invalidation to the peer and passes the
+// response to fn, if fn isn't nil.
+func (g *tcpGetter) command(req *pb.Frame, fn func(res *pb.Frame)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
+	defer cancel()
+	c, err := g.conn(ctx)
+	if err != nil {
+		return err
+	}
+	if c.version < opVersion(req.Op) {
+		return fmt.Errorf("%s speaks protocol %d, which has no %s", g.addr, c.version, req.Op)
+	}
+	res, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return err
+	}
+	if res.Error == ErrLeaseInvalid.Error() {
+		return ErrLeaseInvalid
+	}
+	if res.Error != "" {
+		return fmt.Errorf("server returned: %v", res.Error)
+	}
+	if fn != nil {
+		fn(res)
+	}
+	return nil
+}
+
+var _ PeerGetter = (*tcpGetter)(nil)
+var _ PeerContextGetter = (*tcpGetter)(nil)
+var _ PeerSetter = (*tcpGetter)(nil)
+var _ PeerRemover = (*tcpGetter)(nil)
+var _ PeerToucher = (*tcpGetter)(nil)
+var _ PeerLeaser = (*tcpGetter)(nil)
+var _ PeerWarmer = (*tcpGetter)(nil)
+var _ PeerInvalidator = (*tcpGetter)(nil)
+
+// conn returns the next connection in turn, dialing a new one if there
+// are fewer than Conns that still work. Dials are made one at a time and
+// without holding g.mu, so that requests on the connections already open
+// aren't held up by them.
+func (g *tcpGetter) conn(ctx context.Context) (*tcpConn, error) {
+	if c, ok, err := g.openConn(); ok {
+		return c, err
+	}
+	g.dialMu.Lock()
+	defer g.dialMu.Unlock()
+	// another request may have dialed meanwhile
+	if c, ok, err := g.openConn(); ok {
+		return c, err
+	}
+	c, err := dialTCP(ctx, g.addr, g.opts)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		c.fail(errPoolClosed)
+		return nil, errPoolClosed
+	}
+	g.conns = append(g.conns, c)
+	return c, nil
+}
+
+// openConn returns the next open connection in turn, or ok false if there
+// is room for another.
+func (g *tcpGetter) openConn() (c *tcpConn, ok bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil, true, errPoolClosed
+	}
+	g.conns = slices.DeleteFunc(g.conns, (*tcpConn).broken)
+	if len(g.conns) < g.opts.Conns {
+		return nil, false, nil
+	}
+	g.next++
+	return g.conns[g.next%len(g.conns)], true, nil
+}
+
+func (g *tcpGetter) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	for _, c := range g.conns {
+		c.fail(errPoolClosed)
+	}
+	g.conns = nil
+}
+
+// tcpConn is a client connection to a peer, with any number of requests
+// in flight.
+type tcpConn struct {
+	conn    net.Conn
+	version uint32        // the protocol version agreed on
+	timeout time.Duration // bounds writes without a deadline of their own
+	wmu     sync.Mutex    // serializes writes
+	mu      sync.Mutex    // guards the rest
+	nextID  uint64
+	pending map[uint64]chan *pb.Frame
+	err     error // why the connection failed
+}
+
+// dialTCP connects to addr, over TLS and signing the connection if opts
+// say so, and agrees on a protocol version.
+func dialTCP(ctx context.Context, addr string, opts *TCPPoolOptions) (*tcpConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if opts.TLS != nil {
+		var config *tls.Config
+		if config, err = opts.TLS.ClientConfig(); err == nil {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+			conn = tls.Client(conn, config)
+		}
+	}
+	out := &pb.Hello{Versions: tcpVersions}
+	if err == nil && opts.Keys != nil {
+		out.Signature, err = opts.Keys.SignMessage([]byte(addr))
+	}
+	r := bufio.NewReader(conn)
+	hello := &pb.Hello{}
+	if err == nil {
+		err = writeFrame(conn, out)
+	}
+	if err == nil {
+		err = readFrame(r, hello)
+	}
+	if err == nil && (len(hello.Versions) != 1 || !slices.Contains(tcpVersions, hello.Versions[0])) {
+		err = fmt.Errorf("no common protocol version with %s", addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &tcpConn{conn: conn, version: hello.Versions[0], timeout: opts.Timeout, pending: make(map[uint64]chan *pb.Frame)}
+	go c.readLoop(r)
+	return c, nil
+}
+
+// roundTrip sends req, with a new id, and waits for the response to it.
+func (c *tcpConn) roundTrip(ctx context.Context, req *pb.Frame) (*pb.Frame, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan *pb.Frame, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	req.Id = id
+	c.wmu.Lock()
+	// a peer that stops reading fails the connection rather than hold
+	// up every request waiting to write
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	err := writeFrame(c.conn, req)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		return res, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop hands responses to the requests waiting for them.
+func (c *tcpConn) readLoop(r *bufio.Reader) {
+	for {
+		res := &pb.Frame{}
+		if err := readFrame(r, res); err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[res.Id]
+		delete(c.pending, res.Id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- res
+		}
+	}
+}
+
+// fail closes the connection and fails every request still waiting on it.
+func (c *tcpConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		for _, ch := range c.pending {
+			close(ch)
+		}
+		c.pending = nil
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+func (c *tcpConn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// writeFrame writes m preceded by its length as a big-endian uint32.
+func writeFrame(w io.Writer, m proto.Message) error {
+	body, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+// readFrame reads a message written by writeFrame into m.
+func readFrame(r io.Reader, m proto.Message) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return proto.Unmarshal(body, m)
+}
@@ -0,0 +1,452 @@
+package geecache
+
+import (
+	pb "Dcache/7_proto-buf/geecache/geecachepb"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type tcpNode struct {
+	pool  *TCPPool
+	group *Group
+	l     net.Listener
+}
+
+// newTCPCluster runs n nodes of a group over TCPPools in this process.
+func newTCPCluster(t testing.TB, n int, name string, getter Getter, opts *TCPPoolOptions) []*tcpNode {
+	t.Helper()
+	var nodes []*tcpNode
+	var addrs []string
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &tcpNode{l: l, group: newGroup(name, 2<<10, getter)}
+		node.pool = NewTCPPoolOpts(l.Addr().String(), opts)
+		node.pool.groups = map[string]*Group{name: node.group}
+		go node.pool.Serve(l)
+		nodes = append(nodes, node)
+		addrs = append(addrs, l.Addr().String())
+	}
+	for _, node := range nodes {
+		node.pool.Set(addrs...)
+		node.group.RegisterPeers(node.pool)
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.pool.Set()
+			node.l.Close()
+		}
+	})
+	return nodes
+}
+
+func TestTCPPool(t *testing.T) {
+	var loads atomic.Int32
+	nodes := newTCPCluster(t, 2, "tcp", GetterFunc(
+		func(key string) ([]byte, error) {
+			loads.Add(1)
+			if key == "missing" {
+				return nil, errors.New("missing not exist")
+			}
+			return []byte(key), nil
+		}), &TCPPoolOptions{Conns: 1})
+
+	// many requests in flight on the one connection
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := nodes[0].group.Get(key); err != nil || v.String() != key {
+				t.Errorf("expected %s, got %v, %v", key, v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := loads.Load(); n != 50 {
+		t.Fatalf("expected each key loaded once, got %d loads", n)
+	}
+
+	remote := 0
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, ok := nodes[1].group.mainCache.get(nodes[1].group.cacheKey(key)); ok {
+			remote++
+		}
+	}
+	if remote == 0 {
+		t.Fatal("expected some keys to be loaded by the other node")
+	}
+
+	var peer *tcpGetter
+	for i := 0; peer == nil; i++ {
+		if p, ok := nodes[0].pool.PickPeer(fmt.Sprintf("key-%d", i)); ok {
+			peer = p.(*tcpGetter)
+		}
+	}
+	if len(peer.conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(peer.conns))
+	}
+	err := peer.Get(&pb.Request{Group: "tcp", Key: "missing"}, &pb.Response{})
+	if err == nil || err.Error() != "server returned: missing not exist" {
+		t.Fatalf("expected the getter's error, got %v", err)
+	}
+
+	// a broken connection is redialed
+	peer.conns[0].conn.Close()
+	if !waitFor(time.Second, func() bool { return peer.conns[0].broken() }) {
+		t.Fatal("expected the connection to notice it was closed")
+	}
+	res := &pb.Response{}
+	if err := peer.Get(&pb.Request{Group: "tcp", Key: "key-0"}, res); err != nil || string(res.Value) != "key-0" {
+		t.Fatalf("expected key-0 over a new connection, got %q, %v", res.Value, err)
+	}
+}
+
+func TestTCPContext(t *testing.T) {
+	release := make(chan struct{})
+	nodes := newTCPCluster(t, 1, "tcp-context", GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "slow" {
+				<-release
+			}
+			return []byte(key), nil
+		}), nil)
+	defer close(release)
+	peer := &tcpGetter{addr: nodes[0].l.Addr().String(), opts: &nodes[0].pool.opts}
+	defer peer.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := peer.GetContext(ctx, &pb.Request{Group: "tcp-context", Key: "slow"}, &pb.Response{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	// the slow request doesn't hold the connection up
+	res := &pb.Response{}
+	if err := peer.Get(&pb.Request{Group: "tcp-context", Key: "fast"}, res); err != nil || string(res.Value) != "fast" {
+		t.Fatalf("expected fast, got %q, %v", res.Value, err)
+	}
+}
+
+func TestTCPVersionNegotiation(t *testing.T) {
+	nodes := newTCPCluster(t, 1, "tcp-version", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), nil)
+
+	conn, err := net.Dial("tcp", nodes[0].l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, &pb.Hello{Versions: []uint32{tcpVersion + 1}}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	hello := &pb.Hello{}
+	if err := readFrame(r, hello); err != nil {
+		t.Fatal(err)
+	}
+	if len(hello.Versions) != 0 {
+		t.Fatalf("expected no common version, got %v", hello.Versions)
+	}
+	if err := readFrame(r, &pb.Frame{}); err == nil {
+		t.Fatal("expected the server to hang up")
+	}
+
+	if v := negotiate([]uint32{tcpVersion, tcpVersion + 1}); v != tcpVersion {
+		t.Fatalf("expected version %d, got %d", tcpVersion, v)
+	}
+}
+
+func TestTCPPoolWrites(t *testing.T) {
+	nodes := newTCPCluster(t, 3, "tcp-writes", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("loaded-" + key), nil
+		}), nil)
+	var key string
+	var owner, other *tcpNode
+	for i := 0; owner == nil; i++ {
+		key = fmt.Sprintf("key-%d", i)
+		for _, node := range nodes[1:] {
+			if _, ok := node.pool.PickPeer(key); !ok {
+				owner = node
+			}
+		}
+	}
+	for _, node := range nodes[1:] {
+		if node != owner {
+			other = node
+		}
+	}
+	cached := func(node *tcpNode) (string, bool) {
+		v, ok := node.group.mainCache.get(node.group.cacheKey(key))
+		return v.String(), ok
+	}
+
+	other.group.hotCache.add(other.group.cacheKey(key), ByteView{b: []byte("old")})
+	if err := nodes[0].group.Set(key, []byte("new"), "t"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cached(owner); !ok || v != "new" {
+		t.Fatalf("expected the owner to store new, got %q", v)
+	}
+	if !waitFor(time.Second, func() bool {
+		_, ok := other.group.hotCache.get(other.group.cacheKey(key))
+		return !ok
+	}) {
+		t.Fatal("expected the write to be broadcast")
+	}
+
+	if err := nodes[0].group.InvalidateTag("t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cached(owner); ok {
+		t.Fatal("expected the tag to be invalidated on the owner")
+	}
+	nodes[0].group.Set(key, []byte("new"))
+	if removed, err := nodes[0].group.Remove(key); err != nil || !removed {
+		t.Fatalf("expected the owner to remove the key, got %v, %v", removed, err)
+	}
+	if _, ok := cached(owner); ok {
+		t.Fatal("expected the owner to remove the key")
+	}
+	if removed, err := nodes[0].group.Remove(key); err != nil || removed {
+		t.Fatalf("expected the key to be gone, got %v, %v", removed, err)
+	}
+	if err := nodes[0].group.InvalidateAll(); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes[1:] {
+		if node.group.Generation() != nodes[0].group.Generation() {
+			t.Fatal("expected every node to move to the new generation")
+		}
+	}
+}
+
+func TestTCPPoolSigned(t *testing.T) {
+	keys := func(secret string) *PeerKeys {
+		return &PeerKeys{Keys: map[string][]byte{"k1": []byte(secret)}, SignWith: "k1", Enforce: true}
+	}
+	nodes := newTCPCluster(t, 1, "tcp-signed", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), &TCPPoolOptions{Keys: keys("secret")})
+	addr := nodes[0].l.Addr().String()
+
+	tests := []struct {
+		name string
+		keys *PeerKeys
+		ok   bool
+	}{
+		{"signed", keys("secret"), true},
+		{"unsigned", nil, false},
+		{"wrong secret", keys("guess"), false},
+	}
+	for _, tt := range tests {
+		peer := &tcpGetter{addr: addr, opts: &TCPPoolOptions{Conns: 1, Timeout: time.Second, Keys: tt.keys}}
+		err := peer.Get(&pb.Request{Group: "tcp-signed", Key: "k"}, &pb.Response{})
+		peer.close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok %v, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestTCPPoolTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue("node", "127.0.0.1")
+	peerTLS := func(certFile, keyFile string) *PeerTLS {
+		return &PeerTLS{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file, Mutual: true}
+	}
+	nodes := newTCPCluster(t, 2, "tcp-tls", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte(key), nil
+		}), &TCPPoolOptions{TLS: peerTLS(certFile, keyFile)})
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if v, err := nodes[0].group.Get(key); err != nil || v.String() != key {
+			t.Fatalf("expected %s over TLS, got %v", key, err)
+		}
+	}
+	if st := nodes[0].group.Stats(); st.PeerErrors != 0 || st.PeerLoads == 0 {
+		t.Fatalf("expected node 0 to fetch from node 1, got %+v", st)
+	}
+
+	outsiderCert, outsiderKey := ca.issue("outsider", "outsider.test")
+	tests := []struct {
+		name string
+		tls  *PeerTLS
+	}{
+		{"plain", nil},
+		{"non-member", peerTLS(outsiderCert, outsiderKey)},
+	}
+	for _, tt := range tests {
+		peer := &tcpGetter{addr: nodes[0].l.Addr().String(), opts: &TCPPoolOptions{Conns: 1, Timeout: time.Second, TLS: tt.tls}}
+		if err := peer.Get(&pb.Request{Group: "tcp-tls", Key: "k"}, &pb.Response{}); err == nil {
+			t.Errorf("%s: expected the connection to be refused", tt.name)
+		}
+		peer.close()
+	}
+}
+
+// The benchmarks fetch a value cached on a peer, so they measure the
+// transport's round trip.
+
+func BenchmarkTCPPoolGet(b *testing.B) {
+	nodes := newTCPCluster(b, 1, "bench-tcp", GetterFunc(
+		func(key string) ([]byte, error) {
+			return make([]byte, 1024), nil
+		}), nil)
+	nodes[0].group.Get("k")
+	peer := &tcpGetter{addr: nodes[0].l.Addr().String(), opts: &nodes[0].pool.opts}
+	defer peer.close()
+	benchmarkPeerGet(b, peer, "bench-tcp")
+}
+
+func BenchmarkHTTPPoolGet(b *testing.B) {
+	g := newGroup("bench-http", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return make([]byte, 1024), nil
+		}))
+	g.Get("k")
+	srv := httptest.NewUnstartedServer(nil)
+	pool := NewHTTPPool("http://" + srv.Listener.Addr().String())
+	pool.groups = map[string]*Group{"bench-http": g}
+	srv.Config.Handler = pool
+	srv.Start()
+	defer srv.Close()
+	benchmarkPeerGet(b, &httpGetter{baseURL: srv.URL + defaultBasePath}, "bench-http")
+}
+
+func benchmarkPeerGet(b *testing.B, peer PeerGetter, group string) {
+	b.ReportAllocs()
+	b.RunParallel(func(bp *testing.PB) {
+		for bp.Next() {
+			res := &pb.Response{}
+			if err := peer.Get(&pb.Request{Group: group, Key: "k"}, res); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestTCPPoolLeaseAndKeepWarm(t *testing.T) {
+	nodes := newTCPCluster(t, 2, "tcp-lease", GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("loaded-" + key), nil
+		}), nil)
+	var key string
+	for i := 0; key == ""; i++ {
+		if _, ok := nodes[0].pool.PickPeer(fmt.Sprintf("key-%d", i)); ok {
+			key = fmt.Sprintf("key-%d", i)
+		}
+	}
+	owner := nodes[1].group
+
+	lease, err := nodes[0].group.LeaseGet(key)
+	if err != nil || lease.Token == 0 {
+		t.Fatalf("expected a lease on %s, got %+v, %v", key, lease, err)
+	}
+	if err := nodes[0].group.LeaseSet(key, lease.Token+1, []byte("filled")); err != ErrLeaseInvalid {
+		t.Fatalf("expected a wrong token to be refused, got %v", err)
+	}
+	if err := nodes[0].group.LeaseSet(key, lease.Token, []byte("filled")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := owner.lookupCache(key); !ok || v.String() != "filled" {
+		t.Fatalf("expected the owner to be filled, got %q", v)
+	}
+
+	if err := nodes[0].group.KeepWarm(key, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !owner.warm.registered(key) {
+		t.Fatal("expected the owner to keep the key warm")
+	}
+}
+
+func TestTCPWriteDeadline(t *testing.T) {
+	// a peer that answers the handshake, then stops reading
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readFrame(bufio.NewReader(conn), &pb.Hello{})
+		writeFrame(conn, &pb.Hello{Versions: []uint32{tcpVersion}})
+		<-done
+	}()
+	opts := &TCPPoolOptions{Conns: 1, Timeout: 100 * time.Millisecond}
+	peer := &tcpGetter{addr: l.Addr().String(), opts: opts}
+	defer peer.close()
+
+	// more than the socket buffers hold
+	e := &pb.Entry{Key: "k", Value: make([]byte, 32<<20)}
+	start := time.Now()
+	if err := peer.Set("g", e); err == nil {
+		t.Fatal("expected the write to time out")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("expected the write to give up after its timeout, took %v", d)
+	}
+}
+
+func TestTCPConnRequestsCapped(t *testing.T) {
+	var running, most atomic.Int32
+	release := make(chan struct{})
+	nodes := newTCPCluster(t, 1, "tcp-cap", GetterFunc(
+		func(key string) ([]byte, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := most.Load()
+				if n <= m || most.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			<-release
+			return []byte(key), nil
+		}), nil)
+	peer := &tcpGetter{addr: nodes[0].l.Addr().String(), opts: &TCPPoolOptions{Conns: 1, Timeout: 5 * time.Second}}
+	defer peer.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxConnRequests+50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peer.Get(&pb.Request{Group: "tcp-cap", Key: fmt.Sprintf("key-%d", i)}, &pb.Response{})
+		}()
+	}
+	if !waitFor(time.Second, func() bool { return running.Load() == maxConnRequests }) {
+		t.Fatalf("expected %d requests to be served at once, got %d", maxConnRequests, running.Load())
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := most.Load(); n != maxConnRequests {
+		t.Fatalf("expected at most %d requests served at once, got %d", maxConnRequests, n)
+	}
+}
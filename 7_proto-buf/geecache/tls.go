@@ -0,0 +1,251 @@
+package geecache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultTLSReloadInterval = time.Minute
+
+// PeerTLS secures the traffic between peers with TLS. Peers are then
+// addressed by https:// URLs. The certificate files are polled and
+// reloaded when they change, so certificates can be rotated without a
+// restart.
+type PeerTLS struct {
+	// CertFile and KeyFile hold this node's PEM certificate and key. The
+	// node presents the certificate both as a server and, with Mutual, as
+	// a client.
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the PEM certificates of the CAs peers' certificates are
+	// verified against. If blank, the system roots are used.
+	CAFile string
+
+	// Mutual requires peers to present a client certificate issued by
+	// CAFile and naming the host of one of the pool's members.
+	Mutual bool
+
+	// ReloadInterval specifies how often the files are checked for
+	// changes. If blank, it defaults to 1m; if negative, they are only
+	// reloaded by Reload.
+	ReloadInterval time.Duration
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes [3]time.Time
+	watching sync.Once
+}
+
+// Reload reads the certificate files again. On error the certificates
+// loaded before are kept.
+func (t *PeerTLS) Reload() error {
+	modTimes, err := t.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return err
+	}
+	var roots *x509.CertPool
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	t.mu.Lock()
+	t.cert, t.roots, t.modTimes = &cert, roots, modTimes
+	t.mu.Unlock()
+	return nil
+}
+
+// stat returns the modification times of the files.
+func (t *PeerTLS) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, name := range []string{t.CertFile, t.KeyFile, t.CAFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load loads the files the first time it is called and starts watching
+// them for changes.
+func (t *PeerTLS) load() error {
+	t.mu.RLock()
+	loaded := t.cert != nil
+	t.mu.RUnlock()
+	if !loaded {
+		if err := t.Reload(); err != nil {
+			return err
+		}
+	}
+	if t.ReloadInterval >= 0 {
+		t.watching.Do(func() { go t.watch() })
+	}
+	return nil
+}
+
+func (t *PeerTLS) watch() {
+	interval := t.ReloadInterval
+	if interval == 0 {
+		interval = defaultTLSReloadInterval
+	}
+	for {
+		time.Sleep(interval)
+		modTimes, err := t.stat()
+		t.mu.RLock()
+		changed := modTimes != t.modTimes
+		t.mu.RUnlock()
+		if err != nil || !changed {
+			continue
+		}
+		if err := t.Reload(); err != nil {
+			log.Println("[GeeCache] Failed to reload TLS certificates", err)
+			continue
+		}
+		log.Println("[GeeCache] reloaded TLS certificates")
+	}
+}
+
+func (t *PeerTLS) current() (*tls.Certificate, *x509.CertPool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, t.roots
+}
+
+// ServerConfig returns the configuration for the server the pool is served
+// by, e.g. as http.Server.TLSConfig.
+func (t *PeerTLS) ServerConfig() (*tls.Config, error) {
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// a config per handshake picks up reloaded certificates
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, roots := t.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if t.Mutual {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = roots
+			}
+			return config, nil
+		},
+	}, nil
+}
+
+// ClientConfig returns the configuration for requests to peers.
+func (t *PeerTLS) ClientConfig() (*tls.Config, error) {
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// The peer's certificate is verified in VerifyConnection instead,
+		// against the CAs loaded last.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("peer presented no certificate")
+			}
+			_, roots := t.current()
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}, nil
+}
+
+// transport returns the RoundTripper for requests to peers.
+func (p *HTTPPool) transport() http.RoundTripper {
+	p.rtOnce.Do(func() {
+		p.rt = p.opts.Transport
+		if p.rt == nil && p.opts.TLS != nil {
+			config, err := p.opts.TLS.ClientConfig()
+			if err != nil {
+				// the same files failed in TLSConfig already, or will
+				p.Log("tls: %v", err)
+				config = &tls.Config{MinVersion: tls.VersionTLS12}
+			}
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = config
+			p.rt = t
+		}
+		if p.opts.Keys != nil {
+			p.rt = &signingTransport{keys: p.opts.Keys, base: p.rt}
+		}
+	})
+	return p.rt
+}
+
+// TLSConfig returns the TLS configuration to serve the pool with, or nil
+// if the pool has no PeerTLS.
+func (p *HTTPPool) TLSConfig() (*tls.Config, error) {
+	if p.opts.TLS == nil {
+		return nil, nil
+	}
+	return p.opts.TLS.ServerConfig()
+}
+
+// authorized reports whether the client certificate of r, if mutual TLS is
+// on, names the host of one of the pool's members.
+func (p *HTTPPool) authorized(r *http.Request) bool {
+	if p.opts.TLS == nil || !p.opts.TLS.Mutual {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	p.mu.Lock()
+	members := append([]string{p.self}, p.members...)
+	p.mu.Unlock()
+	for _, member := range members {
+		u, err := url.Parse(member)
+		if err == nil && cert.VerifyHostname(u.Hostname()) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package geecache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the CA certificate, PEM encoded
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.create(name, nil, nil)
+	ca.file, _ = ca.write(name, ca.cert, ca.key)
+	return ca
+}
+
+// create makes a certificate signed by parent, or a self-signed CA if
+// parent is nil.
+func (ca *testCA) create(name string, hosts []string, parent *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	signer := key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent = tmpl
+	} else {
+		signer = ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write writes cert and key as PEM files and returns their names.
+func (ca *testCA) write(name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert.Raw},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: der},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			ca.t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// issue writes a certificate for hosts and its key, and returns their
+// file names.
+func (ca *testCA) issue(name string, hosts ...string) (string, string) {
+	cert, key := ca.create(name, hosts, ca.cert)
+	return ca.write(name, cert, key)
+}
+
+// client returns a client that presents the certificate of name, if
+// not empty, and trusts ca.
+func (ca *testCA) client(name string) *http.Client {
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AddCert(ca.cert)
+	if name != "" {
+		cert, err := tls.LoadX509KeyPair(ca.issue(name, name))
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// newTLSNode starts a node served over TLS with peerTLS.
+func newTLSNode(t *testing.T, name string, getter Getter, peerTLS *PeerTLS) *testNode {
+	t.Helper()
+	node := &testNode{}
+	node.srv = httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			node.pool.ServeHTTP(w, r)
+		}))
+	node.addr = "https://" + node.srv.Listener.Addr().String()
+	node.group = newGroup(name, 2<<10, getter)
+	node.pool = NewHTTPPoolOpts(node.addr, &HTTPPoolOptions{TLS: peerTLS, HealthInterval: -1})
+	node.pool.groups = map[string]*Group{name: node.group}
+	config, err := node.pool.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.srv.TLS = config
+	node.srv.StartTLS()
+	t.Cleanup(node.srv.Close)
+	return node
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		return []byte("v-" + key), nil
+	})
+	var nodes []*testNode
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		certFile, keyFile := ca.issue(fmt.Sprintf("node%d", i), "127.0.0.1")
+		node := newTLSNode(t, "mtls", getter, &PeerTLS{
+			CertFile: certFile, KeyFile: keyFile, CAFile: ca.file, Mutual: true,
+		})
+		nodes = append(nodes, node)
+		addrs = append(addrs, node.addr)
+	}
+	for _, node := range nodes {
+		node.pool.Set(addrs...)
+		node.group.RegisterPeers(node.pool)
+	}
+
+	// every key is fetched through node 0, some from node 1 over mTLS
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if v, err := nodes[0].group.Get(key); err != nil || v.String() != "v-"+key {
+			t.Fatalf("expected v-%s, got %q, %v", key, v, err)
+		}
+	}
+	if st := nodes[1].group.Stats(); st.LocalLoads == 0 {
+		t.Fatalf("expected node 1 to load its keys, got %+v", st)
+	}
+	if st := nodes[0].group.Stats(); st.PeerErrors != 0 || st.PeerLoads == 0 {
+		t.Fatalf("expected node 0 to fetch from node 1, got %+v", st)
+	}
+
+	health := nodes[0].addr + defaultBasePath + "_health"
+	res, err := ca.client("127.0.0.1").Get(health)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("expected a member's certificate to be accepted, got %v, %v", res, err)
+	}
+	res.Body.Close()
+	res, err = ca.client("outsider.test").Get(health)
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a non-member's certificate to be refused, got %v, %v", res, err)
+	}
+	res.Body.Close()
+	if _, err := ca.client("").Get(health); err == nil {
+		t.Fatal("expected a client without a certificate to fail the handshake")
+	}
+	if _, err := newTestCA(t, "other").client("127.0.0.1").Get(health); err == nil {
+		t.Fatal("expected a certificate from another CA to fail the handshake")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue("node", "127.0.0.1")
+	peerTLS := &PeerTLS{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file, ReloadInterval: 10 * time.Millisecond}
+	node := newTLSNode(t, "tls-reload", GetterFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), peerTLS)
+	node.pool.Set(node.addr)
+	health := node.addr + defaultBasePath + "_health"
+
+	// rotate to a new CA, writing over the same files
+	next := newTestCA(t, "next")
+	cert, key := next.create("node", []string{"127.0.0.1"}, next.cert)
+	next.dir = ca.dir
+	next.write("node", cert, key)
+	next.write("ca", next.cert, next.key)
+	later := time.Now().Add(time.Second)
+	for _, file := range []string{certFile, keyFile, ca.file} {
+		os.Chtimes(file, later, later)
+	}
+
+	ok := waitFor(2*time.Second, func() bool {
+		res, err := next.client("").Get(health)
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	})
+	if !ok {
+		t.Fatal("expected the server to present the new certificate")
+	}
+	if _, err := ca.client("").Get(health); err == nil {
+		t.Fatal("expected the old CA to no longer verify the server")
+	}
+
+	// the pool's own client trusts the new CA too
+	view, err := (&httpGetter{baseURL: node.addr + defaultBasePath, transport: node.pool.transport()}).view()
+	if err != nil || len(view) != 1 {
+		t.Fatalf("expected the pool to reach itself, got %v, %v", view, err)
+	}
+}
@@ -1,19 +1,37 @@
 package main
 
 /*
-$ curl "http://localhost:9999/api?key=Tom"
-630
+$ curl "http://localhost:9999/v1/groups/scores/keys/Tom?encoding=raw"
+{"key":"Tom","value":"630","encoding":"raw"}
 
-$ curl "http://localhost:9999/api?key=kkk"
-kkk not exist
+$ curl "http://localhost:9999/v1/groups/scores/keys/kkk"
+{"error":{"code":"not_found","message":"kkk not found"}}
 */
 
 import (
-	"Dcache/6_single-flight/geecache"
+	"Dcache/7_proto-buf/geecache"
+	"Dcache/7_proto-buf/geecache/gossip"
+	"Dcache/7_proto-buf/geecache/logstore"
+	"Dcache/7_proto-buf/geecache/memcache"
+	"Dcache/7_proto-buf/geecache/resp"
+	"Dcache/7_proto-buf/geecache/rest"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var db = map[string]string{
@@ -29,58 +47,449 @@ func createGroup() *geecache.Group {
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
+			return nil, fmt.Errorf("%s %w", key, geecache.ErrNotFound)
 		}))
 }
 
-func startCacheServer(addr string, addrs []string, gee *geecache.Group) {
-	peers := geecache.NewHTTPPool(addr)
-	peers.Set(addrs...)
+// startCacheServer serves gee to its peers. If onPeers isn't nil, it is
+// called every time the peers change, starting with the first peers
+// discovered.
+func startCacheServer(addr, listen string, discovery geecache.Discovery, gee *geecache.Group,
+	opts *geecache.HTTPPoolOptions, onPeers func()) (*geecache.HTTPPool, *http.Server) {
+	peers := geecache.NewHTTPPoolOpts(addr, opts)
 	gee.RegisterPeers(peers)
+	if onPeers != nil {
+		peers.Watch(onPeers)
+	}
+	go func() {
+		err := peers.Discover(context.Background(), discovery, 5*time.Second)
+		log.Fatal(err)
+	}()
+	tlsConfig, err := peers.TLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: listen, Handler: peers, TLSConfig: tlsConfig}
+	go serve(server)
 	log.Println("geecache is running at", addr)
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	return peers, server
 }
 
-func startAPIServer(apiAddr string, gee *geecache.Group) {
-	http.Handle("/api", http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			key := r.URL.Query().Get("key")
-			view, err := gee.Get(key)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+// startAPIServer serves the JSON/REST API for every group through api.
+func startAPIServer(apiAddr string, api *rest.Server) *http.Server {
+	server := &http.Server{Addr: hostPort(apiAddr), Handler: api}
+	go serve(server)
+	log.Println("fontend server is running at", apiAddr)
+	return server
+}
+
+// startRESPServer lets Redis clients read the scores group, as database 0
+// or with keys like "scores:Tom".
+func startRESPServer(addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &resp.Server{DBs: map[int]string{0: "scores"}, Separator: ":"}
+	go s.Serve(l)
+	log.Println("redis frontend is running at", addr)
+	return l
+}
+
+// startMemcacheServer lets memcached clients read the scores group, with
+// keys like "Tom" or "scores:Tom".
+func startMemcacheServer(addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &memcache.Server{Group: "scores", Separator: ":"}
+	go s.Serve(l)
+	log.Println("memcached frontend is running at", addr)
+	return l
+}
+
+// loadPeerKeys reads the secrets peers sign their requests with from a
+// JSON file of the form {"sign_with": "k2", "keys": {"k1": "...", "k2": "..."}}.
+func loadPeerKeys(path string) (map[string][]byte, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var file struct {
+		SignWith string            `json:"sign_with"`
+		Keys     map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if _, ok := file.Keys[file.SignWith]; !ok {
+		return nil, "", fmt.Errorf("%s: no key %q to sign with", path, file.SignWith)
+	}
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, secret := range file.Keys {
+		keys[id] = []byte(secret)
+	}
+	return keys, file.SignWith, nil
+}
+
+// loadEncryptionKeys reads the keys cached values are encrypted with from a
+// JSON file of the form {"encrypt_with": "k2", "keys": {"k1": "...", "k2": "..."}},
+// where the keys are base64-encoded AES keys of 16, 24 or 32 bytes.
+func loadEncryptionKeys(path string) (map[string][]byte, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var file struct {
+		EncryptWith string            `json:"encrypt_with"`
+		Keys        map[string][]byte `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if _, ok := file.Keys[file.EncryptWith]; !ok {
+		return nil, "", fmt.Errorf("%s: no key %q to encrypt with", path, file.EncryptWith)
+	}
+	for id, key := range file.Keys {
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return nil, "", fmt.Errorf("%s: key %q is %d bytes, not 16, 24 or 32", path, id, n)
+		}
+	}
+	return file.Keys, file.EncryptWith, nil
+}
+
+// snapshotter keeps a snapshot of a group on disk, so that a restarted
+// node starts warm.
+type snapshotter struct {
+	group    *geecache.Group
+	path     string
+	interval time.Duration
+	once     sync.Once
+	restored atomic.Bool
+}
+
+// restore restores the group from its snapshot the first time it is
+// called, which should be once the peers are known so that the keys other
+// nodes own are skipped. From then on a snapshot is saved every interval.
+func (s *snapshotter) restore() {
+	s.once.Do(func() {
+		if err := s.group.LoadSnapshot(s.path); err != nil && !os.IsNotExist(err) {
+			log.Println("restore snapshot:", err)
+		}
+		s.restored.Store(true)
+		go func() {
+			for range time.Tick(s.interval) {
+				s.save()
 			}
-			w.Header().Set("Content-Type", "application/octet-stream")
-			w.Write(view.ByteSlice())
+		}()
+	})
+}
 
-		}))
-	log.Println("fontend server is running at", apiAddr)
-	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
+// save saves a snapshot, unless the old one hasn't been restored yet.
+func (s *snapshotter) save() {
+	if !s.restored.Load() {
+		return
+	}
+	if err := s.group.SaveSnapshot(s.path); err != nil {
+		log.Println("save snapshot:", err)
+	}
+}
 
+// onHangup calls reload on every SIGHUP.
+func onHangup(what string, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reload(); err != nil {
+			log.Printf("reload %s: %v", what, err)
+			continue
+		}
+		log.Println("reloaded", what)
+	}
+}
+
+// hostPort returns the host:port of a URL such as "https://localhost:8001".
+func hostPort(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return u.Host
+}
+
+func hostname(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return u.Hostname()
+}
+
+func serve(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		// the certificates come from TLSConfig
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
 func main() {
 	var port int
 	var api bool
+	var self string
+	var peers, peersFile, peersDNS string
+	var peersSRV bool
+	var gossipSeeds string
+	var drainTimeout time.Duration
+	var drainHandoff int
+	var respAddr string
+	var memcacheAddr string
+	var tlsCert, tlsKey, tlsCA string
+	var mutualTLS bool
+	var peerKeysFile string
+	var enforceSigning bool
+	var apiACL string
+	var clientLimit, groupLimit rest.Limit
+	var loadLimit geecache.LoadLimit
+	var snapshotDir string
+	var snapshotInterval time.Duration
+	var arenaShards int
+	var l2Dir string
+	var l2Bytes int64
+	var compress string
+	var compressMinBytes int
+	var encryptionKeysFile string
 	flag.IntVar(&port, "port", 8001, "Geecache server port")
 	flag.BoolVar(&api, "api", false, "Start a api server?")
+	flag.StringVar(&self, "self", "",
+		"URL the peers reach this node at, as discovery lists it, e.g. http://10.0.0.2:8001; defaults to localhost")
+	flag.StringVar(&peers, "peers", "http://localhost:8001,http://localhost:8002,http://localhost:8003",
+		"Comma-separated peer URLs")
+	flag.StringVar(&peersFile, "peers-file", "", `JSON file of {"peers": [...]}, polled for changes`)
+	flag.StringVar(&peersDNS, "peers-dns", "", "DNS name whose A records are the peers, polled for changes")
+	flag.BoolVar(&peersSRV, "peers-srv", false, "Look -peers-dns up as an SRV record")
+	flag.StringVar(&gossipSeeds, "gossip-seeds", "",
+		"Comma-separated host:port of nodes to gossip with, on the UDP port matching -port")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long to wait for peers to let go on shutdown")
+	flag.IntVar(&drainHandoff, "drain-handoff", 1000, "Hottest entries per group handed to their new owners on shutdown")
+	flag.StringVar(&respAddr, "resp", "", "Address to serve Redis clients on, e.g. localhost:6379")
+	flag.StringVar(&memcacheAddr, "memcache", "", "Address to serve memcached clients on, e.g. localhost:11211")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate for peer traffic; peers are then https:// URLs")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM key of -tls-cert")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM CA certificates to verify peers with, instead of the system roots")
+	flag.BoolVar(&mutualTLS, "mtls", false, "Require peers to present certificates naming a member")
+	flag.StringVar(&peerKeysFile, "peer-keys", "",
+		`JSON file of {"sign_with": id, "keys": {id: secret}} to sign peer requests and gossip with, reloaded on SIGHUP`)
+	flag.BoolVar(&enforceSigning, "peer-keys-enforce", false, "Refuse unsigned peer requests and gossip")
+	flag.StringVar(&apiACL, "api-acl", "", "JSON file of the API tokens and the groups they may use, reloaded on SIGHUP; not with -resp or -memcache")
+	flag.Float64Var(&clientLimit.Rate, "api-client-rate", 0, "API requests a second allowed per token or client IP; 0 for no limit")
+	flag.IntVar(&clientLimit.Burst, "api-client-burst", 100, "API requests a client may burst to above -api-client-rate")
+	flag.Float64Var(&groupLimit.Rate, "api-group-rate", 0, "API requests a second allowed per group; 0 for no limit")
+	flag.IntVar(&groupLimit.Burst, "api-group-burst", 1000, "API requests a group may burst to above -api-group-rate")
+	flag.IntVar(&loadLimit.MaxConcurrent, "max-loads", 0, "Loads from the database allowed at once; 0 for no limit")
+	flag.IntVar(&loadLimit.MaxQueue, "load-queue", 0, "Loads that may wait for -max-loads; 0 for any, -1 for none")
+	flag.DurationVar(&loadLimit.QueueTarget, "load-target", 0, "Shed queued loads once one waits longer than this")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "Directory to keep snapshots of the cache in, restored at startup")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 5*time.Minute, "How often to snapshot the cache")
+	flag.IntVar(&arenaShards, "arena-shards", 0, "Keep the cache in an arena of this many shards, out of the GC's way")
+	flag.StringVar(&l2Dir, "l2-dir", "", "Directory to keep entries evicted from memory in, e.g. on local SSD; emptied at startup")
+	flag.Int64Var(&l2Bytes, "l2-bytes", 1<<30, "Disk space -l2-dir may take")
+	flag.StringVar(&compress, "compress", "", "Compress cached values with gzip or flate")
+	flag.IntVar(&compressMinBytes, "compress-min-bytes", 1<<10, "Values smaller than this are kept uncompressed")
+	flag.StringVar(&encryptionKeysFile, "encryption-keys", "",
+		`JSON file of {"encrypt_with": id, "keys": {id: base64 AES key}} to encrypt cached values with, reloaded on SIGHUP`)
 	flag.Parse()
+	// the Redis and memcached frontends have no tokens to check, so they
+	// would let anyone around the ACL
+	if apiACL != "" && (respAddr != "" || memcacheAddr != "") {
+		log.Fatal("-api-acl can't be used with -resp or -memcache, which don't check it")
+	}
 
 	apiAddr := "http://localhost:9999"
-	addrMap := map[int]string{
-		8001: "http://localhost:8001",
-		8002: "http://localhost:8002",
-		8003: "http://localhost:8003",
+	scheme := "http"
+	var peerTLS *geecache.PeerTLS
+	if tlsCert != "" {
+		scheme = "https"
+		peerTLS = &geecache.PeerTLS{CertFile: tlsCert, KeyFile: tlsKey, CAFile: tlsCA, Mutual: mutualTLS}
+	}
+	addr := fmt.Sprintf("%s://localhost:%d", scheme, port)
+	listen := hostPort(addr)
+	if self != "" {
+		// the advertised host may not be one to bind to, e.g. behind NAT
+		addr, listen = self, fmt.Sprintf(":%d", port)
+	}
+	var peerKeys *geecache.PeerKeys
+	if peerKeysFile != "" {
+		keys, signWith, err := loadPeerKeys(peerKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peerKeys = &geecache.PeerKeys{Keys: keys, SignWith: signWith, Enforce: enforceSigning}
+		go onHangup("peer keys", func() error {
+			keys, signWith, err := loadPeerKeys(peerKeysFile)
+			if err != nil {
+				return err
+			}
+			peerKeys.SetKeys(keys, signWith)
+			return nil
+		})
 	}
 
-	var addrs []string
-	for _, v := range addrMap {
-		addrs = append(addrs, v)
+	var discovery geecache.Discovery = geecache.StaticDiscovery(strings.Split(peers, ","))
+	var node *gossip.Node
+	switch {
+	case peersFile != "":
+		discovery = &geecache.FileDiscovery{Path: peersFile}
+	case peersDNS != "":
+		discovery = &geecache.DNSDiscovery{Name: peersDNS, SRV: peersSRV, Port: port, Scheme: scheme}
+	case gossipSeeds != "":
+		transport, err := gossip.ListenUDP(fmt.Sprintf(":%d", port))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg := gossip.Config{
+			Name:      addr,
+			Addr:      net.JoinHostPort(hostname(addr), strconv.Itoa(port)),
+			Seeds:     strings.Split(gossipSeeds, ","),
+			Transport: transport,
+		}
+		if peerKeys != nil {
+			// otherwise anyone who can send a packet can join the ring
+			cfg.Signer = peerKeys
+		}
+		node, err = gossip.New(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		discovery = node
 	}
 
 	gee := createGroup()
+	gee.SetLoadLimit(loadLimit)
+	switch compress {
+	case "":
+	case "gzip":
+		gee.SetCompression(geecache.Compression{Codec: geecache.GzipCodec{}, MinBytes: compressMinBytes})
+	case "flate":
+		gee.SetCompression(geecache.Compression{Codec: geecache.FlateCodec{}, MinBytes: compressMinBytes})
+	default:
+		log.Fatalf("unknown -compress %q", compress)
+	}
+	if encryptionKeysFile != "" {
+		keys, encryptWith, err := loadEncryptionKeys(encryptionKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encryptionKeys := &geecache.StaticKeys{Keys: keys, EncryptWith: encryptWith}
+		gee.SetEncryption(encryptionKeys)
+		go onHangup("encryption keys", func() error {
+			keys, encryptWith, err := loadEncryptionKeys(encryptionKeysFile)
+			if err != nil {
+				return err
+			}
+			encryptionKeys.SetKeys(keys, encryptWith)
+			return nil
+		})
+	}
+	if arenaShards > 0 {
+		gee.UseArena(arenaShards)
+	}
+	var l2 *logstore.Store
+	if l2Dir != "" {
+		var err error
+		if l2, err = logstore.Open(filepath.Join(l2Dir, gee.Name()), &logstore.Options{MaxBytes: l2Bytes}); err != nil {
+			log.Fatal(err)
+		}
+		if err := gee.SetL2(l2); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var apiServer *http.Server
 	if api {
-		go startAPIServer(apiAddr, gee)
+		var acl *rest.ACL
+		if apiACL != "" {
+			var err error
+			if acl, err = rest.LoadACL(apiACL); err != nil {
+				log.Fatal(err)
+			}
+			go onHangup("api acl", acl.Reload)
+		}
+		apiServer = startAPIServer(apiAddr, &rest.Server{
+			Timeout:     30 * time.Second,
+			ACL:         acl,
+			ClientLimit: clientLimit,
+			GroupLimit:  groupLimit,
+		})
+	}
+	var respListener net.Listener
+	if respAddr != "" {
+		respListener = startRESPServer(respAddr)
+	}
+	var memcacheListener net.Listener
+	if memcacheAddr != "" {
+		memcacheListener = startMemcacheServer(memcacheAddr)
+	}
+	var snapshots *snapshotter
+	var onPeers func()
+	if snapshotDir != "" {
+		snapshots = &snapshotter{
+			group:    gee,
+			path:     filepath.Join(snapshotDir, gee.Name()+".snapshot"),
+			interval: snapshotInterval,
+		}
+		onPeers = snapshots.restore
+	}
+	pool, server := startCacheServer(addr, listen, discovery, gee,
+		&geecache.HTTPPoolOptions{TLS: peerTLS, Keys: peerKeys}, onPeers)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	signal.Stop(sig)
+	// before the drain hands entries off to the other nodes
+	if snapshots != nil {
+		snapshots.save()
+	}
+
+	// Keep serving while the peers take this node out of their rings,
+	// then let in-flight requests finish.
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if node != nil {
+		node.Leave()
+	}
+	if err := pool.Drain(ctx, drainHandoff); err != nil {
+		log.Println("drain:", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if apiServer != nil {
+		apiServer.Shutdown(ctx)
+	}
+	if respListener != nil {
+		respListener.Close()
+	}
+	if memcacheListener != nil {
+		memcacheListener.Close()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
+	pool.Close()
+	if node != nil {
+		node.Stop()
+	}
+	if l2 != nil {
+		// write out what was evicted before closing the store
+		gee.SetL2(nil)
+		if err := l2.Close(); err != nil {
+			log.Println("close l2:", err)
+		}
 	}
-	startCacheServer(addrMap[port], addrs, gee)
 }
@@ -8,8 +8,8 @@ go build -o server
 
 sleep 2
 echo ">>> start test"
-curl "http://localhost:9999/api?key=Tom" &
-curl "http://localhost:9999/api?key=Tom" &
-curl "http://localhost:9999/api?key=Tom" &
+curl "http://localhost:9999/v1/groups/scores/keys/Tom" &
+curl "http://localhost:9999/v1/groups/scores/keys/Tom" &
+curl "http://localhost:9999/v1/groups/scores/keys/Tom" &
 
 wait
\ No newline at end of file
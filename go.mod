@@ -3,6 +3,6 @@ module Dcache
 go 1.24.4
 
 require (
-	github.com/golang/protobuf v1.5.4 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
+	github.com/golang/protobuf v1.5.4
+	google.golang.org/protobuf v1.33.0
 )